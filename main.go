@@ -1,36 +1,128 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"path/filepath"
-	"sync"
 
+	"github.com/banzaicloud/drone-plugin-k8s-client/plugin"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
-	label      = "label-name"
 	appName    = "k8s client plugin"
 	appVersion = "0.0.1"
+
+	// the length limit of DNS-1123 labels and the length of the hash shortened names are suffixed with
+	maxNameLength  = 63
+	nameHashLength = 8
+)
+
+var (
+	// the runs of characters not allowed in DNS-1123 labels
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+	// the names of the env vars read from the env file
+	envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// the names of the capabilities (eg. NET_ADMIN or ALL)
+	capabilityName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+	// sysctls allowed by default by the kubelet, any other sysctl needs to be enabled on the nodes
+	safeSysctls = map[string]bool{
+		"kernel.shm_rmid_forced":              true,
+		"net.ipv4.ip_local_port_range":        true,
+		"net.ipv4.ip_unprivileged_port_start": true,
+		"net.ipv4.tcp_syncookies":             true,
+		"net.ipv4.ping_group_range":           true,
+	}
+
+	// the supported types of the host paths
+	hostPathTypes = map[string]coreV1.HostPathType{
+		"DirectoryOrCreate": coreV1.HostPathDirectoryOrCreate,
+		"Directory":         coreV1.HostPathDirectory,
+		"FileOrCreate":      coreV1.HostPathFileOrCreate,
+		"File":              coreV1.HostPathFile,
+		"Socket":            coreV1.HostPathSocket,
+		"CharDevice":        coreV1.HostPathCharDev,
+		"BlockDevice":       coreV1.HostPathBlockDev,
+	}
+
+	// the pod fields exposed to env vars by the downward API
+	podFieldPaths = map[string]bool{
+		"metadata.name":           true,
+		"metadata.namespace":      true,
+		"metadata.uid":            true,
+		"spec.nodeName":           true,
+		"spec.serviceAccountName": true,
+		"status.hostIP":           true,
+		"status.hostIPs":          true,
+		"status.podIP":            true,
+		"status.podIPs":           true,
+	}
+
+	// the container resources exposed to env vars by the downward API
+	containerResources = map[string]bool{
+		"limits.cpu":                 true,
+		"limits.memory":              true,
+		"limits.ephemeral-storage":   true,
+		"requests.cpu":               true,
+		"requests.memory":            true,
+		"requests.ephemeral-storage": true,
+	}
+
+	portProtocols = map[string]coreV1.Protocol{
+		"TCP":  coreV1.ProtocolTCP,
+		"UDP":  coreV1.ProtocolUDP,
+		"SCTP": coreV1.ProtocolSCTP,
+	}
 )
 
+// keyValue represents a key=value pair passed in a flag
+type keyValue struct {
+	key   string
+	value string
+}
+
+func init() {
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.InfoLevel)
+}
+
 func main() {
 
 	app := cli.NewApp()
 	app.Name = appName
 	app.Usage = ""
 	app.Action = run
-	app.Version = fmt.Sprintf("%s", appVersion)
+	app.Version = appVersion
 	app.EnableBashCompletion = true
 
 	app.Flags = []cli.Flag{
@@ -41,17 +133,81 @@ func main() {
 			EnvVar: "PLUGIN_JOB_NAMESPACE",
 			Value:  "default",
 		},
+		cli.StringFlag{
+			Name:   "plugin.job.name.prefix",
+			Usage:  "the prefix of the job name, the name of the repository by default",
+			EnvVar: "PLUGIN_JOB_NAME_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.container.name",
+			Usage:  "the name of the job container (and of its workspace volume)",
+			EnvVar: "PLUGIN_JOB_CONTAINER_NAME",
+			Value:  "build",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.workspace.default",
+			Usage:  "the workspace of the job if drone doesn't set one (DRONE_WORKSPACE)",
+			EnvVar: "PLUGIN_JOB_WORKSPACE_DEFAULT",
+			Value:  "/drone/src",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.shell",
+			Usage:  "the shell running the commands of the step in the job container (eg. bash if the image provides it)",
+			EnvVar: "PLUGIN_JOB_SHELL",
+			Value:  "sh",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.generate.name",
+			Usage:  "let the API server generate a unique job name from the job name (avoids collisions of retried builds)",
+			EnvVar: "PLUGIN_JOB_GENERATE_NAME",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.on.exists",
+			Usage:  "what to do if the job already exists (eg. the plugin is retried): fail, adopt (watch the existing job) or replace it",
+			EnvVar: "PLUGIN_JOB_ON_EXISTS",
+			Value:  "fail",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.name",
+			Usage:  "the name of the job, overrides the generated one (required to adopt an existing job)",
+			EnvVar: "PLUGIN_JOB_NAME",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.adopt.existing",
+			Usage:  "only wait for the existing job named by plugin.job.name to complete, streaming its logs, instead of creating one",
+			EnvVar: "PLUGIN_JOB_ADOPT_EXISTING",
+		},
 		cli.StringFlag{
 			Name:   "plugin.original.image",
 			Usage:  "the image to ebe run on the cluster",
 			EnvVar: "PLUGIN_ORIGINAL_IMAGE",
 		},
+		cli.StringFlag{
+			Name:   "plugin.image.allowed.registries",
+			Usage:  "comma separated list of registry prefixes the image is allowed to come from (eg. docker.io/library,gcr.io/project)",
+			EnvVar: "PLUGIN_IMAGE_ALLOWED_REGISTRIES",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.image.pull.secrets",
+			Usage:  "comma separated list of the secrets used to pull the image",
+			EnvVar: "PLUGIN_JOB_IMAGE_PULL_SECRETS",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.image.track.digest",
+			Usage:  "record the digest of the image and report whether it changed since the previous build (for mutable tags)",
+			EnvVar: "PLUGIN_IMAGE_TRACK_DIGEST",
+		},
 		cli.StringFlag{
 			Name:   "plugin.proxy.service.account",
 			Usage:  "the service account name",
 			EnvVar: "PLUGIN_PROXY_SERVICE_ACCOUNT",
 			Value:  "default",
 		},
+		cli.BoolFlag{
+			Name:   "plugin.validate.sa",
+			Usage:  "check that the service account exists before running the job (the plugin needs to be allowed to get it)",
+			EnvVar: "PLUGIN_VALIDATE_SA",
+		},
 		cli.StringFlag{
 			Name:   "plugin.job.workspace",
 			Usage:  "repository full name",
@@ -59,14 +215,444 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "plugin.job.label.selector",
-			Usage:  "repository full name",
+			Usage:  "comma separated list of key=value labels set on the resources of the build and selecting them (eg. team=ci,app=web)",
 			EnvVar: "PLUGIN_JOB_LABEL_SELECTOR",
 		},
+		cli.StringFlag{
+			Name:   "plugin.kubeconfig.path",
+			Usage:  "the path to the kubeconfig file (defaults to $DRONE_WORKSPACE/.kube/config)",
+			EnvVar: "PLUGIN_KUBECONFIG_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.in.cluster",
+			Usage:  "use the service account of the plugin pod to access the cluster instead of a kubeconfig file",
+			EnvVar: "PLUGIN_IN_CLUSTER",
+		},
+		cli.StringFlag{
+			Name:   "plugin.api.server",
+			Usage:  "the URL of the API server, accessed with the token instead of a kubeconfig file if set",
+			EnvVar: "PLUGIN_API_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "plugin.api.token",
+			Usage:  "the bearer token to access the API server with (plugin.api.server)",
+			EnvVar: "PLUGIN_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "plugin.api.ca.cert",
+			Usage:  "the CA certificate of the API server (plugin.api.server), PEM encoded or the path to it",
+			EnvVar: "PLUGIN_API_CA_CERT",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.api.insecure",
+			Usage:  "skip verifying the certificate of the API server (plugin.api.server), for dev clusters only",
+			EnvVar: "PLUGIN_API_INSECURE",
+		},
+		cli.IntFlag{
+			Name:   "plugin.api.max.retries",
+			Usage:  "the number of times API calls failing with transient errors are retried",
+			EnvVar: "PLUGIN_API_MAX_RETRIES",
+			Value:  5,
+		},
+		cli.DurationFlag{
+			Name:   "plugin.api.timeout",
+			Usage:  "how long to wait for the API server to respond to a request, 0 waits forever (watches and log streams stay open)",
+			EnvVar: "PLUGIN_API_TIMEOUT",
+			Value:  30 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:   "plugin.preserve.workspace",
+			Usage:  "take a volume snapshot of the workspace before cleaning up after a failed build (if the cluster supports volume snapshots)",
+			EnvVar: "PLUGIN_PRESERVE_WORKSPACE",
+		},
+		cli.StringFlag{
+			Name:   "plugin.volume.snapshot.class",
+			Usage:  "the volume snapshot class of the workspace snapshot (the default class if not set)",
+			EnvVar: "PLUGIN_VOLUME_SNAPSHOT_CLASS",
+		},
+		cli.IntFlag{
+			Name:   "plugin.cleanup.concurrency",
+			Usage:  "the number of resources deleted concurrently when cleaning up",
+			EnvVar: "PLUGIN_CLEANUP_CONCURRENCY",
+			Value:  4,
+		},
+		cli.BoolFlag{
+			Name:   "plugin.show.events",
+			Usage:  "log the warning events of the job and its pods (eg. scheduling failures)",
+			EnvVar: "PLUGIN_SHOW_EVENTS",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.dry.run",
+			Usage:  "print the resources of the build as YAML instead of creating them",
+			EnvVar: "PLUGIN_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.redact.keys",
+			Usage:  "comma separated list of glob patterns, the values of the matching env vars are masked in the logs",
+			EnvVar: "PLUGIN_LOG_REDACT_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.env.allowlist",
+			Usage:  "comma separated list of glob patterns, only the matching PLUGIN_ / DRONE_ env vars are passed to the job",
+			EnvVar: "PLUGIN_ENV_ALLOWLIST",
+		},
+		cli.StringFlag{
+			Name:   "plugin.env.denylist",
+			Usage:  "comma separated list of glob patterns, the matching env vars are not passed to the job (even if allowed)",
+			EnvVar: "PLUGIN_ENV_DENYLIST",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.workspace.type",
+			Usage:  "the type of the workspace volume: pvc or emptydir (not persisted, no PVC is created)",
+			EnvVar: "PLUGIN_JOB_WORKSPACE_TYPE",
+			Value:  "pvc",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.workspace.size.limit",
+			Usage:  "the size limit of the emptydir workspace (eg. 2Gi)",
+			EnvVar: "PLUGIN_JOB_WORKSPACE_SIZE_LIMIT",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.workspace.readonly",
+			Usage:  "mount the workspace read-only into the job container (other containers mounting it may still write it)",
+			EnvVar: "PLUGIN_JOB_WORKSPACE_READONLY",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.ephemeral.storage.request",
+			Usage:  "the ephemeral storage request of the job container (eg. 1Gi)",
+			EnvVar: "PLUGIN_JOB_EPHEMERAL_STORAGE_REQUEST",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.ephemeral.storage.limit",
+			Usage:  "the ephemeral storage limit of the job container (eg. 4Gi)",
+			EnvVar: "PLUGIN_JOB_EPHEMERAL_STORAGE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.restart.policy",
+			Usage:  "the restart policy of the job pod: Never or OnFailure (the failed container is restarted in place)",
+			EnvVar: "PLUGIN_JOB_RESTART_POLICY",
+			Value:  "Never",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.termination.message.policy",
+			Usage:  "the termination message policy of the job container: File or FallbackToLogsOnError (the last log lines of the failed container)",
+			EnvVar: "PLUGIN_JOB_TERMINATION_MESSAGE_POLICY",
+			Value:  "FallbackToLogsOnError",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.affinity",
+			Usage:  "the affinity of the job pod as JSON (eg. {\"nodeAffinity\": {...}} or {\"podAntiAffinity\": {...}})",
+			EnvVar: "PLUGIN_JOB_AFFINITY",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.topology.spread",
+			Usage:  "the topology spread constraints of the job pod as a JSON array (eg. [{\"maxSkew\": 1, \"topologyKey\": \"topology.kubernetes.io/zone\", \"whenUnsatisfiable\": \"ScheduleAnyway\"}])",
+			EnvVar: "PLUGIN_JOB_TOPOLOGY_SPREAD",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.sidecars",
+			Usage:  "the sidecar containers of the job pod as a JSON array (eg. [{\"name\": \"dind\", \"image\": \"docker:dind\"}]), run as native sidecars (kubernetes 1.29+)",
+			EnvVar: "PLUGIN_JOB_SIDECARS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.volumes",
+			Usage:  "extra volumes of the job pod as a JSON array (eg. [{\"name\": \"certs\", \"projected\": {...}}])",
+			EnvVar: "PLUGIN_JOB_VOLUMES",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.volume.mounts",
+			Usage:  "extra volume mounts of the job container as a JSON array (eg. [{\"name\": \"certs\", \"mountPath\": \"/certs\"}])",
+			EnvVar: "PLUGIN_JOB_VOLUME_MOUNTS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.priority.class",
+			Usage:  "the priority class of the job pod",
+			EnvVar: "PLUGIN_JOB_PRIORITY_CLASS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.runtime.class",
+			Usage:  "the runtime class of the job pod (eg. gvisor, kata)",
+			EnvVar: "PLUGIN_JOB_RUNTIME_CLASS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.dns.policy",
+			Usage:  "the DNS policy of the job pod: ClusterFirst, ClusterFirstWithHostNet, Default or None (requires nameservers)",
+			EnvVar: "PLUGIN_JOB_DNS_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.dns.nameservers",
+			Usage:  "comma separated list of the nameservers of the job pod",
+			EnvVar: "PLUGIN_JOB_DNS_NAMESERVERS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.host.paths",
+			Usage:  "comma separated list of hostPath:containerPath[:type] node paths to mount (eg. /var/run/docker.sock:/var/run/docker.sock:Socket)",
+			EnvVar: "PLUGIN_JOB_HOST_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.ports",
+			Usage:  "comma separated list of name:containerPort[:protocol] ports the job container exposes (eg. http:8080,dns:53:UDP)",
+			EnvVar: "PLUGIN_JOB_PORTS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.field.envs",
+			Usage:  "comma separated list of ENV_NAME=fieldPath env vars set from the pod fields (eg. MY_POD=metadata.name)",
+			EnvVar: "PLUGIN_JOB_FIELD_ENVS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.resource.envs",
+			Usage:  "comma separated list of ENV_NAME=resource env vars set from the container resources (eg. CPUS=limits.cpu)",
+			EnvVar: "PLUGIN_JOB_RESOURCE_ENVS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.env.file",
+			Usage:  "a .env file of KEY=VALUE lines (eg. written by a previous step into the workspace) added to the job env vars",
+			EnvVar: "PLUGIN_JOB_ENV_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.wait.pvc.bound",
+			Usage:  "wait for the workspace PVC to be bound to a volume before creating the job",
+			EnvVar: "PLUGIN_JOB_WAIT_PVC_BOUND",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.wait.pvc.delete",
+			Usage:  "wait for the workspace PVC of a previous build to be deleted if it's still terminating instead of failing",
+			EnvVar: "PLUGIN_JOB_WAIT_PVC_DELETE",
+		},
+		cli.DurationFlag{
+			Name:   "plugin.job.pvc.bound.timeout",
+			Usage:  "how long to wait for the workspace PVC to be bound",
+			EnvVar: "PLUGIN_JOB_PVC_BOUND_TIMEOUT",
+			Value:  2 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "plugin.pod.start.timeout",
+			Usage:  "the build fails if the job doesn't create a pod in time (eg. the quota is exhausted), 0 disables the deadline",
+			EnvVar: "PLUGIN_POD_START_TIMEOUT",
+			Value:  5 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.workspace.owned",
+			Usage:  "make the job an owner of the workspace PVC, the PVC is garbage collected once all of its jobs are deleted (use with single job builds)",
+			EnvVar: "PLUGIN_JOB_WORKSPACE_OWNED",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.keep.on.failure",
+			Usage:  "keep the job of a failed build for debugging (it's deleted otherwise)",
+			EnvVar: "PLUGIN_JOB_KEEP_ON_FAILURE",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.mount.path",
+			Usage:  "the path the workspace PVC is mounted at, defaults to the workspace (the working directory of the job)",
+			EnvVar: "PLUGIN_JOB_MOUNT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.command",
+			Usage:  "comma separated list, the command of the container (overrides the entrypoint, no shell is involved)",
+			EnvVar: "PLUGIN_JOB_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.args",
+			Usage:  "comma separated list, the arguments of the container command",
+			EnvVar: "PLUGIN_JOB_ARGS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.server.address",
+			Usage:  "the address to serve the streamed logs on over HTTP (eg. 127.0.0.1:8080), disabled if not set",
+			EnvVar: "PLUGIN_LOG_SERVER_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.server.token",
+			Usage:  "the bearer token required to access the log server, mandatory if not listening on loopback",
+			EnvVar: "PLUGIN_LOG_SERVER_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.file",
+			Usage:  "the file the streamed logs are written to besides the stdout (eg. to archive them from the workspace)",
+			EnvVar: "PLUGIN_LOG_FILE",
+		},
+		cli.IntFlag{
+			Name:   "plugin.log.max.retries",
+			Usage:  "the number of times opening a log stream is retried before giving up on the logs of the container",
+			EnvVar: "PLUGIN_LOG_MAX_RETRIES",
+			Value:  3,
+		},
+		cli.BoolTFlag{
+			Name:   "plugin.stream.logs",
+			Usage:  "stream the logs of the job pods, disable to only wait for the job to complete (eg. for huge logs archived elsewhere)",
+			EnvVar: "PLUGIN_STREAM_LOGS",
+		},
+		cli.DurationFlag{
+			Name:   "plugin.timeout",
+			Usage:  "the time the plugin may run for (eg. 1h), the resources of the build are cleaned up when exceeded; no timeout if not set",
+			EnvVar: "PLUGIN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "plugin.metrics.push.gateway",
+			Usage:  "the URL of the Prometheus Pushgateway to push the duration and the outcome of the job to",
+			EnvVar: "PLUGIN_METRICS_PUSH_GATEWAY",
+		},
+		cli.StringFlag{
+			Name:   "plugin.checkpoint.file",
+			Usage:  "the file the progress of the build is periodically written to (as JSON)",
+			EnvVar: "PLUGIN_CHECKPOINT_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "plugin.checkpoint.interval",
+			Usage:  "the period of writing the progress of the build to the checkpoint file",
+			EnvVar: "PLUGIN_CHECKPOINT_INTERVAL",
+			Value:  10 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:   "plugin.heartbeat.interval",
+			Usage:  "the period of logging the phase of the build while waiting for the job, 0 disables it",
+			EnvVar: "PLUGIN_HEARTBEAT_INTERVAL",
+			Value:  30 * time.Second,
+		},
 		cli.StringFlag{
 			Name:   "plugin.log.level",
 			Usage:  "the log level for the plugin",
 			EnvVar: "PLUGIN_LOG_LEVEL",
 		},
+		cli.BoolFlag{
+			Name:   "plugin.job.idempotent",
+			Usage:  "attach to an already existing identical job instead of creating a new one",
+			EnvVar: "PLUGIN_JOB_IDEMPOTENT",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.success.policy",
+			Usage:  "the indexes (eg. 0-2,4) that need to succeed for the job to succeed, optionally followed by the number of them required (eg. 0-4:3) (1.31+)",
+			EnvVar: "PLUGIN_JOB_SUCCESS_POLICY",
+		},
+		cli.IntFlag{
+			Name:   "plugin.job.completions",
+			Usage:  "the number of pods that need to succeed for the job to succeed (defaults to 1, or to the indexes of the success policy)",
+			EnvVar: "PLUGIN_JOB_COMPLETIONS",
+		},
+		cli.IntFlag{
+			Name:   "plugin.job.parallelism",
+			Usage:  "the maximum number of pods of the job running at the same time",
+			EnvVar: "PLUGIN_JOB_PARALLELISM",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.readiness.path",
+			Usage:  "the HTTP path of the readiness probe of the build container (requires the port)",
+			EnvVar: "PLUGIN_JOB_READINESS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "plugin.job.readiness.port",
+			Usage:  "the port of the readiness probe of the build container (a TCP probe without the path)",
+			EnvVar: "PLUGIN_JOB_READINESS_PORT",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.readiness.command",
+			Usage:  "the command of the exec readiness probe of the build container",
+			EnvVar: "PLUGIN_JOB_READINESS_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.user",
+			Usage:  "the user (and group) the build runs as, in the uid[:gid] form (like docker run --user)",
+			EnvVar: "PLUGIN_JOB_USER",
+		},
+		cli.Int64Flag{
+			Name:   "plugin.job.fs.group",
+			Usage:  "the group owning the volumes mounted into the job pod",
+			EnvVar: "PLUGIN_JOB_FS_GROUP",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.automount.sa.token",
+			Usage:  "whether the service account token is mounted into the job pod (the service account decides if not set)",
+			EnvVar: "PLUGIN_JOB_AUTOMOUNT_SA_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.sa.token.audience",
+			Usage:  "the audience of a service account token projected into the job pod (eg. for workload identity)",
+			EnvVar: "PLUGIN_JOB_SA_TOKEN_AUDIENCE",
+		},
+		cli.DurationFlag{
+			Name:   "plugin.job.sa.token.expiration",
+			Usage:  "the validity of the projected service account token, at least 10m",
+			EnvVar: "PLUGIN_JOB_SA_TOKEN_EXPIRATION",
+			Value:  time.Hour,
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.sa.token.path",
+			Usage:  "the directory the projected service account token is mounted at (as the file token)",
+			EnvVar: "PLUGIN_JOB_SA_TOKEN_PATH",
+			Value:  "/var/run/secrets/tokens",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.job.privileged",
+			Usage:  "run the job container privileged (eg. for docker in docker), it has full access to the node",
+			EnvVar: "PLUGIN_JOB_PRIVILEGED",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.cap.add",
+			Usage:  "comma separated list of the capabilities added to the job container (eg. NET_ADMIN,SYS_PTRACE)",
+			EnvVar: "PLUGIN_JOB_CAP_ADD",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.cap.drop",
+			Usage:  "comma separated list of the capabilities dropped from the job container (eg. ALL)",
+			EnvVar: "PLUGIN_JOB_CAP_DROP",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.fs.group.change.policy",
+			Usage:  "when to change the ownership of the mounted volumes: Always or OnRootMismatch (skips large, already owned volumes)",
+			EnvVar: "PLUGIN_JOB_FS_GROUP_CHANGE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "plugin.job.sysctls",
+			Usage:  "comma separated list of name=value sysctls to be set for the job pod",
+			EnvVar: "PLUGIN_JOB_SYSCTLS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.status.file",
+			Usage:  "the file the status of the job is reported to as key=value lines (eg. the Drone output file)",
+			EnvVar: "PLUGIN_STATUS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "plugin.output.file",
+			Usage:  "the file the name, namespace and UID of the job are written to as key=value lines (defaults to the Drone output file)",
+			EnvVar: "PLUGIN_OUTPUT_FILE,DRONE_OUTPUT",
+		},
+		cli.StringFlag{
+			Name:   "plugin.result.file",
+			Usage:  "the file the result of the build is written to as JSON (job name, namespace, phase, exit code and duration)",
+			EnvVar: "PLUGIN_RESULT_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.log.timestamps",
+			Usage:  "prefix the streamed log lines with the time they were received",
+			EnvVar: "PLUGIN_LOG_TIMESTAMPS",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.format",
+			Usage:  "the format of the plugin logs: text or json",
+			EnvVar: "PLUGIN_LOG_FORMAT",
+			Value:  "text",
+		},
+		cli.StringFlag{
+			Name:   "plugin.log.output",
+			Usage:  "where the plugin's own logs are written to: stdout or stderr (the job logs are always written to stdout)",
+			EnvVar: "PLUGIN_LOG_OUTPUT",
+			Value:  "stderr",
+		},
+		cli.BoolFlag{
+			Name:   "plugin.log.color",
+			Usage:  "colorize the levels of the plugin's own (text) logs even if not writing to a terminal (eg. the Drone log view)",
+			EnvVar: "PLUGIN_LOG_COLOR",
+		},
+		cli.Int64Flag{
+			Name:   "plugin.log.tail.lines",
+			Usage:  "the number of lines from the end of the pod logs to show (all lines if not set)",
+			EnvVar: "PLUGIN_LOG_TAIL_LINES",
+		},
+		cli.Int64Flag{
+			Name:   "plugin.log.since.seconds",
+			Usage:  "only show pod logs newer than the given number of seconds (all logs if not set)",
+			EnvVar: "PLUGIN_LOG_SINCE_SECONDS",
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -79,131 +665,528 @@ func main() {
 
 func run(c *cli.Context) error {
 	processLogLevel(c)
+	err := processLogFormat(c)
+	if err != nil {
+		logrus.Errorf("could not set the log format. err: %s", err)
+		return err
+	}
+
+	err = processLogOutput(c)
+	if err != nil {
+		logrus.Errorf("could not set the log output. err: %s", err)
+		return err
+	}
+
+	redactPatterns, err := globPatterns(strings.ToUpper(c.String("plugin.log.redact.keys")))
+	if err != nil {
+		logrus.Errorf("could not parse the keys to redact. err: %s", err)
+		return err
+	}
+	redactKeys := append(append([]string{}, plugin.DefaultRedactKeys...), redactPatterns...)
 
-	logrus.Debugf("plugin environment: %s", os.Environ())
+	logrus.Debugf("plugin environment: %s", plugin.RedactedEnv(os.Environ(), redactKeys))
 	flag.Parse()
 
-	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath())
+	// nothing is sent to the cluster in a dry run, no kubeconfig is required
+	var clientSet kubernetes.Interface
+	var dynamicClient dynamic.Interface
+	if !c.Bool("plugin.dry.run") {
+		clientSet, dynamicClient, err = clients(c)
+		if err != nil {
+			return err
+		}
+	}
+
 	if err != nil {
-		logrus.Errorf("could not build kubeconfig. err: %s", err)
+		logrus.Errorf("could not read env  %s", err)
+		return err
+	}
+	podSysctls, err := sysctls(c.String("plugin.job.sysctls"))
+	if err != nil {
+		logrus.Errorf("could not parse sysctls. err: %s", err)
 		return err
 	}
-	clientSet, err := kubernetes.NewForConfig(config)
 
+	podAffinity, err := affinity(c.String("plugin.job.affinity"))
 	if err != nil {
-		logrus.Errorf("could not get client set  %s", err)
+		logrus.Errorf("could not parse the affinity. err: %s", err)
 		return err
 	}
 
+	capAdd, err := capabilities(c.String("plugin.job.cap.add"))
 	if err != nil {
-		logrus.Errorf("could not read env  %s", err)
+		logrus.Errorf("could not parse the capabilities to add. err: %s", err)
 		return err
 	}
-	var wg sync.WaitGroup
 
-	plugin := Plugin{
-		Namespace:        c.String("plugin.job.namespace"),
-		Image:            c.String("plugin.original.image"),
-		ServiceAccount:   c.String("plugin.proxy.service.account"),
-		Workspace:        workspace(),
-		WorkspacePVC:     workspacePVC(),
-		JobName:          jobName(),
-		OriginalCommands: originalCommands(),
-		LabelSelector:    labelSelector(),
-		Env:              pluginEnv(),
-		Wg:               &wg,
+	capDrop, err := capabilities(c.String("plugin.job.cap.drop"))
+	if err != nil {
+		logrus.Errorf("could not parse the capabilities to drop. err: %s", err)
+		return err
 	}
 
-	_, err = plugin.CreateOrGetPVC(clientSet)
+	jobLabels, err := labelSelector(c.String("plugin.job.label.selector"))
 	if err != nil {
-		logrus.Errorf("could not create PVC. err [ %s ]", err)
+		logrus.Errorf("could not parse the label selector. err: %s", err)
 		return err
 	}
 
-	jobWatcher, err := plugin.WatchJob(clientSet)
+	jobSidecars, err := sidecars(c.String("plugin.job.sidecars"))
 	if err != nil {
-		logrus.Errorf("could not watch jobs. err [ %s ]", err)
+		logrus.Errorf("could not parse the sidecars. err: %s", err)
+		return err
+	}
+
+	var topologySpread []coreV1.TopologySpreadConstraint
+	err = decodeJSON("plugin.job.topology.spread", c.String("plugin.job.topology.spread"), &topologySpread)
+	if err != nil {
+		logrus.Errorf("could not parse the topology spread constraints. err: %s", err)
+		return err
+	}
+
+	var extraVolumes []coreV1.Volume
+	if err := decodeJSON("plugin.job.volumes", c.String("plugin.job.volumes"), &extraVolumes); err != nil {
+		logrus.Errorf("could not parse the extra volumes. err: %s", err)
 		return err
 	}
 
-	err = plugin.CreateJob(clientSet)
+	var extraVolumeMounts []coreV1.VolumeMount
+	err = decodeJSON("plugin.job.volume.mounts", c.String("plugin.job.volume.mounts"), &extraVolumeMounts)
 	if err != nil {
-		jobWatcher.Stop()
+		logrus.Errorf("could not parse the extra volume mounts. err: %s", err)
 		return err
 	}
 
-	err = plugin.JobEvents(jobWatcher, clientSet)
+	jobHostPaths, err := hostPaths(c.String("plugin.job.host.paths"))
 	if err != nil {
-		logrus.Errorf("error encountered: %s", err)
+		logrus.Errorf("could not parse the host paths. err: %s", err)
 		return err
 	}
 
-	plugin.Wg.Wait()
-	plugin.Cleanup(clientSet)
+	jobPorts, err := containerPorts(c.String("plugin.job.ports"))
+	if err != nil {
+		logrus.Errorf("could not parse the container ports. err: %s", err)
+		return err
+	}
 
-	return nil
+	jobFieldEnvs, err := fieldEnvs(c.String("plugin.job.field.envs"))
+	if err != nil {
+		logrus.Errorf("could not parse the field env vars. err: %s", err)
+		return err
+	}
+
+	jobResourceEnvs, err := resourceEnvs(c.String("plugin.job.resource.envs"))
+	if err != nil {
+		logrus.Errorf("could not parse the resource env vars. err: %s", err)
+		return err
+	}
+
+	jobFileEnvs, err := envFile(c.String("plugin.job.env.file"))
+	if err != nil {
+		logrus.Errorf("could not read the env file. err: %s", err)
+		return err
+	}
+
+	sizeLimit, err := quantity(c.String("plugin.job.workspace.size.limit"))
+	if err != nil {
+		logrus.Errorf("could not parse the workspace size limit. err: %s", err)
+		return err
+	}
 
+	ephemeralStorageRequest, err := quantity(c.String("plugin.job.ephemeral.storage.request"))
+	if err != nil {
+		logrus.Errorf("could not parse the ephemeral storage request. err: %s", err)
+		return err
+	}
+
+	ephemeralStorageLimit, err := quantity(c.String("plugin.job.ephemeral.storage.limit"))
+	if err != nil {
+		logrus.Errorf("could not parse the ephemeral storage limit. err: %s", err)
+		return err
+	}
+
+	envAllowlist, err := globPatterns(c.String("plugin.env.allowlist"))
+	if err != nil {
+		logrus.Errorf("could not parse the env allowlist. err: %s", err)
+		return err
+	}
+
+	envDenylist, err := globPatterns(c.String("plugin.env.denylist"))
+	if err != nil {
+		logrus.Errorf("could not parse the env denylist. err: %s", err)
+		return err
+	}
+
+	jobSuccessPolicy, completions, err := successPolicy(c.String("plugin.job.success.policy"))
+	if err != nil {
+		logrus.Errorf("could not parse the success policy. err: %s", err)
+		return err
+	}
+
+	if c.IsSet("plugin.job.completions") {
+		if int32(c.Int("plugin.job.completions")) < completions {
+			err = fmt.Errorf("the completions: [ %d ] don't cover the indexes of the success policy, at least [ %d ] needed",
+				c.Int("plugin.job.completions"), completions)
+			logrus.Errorf("invalid completions. err: %s", err)
+			return err
+		}
+		completions = int32(c.Int("plugin.job.completions"))
+	}
+
+	fsGroupPolicy, err := fsGroupChangePolicy(c.String("plugin.job.fs.group.change.policy"))
+	if err != nil {
+		logrus.Errorf("could not parse the fs group change policy. err: %s", err)
+		return err
+	}
+
+	runAsUser, runAsGroup, err := user(c.String("plugin.job.user"))
+	if err != nil {
+		logrus.Errorf("could not parse the user. err: %s", err)
+		return err
+	}
+
+	probe, err := readinessProbe(c.String("plugin.job.readiness.path"), c.Int("plugin.job.readiness.port"),
+		c.String("plugin.job.readiness.command"), c.String("plugin.job.shell"))
+	if err != nil {
+		logrus.Errorf("could not set up the readiness probe. err: %s", err)
+		return err
+	}
+
+	var fsGroup *int64
+	if c.IsSet("plugin.job.fs.group") {
+		group := c.Int64("plugin.job.fs.group")
+		fsGroup = &group
+	}
+
+	if c.Bool("plugin.job.adopt.existing") && c.String("plugin.job.name") == "" {
+		err := errors.New("adopting an existing job requires its name")
+		logrus.Errorf("invalid configuration. err: %s", err)
+		return err
+	}
+
+	var automountToken *bool
+	if c.IsSet("plugin.job.automount.sa.token") {
+		automount := c.Bool("plugin.job.automount.sa.token")
+		automountToken = &automount
+	}
+
+	p := plugin.New(plugin.Options{
+		Namespace:                c.String("plugin.job.namespace"),
+		Image:                    c.String("plugin.original.image"),
+		ServiceAccount:           c.String("plugin.proxy.service.account"),
+		ValidateServiceAccount:   c.Bool("plugin.validate.sa"),
+		Workspace:                workspace(c.String("plugin.job.workspace.default")),
+		MountPath:                c.String("plugin.job.mount.path"),
+		WorkspacePVC:             workspacePVC(),
+		WorkspaceType:            strings.ToLower(c.String("plugin.job.workspace.type")),
+		WorkspaceReadOnly:        c.Bool("plugin.job.workspace.readonly"),
+		WorkspaceSizeLimit:       sizeLimit,
+		EphemeralStorageRequest:  ephemeralStorageRequest,
+		EphemeralStorageLimit:    ephemeralStorageLimit,
+		JobName:                  jobName(c.String("plugin.job.name"), c.String("plugin.job.name.prefix")),
+		ContainerName:            c.String("plugin.job.container.name"),
+		Shell:                    c.String("plugin.job.shell"),
+		GenerateName:             c.Bool("plugin.job.generate.name"),
+		OnExists:                 strings.ToLower(c.String("plugin.job.on.exists")),
+		AdoptExisting:            c.Bool("plugin.job.adopt.existing"),
+		OriginalCommands:         originalCommands(),
+		Command:                  listItems(c.String("plugin.job.command")),
+		Args:                     listItems(c.String("plugin.job.args")),
+		LabelSelector:            jobLabels,
+		Env:                      pluginEnv(redactKeys),
+		EnvAllowlist:             envAllowlist,
+		EnvDenylist:              envDenylist,
+		LogTailLines:             c.Int64("plugin.log.tail.lines"),
+		LogSinceSeconds:          c.Int64("plugin.log.since.seconds"),
+		LogTimestamps:            c.Bool("plugin.log.timestamps"),
+		Sysctls:                  podSysctls,
+		HostPaths:                jobHostPaths,
+		Ports:                    jobPorts,
+		Sidecars:                 jobSidecars,
+		Volumes:                  extraVolumes,
+		VolumeMounts:             extraVolumeMounts,
+		FieldEnvs:                jobFieldEnvs,
+		ResourceEnvs:             jobResourceEnvs,
+		FileEnvs:                 jobFileEnvs,
+		FSGroup:                  fsGroup,
+		FSGroupChangePolicy:      fsGroupPolicy,
+		StatusFile:               c.String("plugin.status.file"),
+		OutputFile:               c.String("plugin.output.file"),
+		ResultFile:               c.String("plugin.result.file"),
+		Idempotent:               c.Bool("plugin.job.idempotent"),
+		AllowedRegistries:        listItems(c.String("plugin.image.allowed.registries")),
+		APIMaxRetries:            c.Int("plugin.api.max.retries"),
+		CheckpointFile:           c.String("plugin.checkpoint.file"),
+		CheckpointInterval:       c.Duration("plugin.checkpoint.interval"),
+		HeartbeatInterval:        c.Duration("plugin.heartbeat.interval"),
+		PreserveWorkspace:        c.Bool("plugin.preserve.workspace"),
+		VolumeSnapshotClass:      c.String("plugin.volume.snapshot.class"),
+		CleanupConcurrency:       c.Int("plugin.cleanup.concurrency"),
+		ShowEvents:               c.Bool("plugin.show.events"),
+		LogServerAddress:         c.String("plugin.log.server.address"),
+		LogServerToken:           c.String("plugin.log.server.token"),
+		LogFile:                  c.String("plugin.log.file"),
+		LogMaxRetries:            c.Int("plugin.log.max.retries"),
+		SkipLogs:                 !c.BoolT("plugin.stream.logs"),
+		DryRun:                   c.Bool("plugin.dry.run"),
+		ImagePullSecrets:         listItems(c.String("plugin.job.image.pull.secrets")),
+		TrackImageDigest:         c.Bool("plugin.image.track.digest"),
+		RunAsUser:                runAsUser,
+		RunAsGroup:               runAsGroup,
+		AutomountToken:           automountToken,
+		TokenAudience:            c.String("plugin.job.sa.token.audience"),
+		TokenExpiration:          c.Duration("plugin.job.sa.token.expiration"),
+		TokenPath:                c.String("plugin.job.sa.token.path"),
+		Privileged:               c.Bool("plugin.job.privileged"),
+		CapAdd:                   capAdd,
+		CapDrop:                  capDrop,
+		ReadinessProbe:           probe,
+		RestartPolicy:            coreV1.RestartPolicy(c.String("plugin.job.restart.policy")),
+		TerminationMessagePolicy: coreV1.TerminationMessagePolicy(c.String("plugin.job.termination.message.policy")),
+		Affinity:                 podAffinity,
+		TopologySpread:           topologySpread,
+		PriorityClass:            c.String("plugin.job.priority.class"),
+		RuntimeClass:             c.String("plugin.job.runtime.class"),
+		DNSPolicy:                coreV1.DNSPolicy(c.String("plugin.job.dns.policy")),
+		DNSNameservers:           listItems(c.String("plugin.job.dns.nameservers")),
+		SuccessPolicy:            jobSuccessPolicy,
+		Completions:              completions,
+		Parallelism:              int32(c.Int("plugin.job.parallelism")),
+		Timeout:                  c.Duration("plugin.timeout"),
+		MetricsPushGateway:       c.String("plugin.metrics.push.gateway"),
+		WaitPVCBound:             c.Bool("plugin.job.wait.pvc.bound"),
+		WaitPVCDelete:            c.Bool("plugin.job.wait.pvc.delete"),
+		OwnedWorkspace:           c.Bool("plugin.job.workspace.owned"),
+		KeepOnFailure:            c.Bool("plugin.job.keep.on.failure"),
+		PVCBoundTimeout:          c.Duration("plugin.job.pvc.bound.timeout"),
+		PodStartTimeout:          c.Duration("plugin.pod.start.timeout"),
+		RedactKeys:               redactKeys,
+		DynamicClient:            dynamicClient,
+	})
+
+	if strings.ToLower(c.String("plugin.log.format")) == "json" {
+		logrus.AddHook(buildFieldsHook{plugin: p})
+	}
+
+	// the build gets cancelled by signals (eg. when the pipeline is cancelled)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return p.Run(ctx, clientSet)
+
+}
+
+// clients sets up the clients of the API server configured by the flags
+func clients(c *cli.Context) (kubernetes.Interface, dynamic.Interface, error) {
+	var config *rest.Config
+	var err error
+	if server := c.String("plugin.api.server"); server != "" {
+		config, err = serverConfig(server, c.String("plugin.api.token"), c.String("plugin.api.ca.cert"),
+			c.Bool("plugin.api.insecure"))
+	} else {
+		config, err = restConfig(kubeConfigPath(c.String("plugin.kubeconfig.path")), c.Bool("plugin.in.cluster"))
+	}
+	if err != nil {
+		logrus.Errorf("could not build kubeconfig. err: %s", err)
+		return nil, nil, err
+	}
+	withResponseTimeout(config, c.Duration("plugin.api.timeout"))
+
+	clientSet, err := kubernetes.NewForConfig(config)
+
+	if err != nil {
+		logrus.Errorf("could not get client set  %s", err)
+		return nil, nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logrus.Errorf("could not get dynamic client  %s", err)
+		return nil, nil, err
+	}
+	return clientSet, dynamicClient, nil
 }
 
 // WorkspacePVC assembles the name of the persistent volume claim based on the available environment
 func workspacePVC() string {
 	//DRONE_WORKSPACE_PVC=$DRONE_REPO_NAME"-"$DRONE_BUILD_NUMBER"-WORKSPACE"
 	// PVC must be lowercase!
-	workSpacePVC := strings.ToLower(strings.Join([]string{os.Getenv("DRONE_REPO_NAME"),
+	workSpacePVC := sanitizeName(strings.Join([]string{os.Getenv("DRONE_REPO_NAME"),
 		os.Getenv("DRONE_BUILD_NUMBER"), "WORKSPACE"}, "-"))
 
 	logrus.Debugf("workspace PVC name: [ %s ]", workSpacePVC)
 	return workSpacePVC
 }
 
-func workspace() string {
+// Workspace returns the workspace of the build, the fallback is used if drone doesn't set one
+func workspace(fallback string) string {
 	ws := os.Getenv("DRONE_WORKSPACE")
+	if ws == "" {
+		ws = fallback
+	}
 	logrus.Debugf("workspace: [ %s ]", ws)
 	return ws
 }
 
 // JobName assembles the name of the job based on the available environment
-func jobName() string {
+// An explicitly set name is used as is (sanitized); the prefix defaults to the name of the repository
+func jobName(name, prefix string) string {
+	if name != "" {
+		return sanitizeName(name)
+	}
 	//DRONE_JOB_NAME=$DRONE_REPO_NAME"-"$DRONE_BUILD_NUMBER-`date +%s`
-	jobName := strings.Join([]string{os.Getenv("DRONE_REPO_NAME"), os.Getenv("DRONE_BUILD_NUMBER"),
-		strconv.FormatInt(time.Now().Unix(), 10)}, "-")
+	if prefix == "" {
+		prefix = os.Getenv("DRONE_REPO_NAME")
+	}
+	jobName := sanitizeName(strings.Join([]string{prefix, os.Getenv("DRONE_BUILD_NUMBER"),
+		strconv.FormatInt(time.Now().Unix(), 10)}, "-"))
 	logrus.Debugf("job name: [ %s ]", jobName)
 	return jobName
 }
 
-// OriginalCommands parses the passed in original command
-// The original command is passed to the containar "as is"
+// sanitizeName turns the name into a valid DNS-1123 label: lowercase alphanumerics and dashes, at most 63 characters
+// Invalid characters (eg. the slashes and underscores of repository names) are replaced by dashes; longer names are
+// truncated and suffixed with the hash of the whole name to stay unique. All the generated resource names go through it
+func sanitizeName(name string) string {
+	sanitized := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(sanitized) <= maxNameLength {
+		return sanitized
+	}
+
+	hash := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(hash[:])[:nameHashLength]
+	return strings.TrimRight(sanitized[:maxNameLength-nameHashLength-1], "-") + "-" + suffix
+}
+
+// OriginalCommands parses the passed in original commands, one command per line (blank lines are skipped)
+// The commands are run as a single script by the container, see DecorateJob
 func originalCommands() []string {
 	oc, ok := os.LookupEnv("PLUGIN_ORIGINAL_COMMANDS")
 	if ok == false || oc == "" {
 		return nil
 	}
 	logrus.Debugf("original commands: [ %s ]", oc)
-	return []string{oc}
+
+	var commands []string
+	for _, command := range strings.Split(oc, "\n") {
+		if command = strings.TrimSpace(command); command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
 }
 
-// KubeConfigPath assembles the path to the Kubernetes config file
-func kubeConfigPath() string {
+// KubeConfigPath assembles the path to the Kubernetes config file, the path passed in takes precedence if set
+func kubeConfigPath(override string) string {
+	if override != "" {
+		logrus.Debugf("kube config path: [ %s ]", override)
+		return override
+	}
+
 	//export KUBECONFIG="$DRONE_WORKSPACE/.kube/config"
 	kubeConfigPath := filepath.Join(os.Getenv("DRONE_WORKSPACE"), ".kube", "config")
 	logrus.Debugf("kube config path: [ %s ]", kubeConfigPath)
 	return kubeConfigPath
 }
 
-func pluginEnv() map[string]string {
+// restConfig builds the configuration to access the cluster
+// Falls back to the in-cluster configuration (the service account of the plugin pod) if the kubeconfig file doesn't exist
+func restConfig(kubeConfigPath string, inCluster bool) (*rest.Config, error) {
+	if inCluster {
+		logrus.Debugf("using in-cluster config")
+		return rest.InClusterConfig()
+	}
+
+	if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) {
+		logrus.Debugf("kube config [ %s ] not found, using in-cluster config", kubeConfigPath)
+		return rest.InClusterConfig()
+	}
+
+	return clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+}
+
+// serverConfig builds the configuration to access the API server at the given URL with the bearer token
+// The CA certificate is either PEM encoded or the path to it
+func serverConfig(server, token, caCert string, insecure bool) (*rest.Config, error) {
+	if token == "" {
+		return nil, errors.New("the token is required to access the API server (plugin.api.token)")
+	}
+
+	config := &rest.Config{
+		Host:        server,
+		BearerToken: token,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: insecure,
+		},
+	}
+
+	switch {
+	case insecure:
+		if caCert != "" {
+			// the client refuses the CA certificate combined with skipping the verification
+			logrus.Warnf("skipping the verification of the API server certificate, the CA certificate is ignored")
+		}
+	case strings.Contains(caCert, "-----BEGIN"):
+		config.TLSClientConfig.CAData = []byte(caCert)
+	default:
+		config.TLSClientConfig.CAFile = caCert
+	}
+
+	logrus.Debugf("using the API server: [ %s ], insecure: [ %t ]", server, insecure)
+	return config, nil
+}
+
+// withResponseTimeout bounds the time the API server has to respond to the requests
+// The timeout applies to receiving the response headers only: the timeout of the config (config.Timeout) would bound
+// the whole request including reading the body, cutting the long running watches and log streams
+func withResponseTimeout(config *rest.Config, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	config.Wrap(func(roundTripper http.RoundTripper) http.RoundTripper {
+		transport, ok := roundTripper.(*http.Transport)
+		if !ok {
+			logrus.Warnf("could not set the API timeout on the transport of type: [ %T ]", roundTripper)
+			return roundTripper
+		}
+		// the transport may be shared by other configs
+		transport = transport.Clone()
+		transport.ResponseHeaderTimeout = timeout
+		return transport
+	})
+	logrus.Debugf("API timeout: [ %s ]", timeout)
+}
+
+func pluginEnv(redactKeys []string) map[string]string {
 	pluginEnv := map[string]string{}
 	for _, envVar := range os.Environ() {
 		keyVal := strings.SplitN(envVar, "=", 2)
 		pluginEnv[keyVal[0]] = keyVal[1]
 	}
-	logrus.Debugf("parsed env map: %s", pluginEnv)
+	logrus.Debugf("parsed env map: %s", plugin.RedactedEnvMap(pluginEnv, redactKeys))
 	return pluginEnv
 }
 
-func labelSelector() map[string]string {
-	return map[string]string{
-		label: strings.Join([]string{os.Getenv("DRONE_BUILD_NUMBER"), "label"}, "-"),
+// labelSelector assembles the labels of the resources of the build from the comma separated key=value pairs and the
+// label unique to the build; the resources are watched by all of them
+func labelSelector(raw string) (map[string]string, error) {
+	pairs, err := keyValuePairs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := make(map[string]string, len(pairs)+1)
+	for _, pair := range pairs {
+		if pair.key == plugin.Label {
+			// the watches rely on the label being unique to the build
+			return nil, fmt.Errorf("the label [ %s ] is reserved for the plugin", plugin.Label)
+		}
+		selector[pair.key] = pair.value
 	}
+	selector[plugin.Label] = strings.Join([]string{os.Getenv("DRONE_BUILD_NUMBER"), "label"}, "-")
+	logrus.Debugf("label selector: %v", selector)
+	return selector, nil
 }
 
 func processLogLevel(c *cli.Context) {
@@ -222,3 +1205,480 @@ func processLogLevel(c *cli.Context) {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 }
+
+// listItems splits a comma separated list into its (non empty) items
+func listItems(raw string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// keyValuePairs parses a comma separated list of key=value pairs keeping their order
+func keyValuePairs(raw string) ([]keyValue, error) {
+	pairs := make([]keyValue, 0)
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		keyVal := strings.SplitN(item, "=", 2)
+		if len(keyVal) != 2 || strings.TrimSpace(keyVal[0]) == "" {
+			return nil, fmt.Errorf("invalid key=value pair: [ %s ]", item)
+		}
+		pairs = append(pairs, keyValue{key: strings.TrimSpace(keyVal[0]), value: strings.TrimSpace(keyVal[1])})
+	}
+	return pairs, nil
+}
+
+// sysctls parses the sysctls to be set for the job pod; unsafe sysctls are let through but need to be allowed on the nodes
+func sysctls(raw string) ([]coreV1.Sysctl, error) {
+	pairs, err := keyValuePairs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	podSysctls := make([]coreV1.Sysctl, 0, len(pairs))
+	for _, pair := range pairs {
+		if !safeSysctls[pair.key] {
+			logrus.Warnf("sysctl [ %s ] is unsafe, it must be allowed on the nodes (kubelet --allowed-unsafe-sysctls)", pair.key)
+		}
+		podSysctls = append(podSysctls, coreV1.Sysctl{Name: pair.key, Value: pair.value})
+	}
+	logrus.Debugf("pod sysctls: %#v", podSysctls)
+	return podSysctls, nil
+}
+
+// hostPaths parses a comma separated list of hostPath:containerPath[:type] entries
+func hostPaths(raw string) ([]plugin.HostPath, error) {
+	paths := make([]plugin.HostPath, 0)
+	for _, item := range listItems(raw) {
+		segments := strings.Split(item, ":")
+		if len(segments) < 2 || len(segments) > 3 || segments[0] == "" || segments[1] == "" {
+			return nil, fmt.Errorf("invalid host path: [ %s ], expected hostPath:containerPath[:type]", item)
+		}
+
+		hostPath := plugin.HostPath{Path: segments[0], MountPath: segments[1]}
+		if len(segments) == 3 {
+			pathType, ok := hostPathTypes[segments[2]]
+			if !ok {
+				return nil, fmt.Errorf("unsupported host path type: [ %s ]", segments[2])
+			}
+			hostPath.Type = &pathType
+		}
+		paths = append(paths, hostPath)
+	}
+	logrus.Debugf("host paths: %#v", paths)
+	return paths, nil
+}
+
+// containerPorts parses a comma separated list of name:containerPort[:protocol] entries
+func containerPorts(raw string) ([]coreV1.ContainerPort, error) {
+	ports := make([]coreV1.ContainerPort, 0)
+	for _, item := range listItems(raw) {
+		segments := strings.Split(item, ":")
+		if len(segments) < 2 || len(segments) > 3 || segments[0] == "" {
+			return nil, fmt.Errorf("invalid port: [ %s ], expected name:containerPort[:protocol]", item)
+		}
+
+		number, err := strconv.ParseInt(segments[1], 10, 32)
+		if err != nil || number < 1 || number > 65535 {
+			return nil, fmt.Errorf("invalid port number: [ %s ], expected 1-65535", segments[1])
+		}
+
+		port := coreV1.ContainerPort{Name: segments[0], ContainerPort: int32(number), Protocol: coreV1.ProtocolTCP}
+		if len(segments) == 3 {
+			protocol, ok := portProtocols[strings.ToUpper(segments[2])]
+			if !ok {
+				return nil, fmt.Errorf("unsupported port protocol: [ %s ]", segments[2])
+			}
+			port.Protocol = protocol
+		}
+		ports = append(ports, port)
+	}
+	logrus.Debugf("container ports: %#v", ports)
+	return ports, nil
+}
+
+// fieldEnvs parses a comma separated list of ENV_NAME=fieldPath pairs into env vars referencing the pod fields
+// Besides the known fields, labels and annotations can be referenced (eg. metadata.labels['app'])
+func fieldEnvs(raw string) ([]coreV1.EnvVar, error) {
+	pairs, err := keyValuePairs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	envVars := make([]coreV1.EnvVar, 0, len(pairs))
+	for _, pair := range pairs {
+		if !podFieldPaths[pair.value] && !metadataFieldPath(pair.value) {
+			return nil, fmt.Errorf("unsupported field path: [ %s ] for env var: [ %s ]", pair.value, pair.key)
+		}
+		envVars = append(envVars, coreV1.EnvVar{
+			Name: pair.key,
+			ValueFrom: &coreV1.EnvVarSource{
+				FieldRef: &coreV1.ObjectFieldSelector{FieldPath: pair.value},
+			},
+		})
+	}
+	logrus.Debugf("field env vars: %#v", envVars)
+	return envVars, nil
+}
+
+// resourceEnvs parses a comma separated list of ENV_NAME=resource pairs into env vars referencing the container resources
+// Hugepages can be referenced as well (eg. limits.hugepages-2Mi)
+func resourceEnvs(raw string) ([]coreV1.EnvVar, error) {
+	pairs, err := keyValuePairs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	envVars := make([]coreV1.EnvVar, 0, len(pairs))
+	for _, pair := range pairs {
+		if !containerResources[pair.value] && !strings.HasPrefix(pair.value, "limits.hugepages-") &&
+			!strings.HasPrefix(pair.value, "requests.hugepages-") {
+			return nil, fmt.Errorf("unsupported resource: [ %s ] for env var: [ %s ]", pair.value, pair.key)
+		}
+		envVars = append(envVars, coreV1.EnvVar{
+			Name: pair.key,
+			ValueFrom: &coreV1.EnvVarSource{
+				ResourceFieldRef: &coreV1.ResourceFieldSelector{Resource: pair.value},
+			},
+		})
+	}
+	logrus.Debugf("resource env vars: %#v", envVars)
+	return envVars, nil
+}
+
+// envFile reads the env vars of the .env file: KEY=VALUE lines, blank lines and # comments are skipped
+// Values may be quoted, double quoted ones are unescaped; a later line overrides an earlier one of the same key
+func envFile(filePath string) ([]coreV1.EnvVar, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	envVars := make([]coreV1.EnvVar, 0)
+	indexes := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !envName.MatchString(key) {
+			return nil, fmt.Errorf("invalid line %d of [ %s ], expected KEY=VALUE", lineNumber, filePath)
+		}
+
+		value, err := envValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of [ %s ] on line %d of [ %s ]: %s", key, lineNumber, filePath, err)
+		}
+
+		if i, ok := indexes[key]; ok {
+			envVars[i].Value = value
+			continue
+		}
+		indexes[key] = len(envVars)
+		envVars = append(envVars, coreV1.EnvVar{Name: key, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// the values may be secrets, only the names are logged
+	names := make([]string, 0, len(envVars))
+	for _, envVar := range envVars {
+		names = append(names, envVar.Name)
+	}
+	logrus.Debugf("env vars read from [ %s ]: [ %s ]", filePath, strings.Join(names, ", "))
+	return envVars, nil
+}
+
+// envValue unquotes the value of an env file line, values end at an inline comment (" #" if unquoted, "#" after the
+// closing quote)
+func envValue(raw string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		quoted, err := strconv.QuotedPrefix(raw)
+		if err != nil {
+			return "", err
+		}
+		if value, err = strconv.Unquote(quoted); err != nil {
+			return "", err
+		}
+		rest = raw[len(quoted):]
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quoted value")
+		}
+		value, rest = raw[1:end+1], raw[end+2:]
+	default:
+		if i := strings.Index(raw, " #"); i >= 0 {
+			raw = strings.TrimSpace(raw[:i])
+		}
+		return raw, nil
+	}
+
+	// only a comment may follow the quoted value
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected [ %s ] after the quoted value", rest)
+	}
+	return value, nil
+}
+
+// metadataFieldPath checks whether the field path references a label or an annotation of the pod
+func metadataFieldPath(fieldPath string) bool {
+	for _, prefix := range []string{"metadata.labels['", "metadata.annotations['"} {
+		if strings.HasPrefix(fieldPath, prefix) && strings.HasSuffix(fieldPath, "']") && len(fieldPath) > len(prefix)+2 {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilities parses a comma separated list of capability names (eg. NET_ADMIN, without the CAP_ prefix)
+func capabilities(raw string) ([]coreV1.Capability, error) {
+	caps := make([]coreV1.Capability, 0)
+	for _, item := range listItems(raw) {
+		if !capabilityName.MatchString(item) {
+			return nil, fmt.Errorf("invalid capability: [ %s ], expected an uppercase name (eg. NET_ADMIN)", item)
+		}
+		caps = append(caps, coreV1.Capability(item))
+	}
+	return caps, nil
+}
+
+// quantity parses an optional resource quantity
+func quantity(raw string) (*resource.Quantity, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	parsed, err := resource.ParseQuantity(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// globPatterns parses a comma separated list of glob patterns
+func globPatterns(raw string) ([]string, error) {
+	patterns := listItems(raw)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: [ %s ]", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+func processLogFormat(c *cli.Context) error {
+	switch strings.ToLower(c.String("plugin.log.format")) {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{ForceColors: c.Bool("plugin.log.color")})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format: [ %s ]", c.String("plugin.log.format"))
+	}
+	return nil
+}
+
+func processLogOutput(c *cli.Context) error {
+	switch strings.ToLower(c.String("plugin.log.output")) {
+	case "stdout":
+		logrus.SetOutput(os.Stdout)
+	case "", "stderr":
+		logrus.SetOutput(os.Stderr)
+	default:
+		return fmt.Errorf("unsupported log output: [ %s ]", c.String("plugin.log.output"))
+	}
+	return nil
+}
+
+// buildFieldsHook adds the metadata of the build to every (structured) log entry
+type buildFieldsHook struct {
+	plugin *plugin.Plugin
+}
+
+func (h buildFieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h buildFieldsHook) Fire(entry *logrus.Entry) error {
+	entry.Data["job"] = h.plugin.CurrentJobName()
+	entry.Data["namespace"] = h.plugin.Namespace
+	return nil
+}
+
+// successPolicy parses the success policy of an indexed job in the form of indexes[:count] (eg. 0-2,4:3)
+// Returns the number of completions covering the highest index as well
+func successPolicy(raw string) (*batchV1.SuccessPolicy, int32, error) {
+	if raw == "" {
+		return nil, 0, nil
+	}
+
+	parts := strings.SplitN(raw, ":", 2)
+	indexes := strings.TrimSpace(parts[0])
+	maxIndex := int64(-1)
+	for _, indexRange := range strings.Split(indexes, ",") {
+		for _, index := range strings.SplitN(indexRange, "-", 2) {
+			value, err := strconv.ParseInt(strings.TrimSpace(index), 10, 32)
+			if err != nil || value < 0 {
+				return nil, 0, fmt.Errorf("invalid index: [ %s ] in success policy: [ %s ]", index, raw)
+			}
+			if value > maxIndex {
+				maxIndex = value
+			}
+		}
+	}
+
+	rule := batchV1.SuccessPolicyRule{
+		SucceededIndexes: &indexes,
+	}
+
+	if len(parts) == 2 {
+		count, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || count < 1 {
+			return nil, 0, fmt.Errorf("invalid succeeded count: [ %s ] in success policy: [ %s ]", parts[1], raw)
+		}
+		succeededCount := int32(count)
+		rule.SucceededCount = &succeededCount
+	}
+
+	logrus.Debugf("success policy: succeeded indexes: [ %s ], completions: [ %d ]", indexes, maxIndex+1)
+	return &batchV1.SuccessPolicy{Rules: []batchV1.SuccessPolicyRule{rule}}, int32(maxIndex + 1), nil
+}
+
+// affinity parses the affinity of the job pod from JSON
+func affinity(raw string) (*coreV1.Affinity, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var podAffinity coreV1.Affinity
+	if err := decodeJSON("plugin.job.affinity", raw, &podAffinity); err != nil {
+		return nil, err
+	}
+	return &podAffinity, nil
+}
+
+// sidecars parses the sidecar containers of the job pod from a JSON array
+func sidecars(raw string) ([]coreV1.Container, error) {
+	var containers []coreV1.Container
+	if err := decodeJSON("plugin.job.sidecars", raw, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// decodeJSON decodes the optional JSON value of the named flag, unknown fields are rejected to catch typos
+// The decoded values are not logged, they may hold secrets (eg. the env of the sidecars)
+func decodeJSON(name, raw string, into interface{}) error {
+	if raw == "" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(into); err != nil {
+		return fmt.Errorf("invalid JSON of: [ %s ], error: %s", name, err)
+	}
+	logrus.Debugf("decoded [ %d ] item(s) of: [ %s ]", decodedItems(into), name)
+	return nil
+}
+
+// decodedItems counts the decoded items, a single object counts as one
+func decodedItems(decoded interface{}) int {
+	value := reflect.Indirect(reflect.ValueOf(decoded))
+	if value.Kind() == reflect.Slice {
+		return value.Len()
+	}
+	return 1
+}
+
+// fsGroupChangePolicy parses the policy of changing the ownership of the volumes mounted into the job pod
+func fsGroupChangePolicy(raw string) (*coreV1.PodFSGroupChangePolicy, error) {
+	var policy coreV1.PodFSGroupChangePolicy
+	switch raw {
+	case "":
+		return nil, nil
+	case string(coreV1.FSGroupChangeAlways):
+		policy = coreV1.FSGroupChangeAlways
+	case string(coreV1.FSGroupChangeOnRootMismatch):
+		policy = coreV1.FSGroupChangeOnRootMismatch
+	default:
+		return nil, fmt.Errorf("unsupported fs group change policy: [ %s ]", raw)
+	}
+	return &policy, nil
+}
+
+// user parses the numeric uid[:gid] the build runs as
+func user(raw string) (*int64, *int64, error) {
+	if raw == "" {
+		return nil, nil, nil
+	}
+
+	ids := make([]*int64, 2)
+	for i, id := range strings.SplitN(raw, ":", 2) {
+		value, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil || value < 0 {
+			return nil, nil, fmt.Errorf("invalid user: [ %s ], numeric uid[:gid] expected", raw)
+		}
+		ids[i] = &value
+	}
+	logrus.Debugf("run as user: [ %s ]", raw)
+	return ids[0], ids[1], nil
+}
+
+// readinessProbe assembles the readiness probe of the build container: an HTTP probe if the path is set, an exec probe
+// if the command is set (run by the shell, sh by default), a TCP probe if only the port is set; nil if none of them is set
+func readinessProbe(path string, port int, command string, shell string) (*coreV1.Probe, error) {
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid readiness probe port: [ %d ]", port)
+	}
+
+	switch {
+	case path != "" && command != "":
+		return nil, fmt.Errorf("either the path or the command of the readiness probe can be set")
+	case path != "":
+		if port == 0 {
+			return nil, fmt.Errorf("the HTTP readiness probe requires a port")
+		}
+		return &coreV1.Probe{
+			ProbeHandler: coreV1.ProbeHandler{
+				HTTPGet: &coreV1.HTTPGetAction{Path: path, Port: intstr.FromInt(port)},
+			},
+		}, nil
+	case command != "":
+		if shell == "" {
+			shell = "sh"
+		}
+		return &coreV1.Probe{
+			ProbeHandler: coreV1.ProbeHandler{
+				Exec: &coreV1.ExecAction{Command: []string{shell, "-c", command}},
+			},
+		}, nil
+	case port != 0:
+		return &coreV1.Probe{
+			ProbeHandler: coreV1.ProbeHandler{
+				TCPSocket: &coreV1.TCPSocketAction{Port: intstr.FromInt(port)},
+			},
+		}, nil
+	}
+	return nil, nil
+}
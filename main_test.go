@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/drone-plugin-k8s-client/plugin"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// cliContext sets up the context of the app with the given flag values
+func cliContext(t *testing.T, values map[string]string) *cli.Context {
+	set := flag.NewFlagSet(appName, flag.ContinueOnError)
+	for name, value := range values {
+		set.String(name, "", "")
+		if err := set.Set(name, value); err != nil {
+			t.Fatalf("could not set the flag [ %s ]: %s", name, err)
+		}
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+// restoreLogger restores the formatter, the output and the hooks of the logger once the test is done
+func restoreLogger(t *testing.T) {
+	logger := logrus.StandardLogger()
+	formatter, output, hooks := logger.Formatter, logger.Out, logger.Hooks
+	t.Cleanup(func() {
+		logger.SetFormatter(formatter)
+		logger.SetOutput(output)
+		logger.ReplaceHooks(hooks)
+	})
+}
+
+func TestSysctls(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected []coreV1.Sysctl
+		invalid  bool
+	}{
+		{raw: "", expected: []coreV1.Sysctl{}},
+		{raw: "net.ipv4.tcp_syncookies=1", expected: []coreV1.Sysctl{{Name: "net.ipv4.tcp_syncookies", Value: "1"}}},
+		// unsafe sysctls are let through
+		{raw: " kernel.shm_rmid_forced=1 , net.core.somaxconn=1024", expected: []coreV1.Sysctl{
+			{Name: "kernel.shm_rmid_forced", Value: "1"}, {Name: "net.core.somaxconn", Value: "1024"}}},
+		{raw: "net.core.somaxconn", invalid: true},
+		{raw: "=1", invalid: true},
+	}
+
+	for _, test := range tests {
+		podSysctls, err := sysctls(test.raw)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("expected [ %s ] rejected", test.raw)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(podSysctls, test.expected) {
+			t.Errorf("sysctls of [ %s ]: expected %v, got: %v, error: %v", test.raw, test.expected, podSysctls, err)
+		}
+	}
+}
+
+// TestFormatVerbs runs the printf check of go vet on the plugin: the verbs of the log messages must match their arguments
+func TestFormatVerbs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("go vet is not run in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not available")
+	}
+
+	output, err := exec.Command(goTool, "vet", "-printf", "./...").CombinedOutput()
+	if err != nil {
+		t.Errorf("format verb mismatches found: %s\n%s", err, output)
+	}
+}
+
+func TestProcessLogFormat(t *testing.T) {
+	restoreLogger(t)
+
+	if err := processLogFormat(cliContext(t, map[string]string{"plugin.log.format": "json"})); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("expected the JSON formatter, got: %T", logrus.StandardLogger().Formatter)
+	}
+
+	if err := processLogFormat(cliContext(t, map[string]string{"plugin.log.format": "text"})); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := logrus.StandardLogger().Formatter.(*logrus.TextFormatter); !ok {
+		t.Errorf("expected the text formatter, got: %T", logrus.StandardLogger().Formatter)
+	}
+
+	if err := processLogFormat(cliContext(t, map[string]string{"plugin.log.format": "xml"})); err == nil {
+		t.Errorf("expected the xml format rejected")
+	}
+}
+
+func TestProcessLogOutput(t *testing.T) {
+	restoreLogger(t)
+	stdout, stderr := os.Stdout, os.Stderr
+	t.Cleanup(func() { os.Stdout, os.Stderr = stdout, stderr })
+
+	tests := []struct {
+		output, expected string
+	}{
+		{output: "", expected: "stderr"},
+		{output: "stderr", expected: "stderr"},
+		{output: "stdout", expected: "stdout"},
+	}
+	for _, test := range tests {
+		// the streams are looked up when the output is configured
+		streams := map[string]*os.File{}
+		for _, name := range []string{"stdout", "stderr"} {
+			stream, err := os.Create(filepath.Join(t.TempDir(), name))
+			if err != nil {
+				t.Fatalf("could not create the stream: %s", err)
+			}
+			defer stream.Close()
+			streams[name] = stream
+		}
+		os.Stdout, os.Stderr = streams["stdout"], streams["stderr"]
+
+		if err := processLogOutput(cliContext(t, map[string]string{"plugin.log.output": test.output})); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		logrus.Infof("job created")
+
+		for name, stream := range streams {
+			content, _ := os.ReadFile(stream.Name())
+			if logged := strings.Contains(string(content), "job created"); logged != (name == test.expected) {
+				t.Errorf("output [ %s ]: expected the log on the %s only, the %s got: %q", test.output, test.expected, name,
+					content)
+			}
+		}
+	}
+
+	if err := processLogOutput(cliContext(t, map[string]string{"plugin.log.output": "syslog"})); err == nil {
+		t.Errorf("expected the syslog output rejected")
+	}
+}
+
+func TestBuildFieldsHook(t *testing.T) {
+	restoreLogger(t)
+
+	var output bytes.Buffer
+	logrus.SetOutput(&output)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.AddHook(buildFieldsHook{plugin: plugin.New(plugin.Options{JobName: "repo-1", Namespace: "builds"})})
+
+	logrus.Infof("job created")
+
+	var entry map[string]string
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("the log entry is not JSON: %s", err)
+	}
+	if entry["job"] != "repo-1" || entry["namespace"] != "builds" {
+		t.Errorf("expected the job and the namespace fields, got: %v", entry)
+	}
+}
+
+func TestKubeConfigPath(t *testing.T) {
+	t.Setenv("DRONE_WORKSPACE", "/drone/src")
+
+	if path := kubeConfigPath(""); path != "/drone/src/.kube/config" {
+		t.Errorf("expected the kube config in the workspace, got: [ %s ]", path)
+	}
+	if path := kubeConfigPath("/etc/kube/config"); path != "/etc/kube/config" {
+		t.Errorf("expected the kube config path passed in, got: [ %s ]", path)
+	}
+}
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://kubernetes.test:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`
+
+func TestRestConfigReadsTheKubeConfigFile(t *testing.T) {
+	kubeConfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeConfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatalf("could not write the kube config: %s", err)
+	}
+
+	config, err := restConfig(kubeConfig, false)
+	if err != nil || config.Host != "https://kubernetes.test:6443" {
+		t.Errorf("expected the config of the kube config file, got: %v, error: %v", config, err)
+	}
+}
+
+func TestRestConfigFallsBackToInClusterConfig(t *testing.T) {
+	// outside of a pod, the in-cluster config is not available
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	if _, err := restConfig(filepath.Join(t.TempDir(), "missing"), false); err != rest.ErrNotInCluster {
+		t.Errorf("expected the in-cluster config used without a kube config file, got the error: %v", err)
+	}
+}
+
+func TestRestConfigForcedInCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	kubeConfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeConfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatalf("could not write the kube config: %s", err)
+	}
+
+	if _, err := restConfig(kubeConfig, true); err != rest.ErrNotInCluster {
+		t.Errorf("expected the in-cluster config used despite the kube config file, got the error: %v", err)
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	tests := []struct {
+		path, command, shell string
+		port                 int
+		expected             coreV1.ProbeHandler
+		none, invalid        bool
+	}{
+		{none: true},
+		{path: "/healthz", port: 8080,
+			expected: coreV1.ProbeHandler{HTTPGet: &coreV1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8080)}}},
+		{command: "pg_isready",
+			expected: coreV1.ProbeHandler{Exec: &coreV1.ExecAction{Command: []string{"sh", "-c", "pg_isready"}}}},
+		{command: "pg_isready", shell: "bash",
+			expected: coreV1.ProbeHandler{Exec: &coreV1.ExecAction{Command: []string{"bash", "-c", "pg_isready"}}}},
+		{port: 5432, expected: coreV1.ProbeHandler{TCPSocket: &coreV1.TCPSocketAction{Port: intstr.FromInt(5432)}}},
+		{path: "/healthz", invalid: true},
+		{path: "/healthz", port: 8080, command: "pg_isready", invalid: true},
+		{port: 70000, invalid: true},
+	}
+
+	for _, test := range tests {
+		probe, err := readinessProbe(test.path, test.port, test.command, test.shell)
+		switch {
+		case test.invalid:
+			if err == nil {
+				t.Errorf("expected the probe rejected: %+v", test)
+			}
+		case err != nil:
+			t.Errorf("unexpected error: %s", err)
+		case test.none:
+			if probe != nil {
+				t.Errorf("expected no probe, got: %v", probe)
+			}
+		case probe == nil || !reflect.DeepEqual(probe.ProbeHandler, test.expected):
+			t.Errorf("expected the probe %v, got: %v", test.expected, probe)
+		}
+	}
+}
+
+func TestOriginalCommands(t *testing.T) {
+	tests := []struct {
+		env      string
+		expected []string
+	}{
+		{env: "", expected: nil},
+		{env: "go build ./...", expected: []string{"go build ./..."}},
+		{env: "go vet ./...\n\n  go test ./...  \n", expected: []string{"go vet ./...", "go test ./..."}},
+	}
+
+	for _, test := range tests {
+		t.Setenv("PLUGIN_ORIGINAL_COMMANDS", test.env)
+		if commands := originalCommands(); !reflect.DeepEqual(commands, test.expected) {
+			t.Errorf("commands of [ %q ]: expected %q, got: %q", test.env, test.expected, commands)
+		}
+	}
+}
+
+func TestHostPaths(t *testing.T) {
+	socket, directory := coreV1.HostPathSocket, coreV1.HostPathDirectory
+
+	paths, err := hostPaths("/var/run/docker.sock:/var/run/docker.sock:Socket,/opt/cache:/cache:Directory,/tmp:/host-tmp")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []plugin.HostPath{
+		{Path: "/var/run/docker.sock", MountPath: "/var/run/docker.sock", Type: &socket},
+		{Path: "/opt/cache", MountPath: "/cache", Type: &directory},
+		{Path: "/tmp", MountPath: "/host-tmp"},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got: %v", expected, paths)
+	}
+
+	for _, raw := range []string{"/var/run/docker.sock", ":/cache", "/opt/cache:", "/opt/cache:/cache:Pipe", "/a:/b:Socket:extra"} {
+		if _, err := hostPaths(raw); err == nil {
+			t.Errorf("expected the host path [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	nodeAffinity, err := affinity(`{"nodeAffinity":{"requiredDuringSchedulingIgnoredDuringExecution":{"nodeSelectorTerms":[
+		{"matchExpressions":[{"key":"topology.kubernetes.io/zone","operator":"In","values":["eu-west-1a"]}]}]}}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	terms := nodeAffinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 || terms[0].MatchExpressions[0].Key != "topology.kubernetes.io/zone" ||
+		terms[0].MatchExpressions[0].Values[0] != "eu-west-1a" {
+		t.Errorf("unexpected node affinity: %v", nodeAffinity)
+	}
+
+	podAntiAffinity, err := affinity(`{"podAntiAffinity":{"preferredDuringSchedulingIgnoredDuringExecution":[{"weight":100,
+		"podAffinityTerm":{"labelSelector":{"matchLabels":{"app":"drone-build"}},"topologyKey":"kubernetes.io/hostname"}}]}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	preferred := podAntiAffinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(preferred) != 1 || preferred[0].Weight != 100 || preferred[0].PodAffinityTerm.TopologyKey != "kubernetes.io/hostname" {
+		t.Errorf("unexpected pod anti affinity: %v", podAntiAffinity)
+	}
+
+	if podAffinity, err := affinity(""); podAffinity != nil || err != nil {
+		t.Errorf("expected no affinity, got: %v, error: %v", podAffinity, err)
+	}
+	for _, raw := range []string{`{"nodeAffinity":`, `{"nodeAffinty":{}}`} {
+		if _, err := affinity(raw); err == nil {
+			t.Errorf("expected the affinity [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestQuantity(t *testing.T) {
+	if parsed, err := quantity("2Gi"); err != nil || parsed.String() != "2Gi" {
+		t.Errorf("expected 2Gi, got: %v, error: %v", parsed, err)
+	}
+	if parsed, err := quantity(""); parsed != nil || err != nil {
+		t.Errorf("expected no quantity, got: %v, error: %v", parsed, err)
+	}
+	if _, err := quantity("2 gigs"); err == nil {
+		t.Errorf("expected the invalid quantity rejected")
+	}
+}
+
+func TestContainerPorts(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected []coreV1.ContainerPort
+	}{
+		{raw: "", expected: []coreV1.ContainerPort{}},
+		{raw: "http:8080", expected: []coreV1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: coreV1.ProtocolTCP}}},
+		{raw: "http:8080, dns:53:udp,metrics:9090:TCP", expected: []coreV1.ContainerPort{
+			{Name: "http", ContainerPort: 8080, Protocol: coreV1.ProtocolTCP},
+			{Name: "dns", ContainerPort: 53, Protocol: coreV1.ProtocolUDP},
+			{Name: "metrics", ContainerPort: 9090, Protocol: coreV1.ProtocolTCP},
+		}},
+	}
+
+	for _, test := range tests {
+		ports, err := containerPorts(test.raw)
+		if err != nil || !reflect.DeepEqual(ports, test.expected) {
+			t.Errorf("ports of [ %s ]: expected %v, got: %v, error: %v", test.raw, test.expected, ports, err)
+		}
+	}
+
+	for _, raw := range []string{"8080", ":8080", "http:0", "http:65536", "http:port", "http:8080:icmp", "http:8080:tcp:extra"} {
+		if _, err := containerPorts(raw); err == nil {
+			t.Errorf("expected the port [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestFieldEnvs(t *testing.T) {
+	envVars, err := fieldEnvs("MY_POD=metadata.name,MY_NAMESPACE=metadata.namespace,MY_APP=metadata.labels['app']")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]string{"MY_POD": "metadata.name", "MY_NAMESPACE": "metadata.namespace", "MY_APP": "metadata.labels['app']"}
+	if len(envVars) != len(expected) {
+		t.Fatalf("expected %d env vars, got: %v", len(expected), envVars)
+	}
+	for _, envVar := range envVars {
+		if envVar.Value != "" || envVar.ValueFrom == nil || envVar.ValueFrom.FieldRef == nil ||
+			envVar.ValueFrom.FieldRef.FieldPath != expected[envVar.Name] {
+			t.Errorf("expected [ %s ] set from the field [ %s ], got: %v", envVar.Name, expected[envVar.Name], envVar.ValueFrom)
+		}
+	}
+
+	for _, raw := range []string{"MY_POD=metadata.nam", "MY_LABELS=metadata.labels", "MY_APP=metadata.labels['']", "MY_POD"} {
+		if _, err := fieldEnvs(raw); err == nil {
+			t.Errorf("expected [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestResourceEnvs(t *testing.T) {
+	envVars, err := resourceEnvs("CPU_LIMIT=limits.cpu,MEMORY=requests.memory,HUGEPAGES=limits.hugepages-2Mi")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []coreV1.EnvVar{
+		{Name: "CPU_LIMIT", ValueFrom: &coreV1.EnvVarSource{ResourceFieldRef: &coreV1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+		{Name: "MEMORY", ValueFrom: &coreV1.EnvVarSource{ResourceFieldRef: &coreV1.ResourceFieldSelector{Resource: "requests.memory"}}},
+		{Name: "HUGEPAGES", ValueFrom: &coreV1.EnvVarSource{ResourceFieldRef: &coreV1.ResourceFieldSelector{Resource: "limits.hugepages-2Mi"}}},
+	}
+	if !reflect.DeepEqual(envVars, expected) {
+		t.Errorf("expected %v, got: %v", expected, envVars)
+	}
+
+	for _, raw := range []string{"CPU=cpu", "GPU=limits.nvidia.com/gpu", "CPU=limits.cpus"} {
+		if _, err := resourceEnvs(raw); err == nil {
+			t.Errorf("expected [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected []string
+	}{
+		{raw: "", expected: nil},
+		{raw: `[{"name":"docker","image":"docker:dind","securityContext":{"privileged":true}}]`, expected: []string{"docker"}},
+		{raw: `[{"name":"docker","image":"docker:dind"},{"name":"postgres","image":"postgres:16","env":[{"name":"POSTGRES_PASSWORD","value":"test"}]}]`,
+			expected: []string{"docker", "postgres"}},
+	}
+
+	for _, test := range tests {
+		containers, err := sidecars(test.raw)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		var names []string
+		for _, container := range containers {
+			names = append(names, container.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("expected the sidecars %v, got: %v", test.expected, names)
+		}
+	}
+
+	for _, raw := range []string{`{"name":"docker"}`, `[{"name":"docker","imag":"docker:dind"}]`, `[{"name":`} {
+		if _, err := sidecars(raw); err == nil {
+			t.Errorf("expected the sidecars [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name, expected string
+	}{
+		{name: "repo-1-1600000000", expected: "repo-1-1600000000"},
+		{name: "My_Repo.Name-1", expected: "my-repo-name-1"},
+		{name: "--feature/branch--", expected: "feature-branch"},
+		{name: "a__b", expected: "a-b"},
+	}
+
+	for _, test := range tests {
+		if sanitized := sanitizeName(test.name); sanitized != test.expected {
+			t.Errorf("expected [ %s ] sanitized to [ %s ], got: [ %s ]", test.name, test.expected, sanitized)
+		}
+	}
+}
+
+func TestSanitizeLongNames(t *testing.T) {
+	long := strings.Repeat("very-long-repository-name-", 4)
+	first, second := sanitizeName(long+"1-1600000000"), sanitizeName(long+"2-1600000000")
+
+	for _, name := range []string{first, second} {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			t.Errorf("[ %s ] is not a valid DNS label: %v", name, msgs)
+		}
+	}
+	// the truncated names differ in the hash of the full name
+	if first == second {
+		t.Errorf("the names of different builds collide: [ %s ]", first)
+	}
+	if first != sanitizeName(long+"1-1600000000") {
+		t.Errorf("the sanitized name is not stable")
+	}
+}
+
+func TestJobName(t *testing.T) {
+	t.Setenv("DRONE_REPO_NAME", "Hello_World")
+	t.Setenv("DRONE_BUILD_NUMBER", "42")
+
+	if name := jobName("Custom_Name", ""); name != "custom-name" {
+		t.Errorf("expected the custom name sanitized, got: [ %s ]", name)
+	}
+	if name := jobName("", ""); !strings.HasPrefix(name, "hello-world-42-") {
+		t.Errorf("expected the name of the repository and the build, got: [ %s ]", name)
+	}
+	if name := jobName("", "ci"); !strings.HasPrefix(name, "ci-42-") {
+		t.Errorf("expected the name prefixed, got: [ %s ]", name)
+	}
+}
+
+func TestNamesDerivedFromTheDroneEnv(t *testing.T) {
+	t.Setenv("DRONE_REPO_NAME", "Octo_Org/Hello.World")
+	t.Setenv("DRONE_BUILD_NUMBER", "7")
+
+	if pvc := workspacePVC(); pvc != "octo-org-hello-world-7-workspace" {
+		t.Errorf("unexpected workspace PVC name: [ %s ]", pvc)
+	}
+
+	name := jobName("", "")
+	if !strings.HasPrefix(name, "octo-org-hello-world-7-") {
+		t.Errorf("unexpected job name: [ %s ]", name)
+	}
+	for _, derived := range []string{workspacePVC(), name} {
+		if msgs := validation.IsDNS1123Label(derived); len(msgs) > 0 {
+			t.Errorf("[ %s ] is not a valid DNS label: %v", derived, msgs)
+		}
+	}
+}
+
+func TestDecodeProjectedVolume(t *testing.T) {
+	var volumes []coreV1.Volume
+	err := decodeJSON("plugin.job.volumes", `[{"name":"config","projected":{"sources":[{"configMap":{"name":"build-config"}},
+		{"secret":{"name":"build-secrets","items":[{"key":"token","path":"token"}]}}]}}]`, &volumes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(volumes) != 1 || volumes[0].Projected == nil || len(volumes[0].Projected.Sources) != 2 ||
+		volumes[0].Projected.Sources[0].ConfigMap.Name != "build-config" ||
+		volumes[0].Projected.Sources[1].Secret.Items[0].Key != "token" {
+		t.Errorf("unexpected volumes: %v", volumes)
+	}
+
+	var mounts []coreV1.VolumeMount
+	err = decodeJSON("plugin.job.volume.mounts", `[{"name":"config","mountPoint":"/etc/build"}]`, &mounts)
+	if err == nil {
+		t.Errorf("expected the unknown field rejected")
+	}
+}
+
+func TestDecodeJSONDoesNotLogTheValue(t *testing.T) {
+	restoreLogger(t)
+	defer logrus.SetLevel(logrus.GetLevel())
+	var output bytes.Buffer
+	logrus.SetOutput(&output)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	var containers []coreV1.Container
+	raw := `[{"name":"proxy","image":"envoy","env":[{"name":"TOKEN","value":"s3cr3t"}]}]`
+	if err := decodeJSON("plugin.job.sidecars", raw, &containers); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if strings.Contains(output.String(), "s3cr3t") {
+		t.Errorf("the decoded value is logged: %s", output.String())
+	}
+	if !strings.Contains(output.String(), "decoded [ 1 ] item(s) of: [ plugin.job.sidecars ]") {
+		t.Errorf("expected the number of decoded items logged, got: %s", output.String())
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	t.Setenv("DRONE_BUILD_NUMBER", "42")
+
+	selector, err := labelSelector("team=platform,tier=ci")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{"team": "platform", "tier": "ci", plugin.Label: "42-label"}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Errorf("expected %v, got: %v", expected, selector)
+	}
+
+	if _, err := labelSelector(plugin.Label + "=other"); err == nil {
+		t.Errorf("expected the label of the plugin reserved")
+	}
+}
+
+func TestWithResponseTimeout(t *testing.T) {
+	config := &rest.Config{Host: "https://kubernetes.test:6443"}
+	withResponseTimeout(config, 30*time.Second)
+
+	transport, ok := config.WrapTransport(&http.Transport{}).(*http.Transport)
+	if !ok || transport.ResponseHeaderTimeout != 30*time.Second {
+		t.Errorf("expected the response timeout of 30s, got the transport: %#v", transport)
+	}
+
+	config = &rest.Config{Host: "https://kubernetes.test:6443"}
+	withResponseTimeout(config, 0)
+	if config.WrapTransport != nil {
+		t.Errorf("the transport is wrapped without a timeout")
+	}
+}
+
+func TestHungAPIServerTimesOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	withResponseTimeout(config, 100*time.Millisecond)
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("could not set up the clientset: %s", err)
+	}
+
+	result := make(chan error)
+	go func() {
+		_, err := clientSet.BatchV1().Jobs("default").Get(context.Background(), "repo-1", metaV1.GetOptions{})
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("expected the request timed out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the request to the hung API server didn't time out")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	const caCert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+	config, err := serverConfig("https://kubernetes.test:6443", "secret", caCert, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Host != "https://kubernetes.test:6443" || config.BearerToken != "secret" {
+		t.Errorf("the server and the token are not set: %s, %s", config.Host, config.BearerToken)
+	}
+	if string(config.TLSClientConfig.CAData) != caCert || config.TLSClientConfig.CAFile != "" {
+		t.Errorf("expected the PEM encoded CA certificate in the CA data, got: %+v", config.TLSClientConfig)
+	}
+
+	config, err = serverConfig("https://kubernetes.test:6443", "secret", "/var/run/ca.crt", false)
+	if err != nil || config.TLSClientConfig.CAFile != "/var/run/ca.crt" || config.TLSClientConfig.CAData != nil {
+		t.Errorf("expected the path of the CA certificate in the CA file, got: %+v, error: %v", config, err)
+	}
+}
+
+func TestServerConfigInsecure(t *testing.T) {
+	config, err := serverConfig("https://kubernetes.test:6443", "secret", "/var/run/ca.crt", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !config.TLSClientConfig.Insecure || config.TLSClientConfig.CAFile != "" || config.TLSClientConfig.CAData != nil {
+		t.Errorf("expected the verification skipped and the CA certificate ignored, got: %+v", config.TLSClientConfig)
+	}
+
+	// the client refuses the insecure config with a CA certificate
+	if _, err := kubernetes.NewForConfig(config); err != nil {
+		t.Errorf("could not set up the clientset: %s", err)
+	}
+}
+
+func TestServerConfigRequiresTheToken(t *testing.T) {
+	if _, err := serverConfig("https://kubernetes.test:6443", "", "", false); err == nil {
+		t.Errorf("expected an error without the token")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	parsed, err := capabilities("NET_ADMIN, SYS_TIME")
+	if err != nil || !reflect.DeepEqual(parsed, []coreV1.Capability{"NET_ADMIN", "SYS_TIME"}) {
+		t.Errorf("expected NET_ADMIN and SYS_TIME, got: %v, error: %v", parsed, err)
+	}
+	if parsed, err := capabilities(""); len(parsed) != 0 || err != nil {
+		t.Errorf("expected no capabilities, got: %v, error: %v", parsed, err)
+	}
+	for _, invalid := range []string{"net_admin", "CAP-NET-ADMIN", "ALL;rm"} {
+		if _, err := capabilities(invalid); err == nil {
+			t.Errorf("expected the invalid capability [ %s ] rejected", invalid)
+		}
+	}
+}
+
+func TestDecodeTopologySpread(t *testing.T) {
+	var constraints []coreV1.TopologySpreadConstraint
+	err := decodeJSON("plugin.job.topology.spread",
+		`[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "ScheduleAnyway"}]`, &constraints)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []coreV1.TopologySpreadConstraint{{
+		MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: coreV1.ScheduleAnyway,
+	}}
+	if !reflect.DeepEqual(constraints, expected) {
+		t.Errorf("expected the constraints: %v, got: %v", expected, constraints)
+	}
+
+	for _, raw := range []string{`[{"maxSkew": 1`, `[{"maxSkw": 1}]`, `{"maxSkew": 1}`} {
+		if err := decodeJSON("plugin.job.topology.spread", raw, &[]coreV1.TopologySpreadConstraint{}); err == nil {
+			t.Errorf("expected the constraints [ %s ] rejected", raw)
+		}
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	t.Setenv("DRONE_WORKSPACE", "")
+	if ws := workspace("/drone/src"); ws != "/drone/src" {
+		t.Errorf("expected the default workspace without the env, got: %s", ws)
+	}
+
+	t.Setenv("DRONE_WORKSPACE", "/go/src/github.com/octocat/hello-world")
+	if ws := workspace("/drone/src"); ws != "/go/src/github.com/octocat/hello-world" {
+		t.Errorf("expected the workspace of the env, got: %s", ws)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	content := `# written by the build step
+GOFLAGS=-mod=vendor
+
+export VERSION="1.2.3"
+  MESSAGE = 'hello # world'
+ESCAPED="line one\nline two"
+CHANNEL=stable # the release channel
+GREETING="hello world" # quoted, with a comment
+TITLE='release notes'   # padded
+EMPTY=
+VERSION=1.2.4
+`
+	filePath := filepath.Join(t.TempDir(), "build.env")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write the env file: %s", err)
+	}
+
+	envVars, err := envFile(filePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the later value of a repeated key wins, keeping its first position
+	expected := []coreV1.EnvVar{
+		{Name: "GOFLAGS", Value: "-mod=vendor"},
+		{Name: "VERSION", Value: "1.2.4"},
+		{Name: "MESSAGE", Value: "hello # world"},
+		{Name: "ESCAPED", Value: "line one\nline two"},
+		{Name: "CHANNEL", Value: "stable"},
+		{Name: "GREETING", Value: "hello world"},
+		{Name: "TITLE", Value: "release notes"},
+		{Name: "EMPTY", Value: ""},
+	}
+	if !reflect.DeepEqual(envVars, expected) {
+		t.Errorf("expected the env vars: %v, got: %v", expected, envVars)
+	}
+
+	if envVars, err := envFile(""); envVars != nil || err != nil {
+		t.Errorf("expected no env vars without the file, got: %v, error: %v", envVars, err)
+	}
+}
+
+func TestEnvFileRejectsInvalidLines(t *testing.T) {
+	for _, content := range []string{"GOFLAGS", "1VERSION=1.2.3", "MESSAGE='hello",
+		`MESSAGE="hello`, `MESSAGE="hello" world`, "MESSAGE='hello' world"} {
+		filePath := filepath.Join(t.TempDir(), "build.env")
+		if err := os.WriteFile(filePath, []byte(content+"\n"), 0644); err != nil {
+			t.Fatalf("could not write the env file: %s", err)
+		}
+		if _, err := envFile(filePath); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("expected the line [ %s ] rejected, got: %v", content, err)
+		}
+	}
+
+	if _, err := envFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Errorf("expected an error for the missing env file")
+	}
+}
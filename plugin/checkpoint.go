@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkpoint represents the progress of the build as written to the checkpoint file
+type checkpoint struct {
+	Phase          string     `json:"phase"`
+	Started        time.Time  `json:"started"`
+	Updated        time.Time  `json:"updated"`
+	ElapsedSeconds int64      `json:"elapsedSeconds"`
+	LastLogTime    *time.Time `json:"lastLogTime,omitempty"`
+	BytesStreamed  int64      `json:"bytesStreamed"`
+}
+
+// progress tracks the progress of the build
+type progress struct {
+	checkpoint
+	// the moments the job got created and completed (reported in the metrics)
+	jobCreated   time.Time
+	jobCompleted time.Time
+	// the exit code of the job container once terminated (reported in the result file)
+	exitCode *int32
+	lock     sync.Mutex
+}
+
+// progressWriter records the streamed logs in the progress of the build
+type progressWriter struct {
+	writer   io.Writer
+	progress *progress
+}
+
+func (w progressWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+
+	w.progress.lock.Lock()
+	defer w.progress.lock.Unlock()
+	now := time.Now()
+	w.progress.LastLogTime = &now
+	w.progress.BytesStreamed += int64(n)
+
+	return n, err
+}
+
+// StartCheckpoints starts writing the progress of the build to the checkpoint file periodically (besides the updates
+// triggered by the events of the job and its pods); the returned function stops the periodic updates
+func (p *Plugin) StartCheckpoints() func() {
+	p.progress.lock.Lock()
+	p.progress.Started = time.Now()
+	p.progress.lock.Unlock()
+
+	if p.CheckpointFile == "" || p.CheckpointInterval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(p.CheckpointInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				p.writeCheckpoint()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		p.writeCheckpoint()
+	}
+}
+
+// StartHeartbeat logs the phase of the build periodically while waiting for the job, so that the build doesn't look
+// stuck during long image pulls or scheduling; the returned function stops the heartbeat
+func (p *Plugin) StartHeartbeat() func() {
+	if p.HeartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(p.HeartbeatInterval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				p.progress.lock.Lock()
+				phase, elapsed := p.progress.Phase, time.Since(p.progress.Started).Round(time.Second)
+				p.progress.lock.Unlock()
+				logrus.Infof("waiting for job [ %s ], phase: [ %s ], elapsed: [ %s ]", p.CurrentJobName(), phase, elapsed)
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	// no heartbeat is logged once stopped
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// recordPhase records the current phase of the build
+func (p *Plugin) recordPhase(phase string) {
+	p.progress.lock.Lock()
+	p.progress.Phase = phase
+	p.progress.lock.Unlock()
+
+	p.writeCheckpoint()
+}
+
+// writeCheckpoint writes the progress of the build to the checkpoint file
+// The file is replaced atomically so that its readers never see a partially written checkpoint
+func (p *Plugin) writeCheckpoint() {
+	if p.CheckpointFile == "" {
+		return
+	}
+
+	p.progress.lock.Lock()
+	defer p.progress.lock.Unlock()
+
+	p.progress.Updated = time.Now()
+	p.progress.ElapsedSeconds = int64(p.progress.Updated.Sub(p.progress.Started).Seconds())
+	content, err := json.Marshal(p.progress.checkpoint)
+	if err != nil {
+		logrus.Errorf("could not marshal the checkpoint. error: %s", err)
+		return
+	}
+
+	tmpFile := p.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		logrus.Errorf("could not write the checkpoint file: [ %s ], error: %s", tmpFile, err)
+		return
+	}
+
+	if err := os.Rename(tmpFile, p.CheckpointFile); err != nil {
+		logrus.Errorf("could not replace the checkpoint file: [ %s ], error: %s", p.CheckpointFile, err)
+	}
+}
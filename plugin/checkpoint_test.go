@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// heartbeats counts the logged heartbeats
+func heartbeats(logs *test.Hook) int {
+	count := 0
+	for _, entry := range logs.AllEntries() {
+		if strings.HasPrefix(entry.Message, "waiting for job") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestHeartbeatFiresWhileWaiting(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	p := newTestPlugin(Options{HeartbeatInterval: 10 * time.Millisecond})
+	p.recordPhase("pulling the image")
+	stopHeartbeat := p.StartHeartbeat()
+
+	deadline := time.Now().Add(time.Second)
+	for heartbeats(logs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopHeartbeat()
+
+	if heartbeats(logs) == 0 {
+		t.Fatalf("expected a heartbeat logged")
+	}
+	if message := logs.LastEntry().Message; !strings.Contains(message, "[ pulling the image ]") {
+		t.Errorf("expected the phase in the heartbeat, got: %s", message)
+	}
+
+	// no heartbeat once stopped
+	stopped := heartbeats(logs)
+	time.Sleep(50 * time.Millisecond)
+	if heartbeats(logs) != stopped {
+		t.Errorf("the heartbeat fired after it was stopped")
+	}
+}
+
+func TestHeartbeatIsDisabledByDefault(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	stopHeartbeat := newTestPlugin(Options{}).StartHeartbeat()
+	time.Sleep(50 * time.Millisecond)
+	stopHeartbeat()
+
+	if heartbeats(logs) != 0 {
+		t.Errorf("expected no heartbeat without an interval")
+	}
+}
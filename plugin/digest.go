@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// the annotation of the job holding the digest of its image
+	imageDigestAnnotation = "image-digest"
+
+	// the config map holding the digests of the images run by the previous builds
+	imageDigestsConfigMap = "image-digests"
+)
+
+var (
+	// characters not allowed in config map keys
+	invalidConfigMapKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+)
+
+// dockerConfig represents the content of image pull secrets
+type dockerConfig struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+// trackImageDigest resolves the digest of the image of the job and records it as an annotation of the job
+// The digest is compared to the one recorded by the previous build running the same image reference, so that mutable
+// tags (eg. latest) pointing to a changed image get noticed. Failures are logged only, they don't affect the build
+func (p *Plugin) trackImageDigest(ctx context.Context, job *v1.Job, clientSet kubernetes.Interface) {
+	digest, err := p.imageDigest(ctx, clientSet)
+	if err != nil {
+		logrus.Warnf("could not resolve the digest of image: [ %s ], error: %s", p.Image, err)
+		return
+	}
+
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[imageDigestAnnotation] = digest
+
+	previous, err := p.recordImageDigest(ctx, digest, clientSet)
+	if err != nil {
+		logrus.Warnf("could not record the image digest. error: %s", err)
+	}
+
+	switch {
+	case previous == "":
+		logrus.Infof("image [ %s ] digest: [ %s ]", p.Image, digest)
+	case previous == digest:
+		logrus.Infof("image [ %s ] unchanged since the previous build, digest: [ %s ]", p.Image, digest)
+	default:
+		logrus.Warnf("image [ %s ] changed since the previous build, digest: [ %s ] -> [ %s ]", p.Image, previous, digest)
+	}
+}
+
+// recordImageDigest records the digest of the image in the config map shared by the builds, returns the digest recorded
+// by the previous build (empty if none)
+// Concurrent builds may update the config map at the same time, the update is retried on conflicts
+func (p *Plugin) recordImageDigest(ctx context.Context, digest string, clientSet kubernetes.Interface) (string, error) {
+	var previous string
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apiErrors.IsConflict(err) || apiErrors.IsAlreadyExists(err)
+	}, func() error {
+		digests, err := clientSet.CoreV1().ConfigMaps(p.Namespace).Get(ctx, imageDigestsConfigMap, metaV1.GetOptions{})
+		if apiErrors.IsNotFound(err) {
+			previous = ""
+			digests = &coreV1.ConfigMap{
+				ObjectMeta: metaV1.ObjectMeta{Name: imageDigestsConfigMap},
+				Data:       map[string]string{imageDigestKey(p.Image): digest},
+			}
+			_, err = clientSet.CoreV1().ConfigMaps(p.Namespace).Create(ctx, digests, metaV1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		previous = digests.Data[imageDigestKey(p.Image)]
+		if digests.Data == nil {
+			digests.Data = map[string]string{}
+		}
+		digests.Data[imageDigestKey(p.Image)] = digest
+		_, err = clientSet.CoreV1().ConfigMaps(p.Namespace).Update(ctx, digests, metaV1.UpdateOptions{})
+		return err
+	})
+	return previous, err
+}
+
+// imageDigest resolves the digest of the image from its registry, authenticating with the image pull secrets
+func (p *Plugin) imageDigest(ctx context.Context, clientSet kubernetes.Interface) (string, error) {
+	ref, err := name.ParseReference(p.Image)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := p.registryAuth(ctx, normalizeRegistry(ref.Context().RegistryStr()), clientSet)
+	if err != nil {
+		return "", err
+	}
+
+	descriptor, err := remote.Head(ref, remote.WithAuth(auth), remote.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	return descriptor.Digest.String(), nil
+}
+
+// registryAuth looks up the credentials of the registry in the image pull secrets, anonymous access if there is none
+func (p *Plugin) registryAuth(ctx context.Context, registry string, clientSet kubernetes.Interface) (authn.Authenticator, error) {
+	for _, secretName := range p.ImagePullSecrets {
+		secret, err := clientSet.CoreV1().Secrets(p.Namespace).Get(ctx, secretName, metaV1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		var config dockerConfig
+		if content, ok := secret.Data[coreV1.DockerConfigJsonKey]; ok {
+			err = json.Unmarshal(content, &config)
+		} else if content, ok := secret.Data[coreV1.DockerConfigKey]; ok {
+			// the legacy format has no auths wrapper
+			err = json.Unmarshal(content, &config.Auths)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for server, authConfig := range config.Auths {
+			if configRegistry(server) == registry {
+				logrus.Debugf("using the credentials of pull secret [ %s ] for registry [ %s ]", secretName, registry)
+				return authn.FromConfig(authConfig), nil
+			}
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// configRegistry extracts the registry from the server address of a docker config (eg. https://index.docker.io/v1/)
+func configRegistry(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	return normalizeRegistry(strings.SplitN(server, "/", 2)[0])
+}
+
+// imageDigestKey assembles the config map key of the image reference
+func imageDigestKey(image string) string {
+	return invalidConfigMapKeyChars.ReplaceAllString(normalizeImage(image), "_")
+}
@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func TestRecordImageDigestCreatesTheConfigMap(t *testing.T) {
+	p := newTestPlugin(Options{Image: "alpine:latest"})
+	clientSet := fake.NewSimpleClientset()
+
+	previous, err := p.recordImageDigest(context.Background(), "sha256:1", clientSet)
+	if err != nil || previous != "" {
+		t.Fatalf("expected no previous digest, got: [ %s ], error: %v", previous, err)
+	}
+
+	digests, err := clientSet.CoreV1().ConfigMaps(p.Namespace).Get(context.Background(), imageDigestsConfigMap, metaV1.GetOptions{})
+	if err != nil || digests.Data[imageDigestKey(p.Image)] != "sha256:1" {
+		t.Errorf("the digest is not recorded: %v, error: %v", digests, err)
+	}
+}
+
+func TestRecordImageDigestRetriesOnConflict(t *testing.T) {
+	p := newTestPlugin(Options{Image: "alpine:latest"})
+	digests := &coreV1.ConfigMap{
+		ObjectMeta: metaV1.ObjectMeta{Name: imageDigestsConfigMap, Namespace: p.Namespace},
+		Data:       map[string]string{imageDigestKey(p.Image): "sha256:1"},
+	}
+	clientSet := fake.NewSimpleClientset(digests)
+
+	// a concurrent build updates the config map first
+	conflicts := 0
+	clientSet.PrependReactor("update", "configmaps", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apiErrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, imageDigestsConfigMap, nil)
+	})
+
+	previous, err := p.recordImageDigest(context.Background(), "sha256:2", clientSet)
+	if err != nil || previous != "sha256:1" {
+		t.Fatalf("expected the previous digest sha256:1, got: [ %s ], error: %v", previous, err)
+	}
+
+	updated, _ := clientSet.CoreV1().ConfigMaps(p.Namespace).Get(context.Background(), imageDigestsConfigMap, metaV1.GetOptions{})
+	if updated.Data[imageDigestKey(p.Image)] != "sha256:2" {
+		t.Errorf("the digest is not updated after the conflict: %v", updated.Data)
+	}
+}
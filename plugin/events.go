@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// WatchEvents logs the warning events (eg. FailedScheduling) of the job and its pods, as these problems don't show up in
+// the status of the pod. Returns the function to stop watching the events
+func (p *Plugin) WatchEvents(ctx context.Context, clientSet kubernetes.Interface) (func(), error) {
+	if !p.ShowEvents {
+		return func() {}, nil
+	}
+
+	options := metaV1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("type", coreV1.EventTypeWarning).String(),
+	}
+
+	eventWatcher, err := clientSet.CoreV1().Events(p.Namespace).Watch(ctx, options)
+	if err != nil {
+		logrus.Errorf("could not watch events. err: %s", err)
+		return nil, err
+	}
+	logrus.Debugf("event watcher started")
+
+	go func() {
+		for event := range eventWatcher.ResultChan() {
+			payload, ok := event.Object.(*coreV1.Event)
+			if !ok || event.Type == watch.Deleted || !p.ownEvent(payload) {
+				continue
+			}
+
+			logrus.Warnf("%s [ %s ]: %s %s", strings.ToLower(payload.InvolvedObject.Kind), payload.InvolvedObject.Name,
+				payload.Reason, payload.Message)
+		}
+	}()
+
+	return eventWatcher.Stop, nil
+}
+
+// ownEvent checks whether the event is about the job or one of its pods (named after the job)
+func (p *Plugin) ownEvent(event *coreV1.Event) bool {
+	involved := event.InvolvedObject
+	switch involved.Kind {
+	case "Job":
+		return involved.Name == p.CurrentJobName()
+	case "Pod":
+		return strings.HasPrefix(involved.Name, p.CurrentJobName()+"-")
+	}
+	return false
+}
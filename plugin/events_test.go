@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// warningEvent returns a warning event involving the object
+func warningEvent(name, kind, involved, reason string) *coreV1.Event {
+	return &coreV1.Event{
+		ObjectMeta:     metaV1.ObjectMeta{Name: name, Namespace: "default"},
+		InvolvedObject: coreV1.ObjectReference{Kind: kind, Name: involved, Namespace: "default"},
+		Type:           coreV1.EventTypeWarning,
+		Reason:         reason,
+		Message:        "0/3 nodes are available: 3 Insufficient cpu.",
+	}
+}
+
+func TestWatchEventsLogsTheWarningsOfTheJobPods(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	clientSet := fake.NewSimpleClientset()
+	p := newTestPlugin(Options{ShowEvents: true})
+	stop, err := p.WatchEvents(context.Background(), clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer stop()
+
+	for _, event := range []*coreV1.Event{
+		warningEvent("other", "Pod", "other-job-abcde", "FailedScheduling"),
+		warningEvent("own", "Pod", p.JobName+"-abcde", "FailedScheduling"),
+	} {
+		if _, err := clientSet.CoreV1().Events(p.Namespace).Create(context.Background(), event, metaV1.CreateOptions{}); err != nil {
+			t.Fatalf("could not create the event: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(logs.AllEntries()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	entries := logs.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("expected the warning of the job pod logged, got: %d entries", len(entries))
+	}
+	if message := entries[0].Message; !strings.Contains(message, p.JobName+"-abcde") ||
+		!strings.Contains(message, "FailedScheduling") || entries[0].Level != logrus.WarnLevel {
+		t.Errorf("unexpected log entry: [ %s ] %s", entries[0].Level, message)
+	}
+}
+
+func TestWatchEventsIsDisabledByDefault(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	stop, err := newTestPlugin(Options{}).WatchEvents(context.Background(), clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stop()
+
+	if actions := clientSet.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got: %v", actions)
+	}
+}
@@ -0,0 +1,34 @@
+package plugin_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/banzaicloud/drone-plugin-k8s-client/plugin"
+	batchV1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func ExamplePlugin_Run() {
+	clientSet := fake.NewSimpleClientset()
+	// the fake API server doesn't run the jobs, the job succeeds as soon as it's created
+	clientSet.PrependReactor("create", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8sTesting.CreateAction).GetObject().(*batchV1.Job)
+		job.Status.Succeeded = 1
+		return false, nil, nil
+	})
+
+	p := plugin.New(plugin.Options{
+		JobName:       "example-1",
+		Image:         "alpine:3.20",
+		WorkspaceType: plugin.WorkspaceTypeEmptyDir,
+		Command:       []string{"echo", "hello"},
+		LabelSelector: map[string]string{plugin.Label: "example-1"},
+	})
+
+	err := p.Run(context.Background(), clientSet)
+	fmt.Println("error:", err)
+	// Output: error: <nil>
+}
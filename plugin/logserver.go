@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logServerShutdownTimeout the time the viewers get to receive the end of the logs when the log server stops
+const logServerShutdownTimeout = 5 * time.Second
+
+// logServer collects the streamed logs and serves them to the viewers tailing them over HTTP
+type logServer struct {
+	token string
+
+	lock sync.Mutex
+	logs []byte
+	// closed (and replaced) every time logs are written
+	updated chan struct{}
+	done    bool
+}
+
+func newLogServer(token string) *logServer {
+	return &logServer{
+		token:   token,
+		updated: make(chan struct{}),
+	}
+}
+
+func (s *logServer) Write(data []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.logs = append(s.logs, data...)
+	close(s.updated)
+	s.updated = make(chan struct{})
+	return len(data), nil
+}
+
+// finish ends the log streams of the viewers
+func (s *logServer) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.done {
+		s.done = true
+		close(s.updated)
+	}
+}
+
+// ServeHTTP writes the logs collected so far and follows the logs till the build finishes or the viewer disconnects
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		token := []byte("Bearer " + s.token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+
+	offset := 0
+	for {
+		s.lock.Lock()
+		logs := s.logs[offset:]
+		updated, done := s.updated, s.done
+		s.lock.Unlock()
+
+		if len(logs) > 0 {
+			if _, err := w.Write(logs); err != nil {
+				return
+			}
+			offset += len(logs)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if done {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// StartLogServer starts serving the streamed logs over HTTP if a log server address is configured; the returned function
+// stops the server (ending the streams of the viewers)
+// Without a token the server may only listen on the loopback interface
+func (p *Plugin) StartLogServer() (func(), error) {
+	if p.LogServerAddress == "" {
+		return func() {}, nil
+	}
+
+	if p.LogServerToken == "" && !loopbackAddress(p.LogServerAddress) {
+		return nil, fmt.Errorf("log server address [ %s ] is not a loopback one, a log server token is required",
+			p.LogServerAddress)
+	}
+
+	listener, err := net.Listen("tcp", p.LogServerAddress)
+	if err != nil {
+		logrus.Errorf("could not start the log server on [ %s ], error: %s", p.LogServerAddress, err)
+		return nil, err
+	}
+
+	p.logServer = newLogServer(p.LogServerToken)
+	mux := http.NewServeMux()
+	mux.Handle("/logs", p.logServer)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("log server failed, error: %s", err)
+		}
+	}()
+	logrus.Infof("serving the logs on: [ http://%s/logs ]", listener.Addr())
+
+	return func() {
+		p.logServer.finish()
+
+		ctx, cancel := context.WithTimeout(context.Background(), logServerShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.Debugf("could not shut down the log server gracefully, error: %s", err)
+		}
+	}, nil
+}
+
+// loopbackAddress checks whether the address to listen on is on the loopback interface
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
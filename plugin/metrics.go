@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/sirupsen/logrus"
+)
+
+// the job label of the metrics pushed to the Pushgateway
+const metricsJobName = "drone_plugin_k8s_client"
+
+// outcomes of the builds recorded in the metrics
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// pushMetrics pushes the duration and the outcome of the job to the Pushgateway (if set)
+// The metrics are grouped by the namespace and the repository, every build replaces the metrics of the previous one of
+// the repository (eg. the success rate is the rate of the successful builds over the total over time)
+func (p *Plugin) pushMetrics(err error) {
+	if p.MetricsPushGateway == "" {
+		return
+	}
+
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+	}
+
+	err = push.New(p.MetricsPushGateway, metricsJobName).
+		Gatherer(p.metricsRegistry(outcome)).
+		Grouping("namespace", p.Namespace).
+		Grouping("repo", p.metricsRepo()).
+		Push()
+	if err != nil {
+		logrus.Errorf("could not push the metrics to: [ %s ], error: %s", p.MetricsPushGateway, err)
+		return
+	}
+	logrus.Debugf("pushed the metrics to: [ %s ], outcome: [ %s ]", p.MetricsPushGateway, outcome)
+}
+
+// metricsRegistry collects the metrics of the build with the given outcome
+func (p *Plugin) metricsRegistry(outcome string) *prometheus.Registry {
+	duration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8s_client_job_duration_seconds",
+		Help: "The time from creating the job till it completed, by the outcome of the build.",
+	}, []string{"outcome"})
+	p.progress.lock.Lock()
+	if !p.progress.jobCreated.IsZero() && !p.progress.jobCompleted.IsZero() {
+		duration.WithLabelValues(outcome).Set(p.progress.jobCompleted.Sub(p.progress.jobCreated).Seconds())
+	}
+	p.progress.lock.Unlock()
+
+	total := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_client_job_total",
+		Help: "The builds run, by their outcome.",
+	}, []string{"outcome"})
+	// both outcomes are exposed, the one of the build is counted
+	total.WithLabelValues(outcomeSuccess)
+	total.WithLabelValues(outcomeFailure)
+	total.WithLabelValues(outcome).Inc()
+
+	completion := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_client_job_last_completion_timestamp_seconds",
+		Help: "The time the last build completed.",
+	})
+	completion.SetToCurrentTime()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(duration, total, completion)
+	return registry
+}
+
+// metricsRepo returns the repository of the build the metrics are grouped by
+func (p *Plugin) metricsRepo() string {
+	if repo := p.Env["DRONE_REPO"]; repo != "" {
+		return repo
+	}
+	if repo := p.Env["DRONE_REPO_NAME"]; repo != "" {
+		return repo
+	}
+	return "unknown"
+}
+
+// recordJobCreated records the moment the job got created
+func (p *Plugin) recordJobCreated(created time.Time) {
+	p.progress.lock.Lock()
+	defer p.progress.lock.Unlock()
+	p.progress.jobCreated = created
+}
+
+// recordJobCompleted records the moment the job completed (the first time only)
+func (p *Plugin) recordJobCompleted() {
+	p.progress.lock.Lock()
+	defer p.progress.lock.Unlock()
+	if p.progress.jobCompleted.IsZero() {
+		p.progress.jobCompleted = time.Now()
+	}
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricValue returns the value of the gauge or the counter with the given outcome label (if labeled) from the registry
+func metricValue(t *testing.T, registry *prometheus.Registry, name, outcome string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather the metrics: %s", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := metric.GetLabel()
+			if outcome == "" || len(labels) == 1 && labels[0].GetValue() == outcome {
+				if family.GetType() == dto.MetricType_COUNTER {
+					return metric.GetCounter().GetValue()
+				}
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	t.Fatalf("metric [ %s ] with outcome [ %s ] not found", name, outcome)
+	return 0
+}
+
+// testMetricsPlugin sets up a plugin whose job ran for a minute and a half
+func testMetricsPlugin() *Plugin {
+	p := newTestPlugin(Options{})
+	created := time.Now().Add(-time.Minute)
+	p.recordJobCreated(created)
+	p.progress.jobCompleted = created.Add(90 * time.Second)
+	return p
+}
+
+func TestMetricsOfSucceededBuild(t *testing.T) {
+	registry := testMetricsPlugin().metricsRegistry(outcomeSuccess)
+
+	if duration := metricValue(t, registry, "k8s_client_job_duration_seconds", outcomeSuccess); duration != 90 {
+		t.Errorf("expected the duration of 90s, got: %v", duration)
+	}
+	if succeeded := metricValue(t, registry, "k8s_client_job_total", outcomeSuccess); succeeded != 1 {
+		t.Errorf("expected 1 succeeded build, got: %v", succeeded)
+	}
+	if failed := metricValue(t, registry, "k8s_client_job_total", outcomeFailure); failed != 0 {
+		t.Errorf("expected no failed build, got: %v", failed)
+	}
+}
+
+func TestMetricsOfFailedBuild(t *testing.T) {
+	registry := testMetricsPlugin().metricsRegistry(outcomeFailure)
+
+	if duration := metricValue(t, registry, "k8s_client_job_duration_seconds", outcomeFailure); duration != 90 {
+		t.Errorf("expected the duration of 90s, got: %v", duration)
+	}
+	if succeeded := metricValue(t, registry, "k8s_client_job_total", outcomeSuccess); succeeded != 0 {
+		t.Errorf("expected no succeeded build, got: %v", succeeded)
+	}
+	if failed := metricValue(t, registry, "k8s_client_job_total", outcomeFailure); failed != 1 {
+		t.Errorf("expected 1 failed build, got: %v", failed)
+	}
+}
+
+func TestPushMetricsGroupsByTheRepository(t *testing.T) {
+	paths := make(chan string, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer gateway.Close()
+
+	p := testMetricsPlugin()
+	p.MetricsPushGateway = gateway.URL
+	p.Env = map[string]string{"DRONE_REPO": "octocat/hello-world"}
+	p.pushMetrics(errors.New("job failed"))
+
+	// the order of the grouping labels is not defined, values with slashes are base64 encoded
+	job := "/metrics/job/drone_plugin_k8s_client"
+	namespace := "/namespace/default"
+	repo := "/repo@base64/" + base64.RawURLEncoding.EncodeToString([]byte("octocat/hello-world"))
+	if path := <-paths; path != job+namespace+repo && path != job+repo+namespace {
+		t.Errorf("expected the metrics grouped by the namespace and the repository, got: [ %s ]", path)
+	}
+}
+
+func TestNoMetricsPushedWithoutGateway(t *testing.T) {
+	// no panic nor network access
+	testMetricsPlugin().pushMetrics(nil)
+}
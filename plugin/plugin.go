@@ -0,0 +1,2975 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	storageV1 "k8s.io/api/storage/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilErrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// HostPath represents a path of the node mounted into the container
+type HostPath struct {
+	Path      string
+	MountPath string
+	Type      *coreV1.HostPathType
+}
+
+// New creates a plugin running the job as set up by the options, every plugin has its own internal state (watchers, log
+// streams) so that multiple plugins can run side by side
+func New(opts Options) *Plugin {
+	if opts.GracePeriodSeconds == 0 {
+		opts.GracePeriodSeconds = defaultGracePeriodSeconds
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = defaultNamespace
+	}
+	if opts.ContainerName == "" {
+		opts.ContainerName = defaultContainerName
+	}
+	if opts.Workspace == "" {
+		opts.Workspace = defaultWorkspace
+	}
+	if opts.WorkspaceType == "" {
+		opts.WorkspaceType = WorkspaceTypePVC
+	}
+	if opts.Shell == "" {
+		opts.Shell = defaultShell
+	}
+
+	return &Plugin{
+		Options:    opts,
+		Wg:         &sync.WaitGroup{},
+		watchers:   watcherStatus{statuses: make(map[string]bool)},
+		logStreams: make(map[string]*logStream),
+	}
+}
+
+// CurrentJobName returns the name of the job, it's final once the job is created or attached
+func (p *Plugin) CurrentJobName() string {
+	p.jobNameLock.Lock()
+	defer p.jobNameLock.Unlock()
+	return p.JobName
+}
+
+// setJobName records the name of the created or attached job
+func (p *Plugin) setJobName(name string) {
+	p.jobNameLock.Lock()
+	defer p.jobNameLock.Unlock()
+	p.JobName = name
+}
+
+// logStream tracks streaming the logs of a pod, every pod gets its logs streamed once
+type logStream struct {
+	active bool
+	done   bool
+	// the moment the last stream of the pod ended, reconnecting streams only follow lines written after it
+	streamedUntil *metaV1.Time
+}
+
+// Options represents the settings of the job run by the plugin
+type Options struct {
+	JobName            string
+	ContainerName      string
+	GenerateName       bool
+	OnExists           string
+	AdoptExisting      bool
+	Namespace          string
+	Image              string
+	Workspace          string
+	MountPath          string
+	WorkspacePVC       string
+	WorkspaceType      string
+	WorkspaceReadOnly  bool
+	WorkspaceSizeLimit *resource.Quantity
+	// where the termination message of the job container is read from: the termination message file (File) or the last
+	// log lines if the file is empty (FallbackToLogsOnError)
+	TerminationMessagePolicy coreV1.TerminationMessagePolicy
+	// ephemeral storage request and limit of the job container
+	EphemeralStorageRequest *resource.Quantity
+	EphemeralStorageLimit   *resource.Quantity
+	ServiceAccount          string
+	ValidateServiceAccount  bool
+	AutomountToken          *bool
+	TokenAudience           string
+	TokenExpiration         time.Duration
+	TokenPath               string
+	Privileged              bool
+	CapAdd                  []coreV1.Capability
+	CapDrop                 []coreV1.Capability
+	OriginalCommands        []string
+	Command                 []string
+	Args                    []string
+	Shell                   string
+	LabelSelector           map[string]string
+	Env                     map[string]string
+	EnvAllowlist            []string
+	EnvDenylist             []string
+	LogTailLines            int64
+	LogSinceSeconds         int64
+	LogTimestamps           bool
+	Sysctls                 []coreV1.Sysctl
+	HostPaths               []HostPath
+	Ports                   []coreV1.ContainerPort
+	Sidecars                []coreV1.Container
+	Volumes                 []coreV1.Volume
+	VolumeMounts            []coreV1.VolumeMount
+	FieldEnvs               []coreV1.EnvVar
+	ResourceEnvs            []coreV1.EnvVar
+	FileEnvs                []coreV1.EnvVar
+	FSGroup                 *int64
+	FSGroupChangePolicy     *coreV1.PodFSGroupChangePolicy
+	StatusFile              string
+	OutputFile              string
+	ResultFile              string
+	Idempotent              bool
+	AllowedRegistries       []string
+	APIMaxRetries           int
+	CheckpointFile          string
+	CheckpointInterval      time.Duration
+	HeartbeatInterval       time.Duration
+	PreserveWorkspace       bool
+	VolumeSnapshotClass     string
+	CleanupConcurrency      int
+	ShowEvents              bool
+	ImagePullSecrets        []string
+	TrackImageDigest        bool
+	RunAsUser               *int64
+	RunAsGroup              *int64
+	ReadinessProbe          *coreV1.Probe
+	RestartPolicy           coreV1.RestartPolicy
+	Affinity                *coreV1.Affinity
+	TopologySpread          []coreV1.TopologySpreadConstraint
+	PriorityClass           string
+	RuntimeClass            string
+	DNSPolicy               coreV1.DNSPolicy
+	DNSNameservers          []string
+	SuccessPolicy           *v1.SuccessPolicy
+	Completions             int32
+	Parallelism             int32
+	LogServerAddress        string
+	LogServerToken          string
+	LogFile                 string
+	LogMaxRetries           int
+	SkipLogs                bool
+	DryRun                  bool
+	GracePeriodSeconds      int64
+	Timeout                 time.Duration
+	WaitPVCBound            bool
+	WaitPVCDelete           bool
+	OwnedWorkspace          bool
+	KeepOnFailure           bool
+	MetricsPushGateway      string
+	PVCBoundTimeout         time.Duration
+	PodStartTimeout         time.Duration
+	RedactKeys              []string
+	// used to take the snapshots of the workspace, optional
+	DynamicClient dynamic.Interface
+}
+
+// Plugin struct represents the data available for the plugin's logic.
+type Plugin struct {
+	Options
+	Wg *sync.WaitGroup
+
+	// the job and pod watchers running
+	watchers watcherStatus
+
+	// the log streams of the job pods by pod name
+	logStreams     map[string]*logStream
+	logStreamsLock sync.Mutex
+
+	// whether an already existing, identical job has been attached instead of creating a new one
+	attached bool
+
+	// guards the job name, it's changed once the job is created by a generated name or an existing one is attached
+	jobNameLock sync.Mutex
+
+	// the progress of the build written to the checkpoint file
+	progress progress
+	// the resources of the build logged once it's done
+	summary summary
+
+	// serves the streamed logs over HTTP if enabled
+	logServer *logServer
+	// the streamed logs are written to it as well if set
+	logFile *os.File
+
+	// the failure of a pod stopping the (current) job watcher
+	failure    error
+	jobWatcher watch.Interface
+	// the job watcher is closed by the server from time to time, it's re-established unless stopped for good
+	jobWatchStopped bool
+	// set once a pod of the job is seen
+	podObserved bool
+	// set only when the job is seen with succeeded pods
+	jobSucceeded bool
+	failureLock  sync.Mutex
+
+	// the last status reported to the status file
+	reportedStatus string
+	statusLock     sync.Mutex
+}
+
+const (
+	// the label selecting the resources of the build
+	Label = "label-name"
+
+	JobWatcherStatusKey = "job"
+	PodWatcherStatusKey = "pod"
+
+	pluginEnvPrefix = "PLUGIN_"
+	droneEnvPrefix  = "DRONE_"
+
+	// types of the workspace volume
+	WorkspaceTypePVC      = "pvc"
+	WorkspaceTypeEmptyDir = "emptydir"
+
+	// what to do if the job already exists
+	JobExistsFail    = "fail"
+	JobExistsAdopt   = "adopt"
+	JobExistsReplace = "replace"
+
+	// statuses of the job reported to the status file
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+
+	statusKey = "K8S_JOB_STATUS"
+
+	// the keys of the job reference written to the output file
+	jobNameKey      = "K8S_JOB_NAME"
+	jobNamespaceKey = "K8S_JOB_NAMESPACE"
+	jobUIDKey       = "K8S_JOB_UID"
+
+	// the length limit of the label values
+	maxLabelValueLength = 63
+
+	// the label holding the hash of the job specification
+	specHashLabel = "spec-hash"
+
+	// the registry of the images referenced without a registry
+	defaultRegistry = "docker.io"
+
+	// the annotation marking the default storage class
+	defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+	// the volume of the projected service account token
+	tokenVolumeName = "sa-token"
+
+	// the shortest validity of a projected service account token accepted by the API
+	minTokenExpiration = 10 * time.Minute
+
+	// the period before a resource (job, pvc) gets deleted
+	defaultGracePeriodSeconds = int64(2)
+
+	// the defaults of the options left unset, the same as the defaults of the flags
+	defaultNamespace     = "default"
+	defaultContainerName = "build"
+	defaultWorkspace     = "/drone/src"
+	defaultShell         = "sh"
+)
+
+var (
+	// the wait before the first retry of a failed API call, doubled for each further retry
+	retryInitialInterval = 500 * time.Millisecond
+
+	// how long to wait for the container to start when streaming its logs
+	logsAvailableTimeout = 2 * time.Minute
+
+	// the wait before reconnecting a dropped log stream
+	logsReconnectInterval = time.Second
+
+	// how long to wait for a terminating PVC to be deleted
+	pvcDeletedTimeout = 2 * time.Minute
+
+	// how long to wait for an existing job to be deleted when replacing it
+	jobDeletedTimeout = 2 * time.Minute
+
+	// how long cleaning up the resources of the build may take (after the plugin timed out as well)
+	cleanupTimeout = time.Minute
+
+	// the reasons of waiting containers the pod won't recover from by itself
+	stuckReasons = map[string]bool{
+		"ImagePullBackOff": true,
+		"ErrImagePull":     true,
+		"InvalidImageName": true,
+		"CrashLoopBackOff": true,
+	}
+
+	// maps the phases of the job pod to the reported statuses
+	podPhaseStatus = map[coreV1.PodPhase]string{
+		coreV1.PodPending:   StatusPending,
+		coreV1.PodRunning:   StatusRunning,
+		coreV1.PodSucceeded: StatusSuccess,
+		coreV1.PodFailed:    StatusFailure,
+	}
+
+	// the labels of the job holding the build metadata, mapped to the Drone env vars they're set from
+	droneLabels = map[string]string{
+		"drone.io/repo":   "DRONE_REPO_NAME",
+		"drone.io/owner":  "DRONE_REPO_OWNER",
+		"drone.io/build":  "DRONE_BUILD_NUMBER",
+		"drone.io/branch": "DRONE_BRANCH",
+		"drone.io/event":  "DRONE_BUILD_EVENT",
+		"drone.io/commit": "DRONE_COMMIT_SHA",
+	}
+
+	// the shell running the original commands is looked up on the PATH of the image
+	shellName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+	// the runs of characters not allowed in label values
+	invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// watcherStatus tracks which watchers are running, it's safe for concurrent use
+type watcherStatus struct {
+	lock     sync.Mutex
+	statuses map[string]bool
+}
+
+func (w *watcherStatus) on(watcherStatusKey string) {
+	logrus.Debugf("Switching on logging status for: [ %s ]", watcherStatusKey)
+	w.set(watcherStatusKey, true)
+}
+
+func (w *watcherStatus) off(watcherStatusKey string) {
+	logrus.Debugf("Switching off logging status for: [ %s ]", watcherStatusKey)
+	w.set(watcherStatusKey, false)
+}
+
+func (w *watcherStatus) set(watcherStatusKey string, status bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.statuses[watcherStatusKey] = status
+}
+
+func (w *watcherStatus) watching(watcherStatusKey string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.statuses[watcherStatusKey]
+}
+
+func (p *Plugin) handleJobEvent(ctx context.Context, event watch.Event, watcher watch.Interface, clientSet kubernetes.Interface) error {
+
+	payloadType := reflect.TypeOf(event.Object)
+	if event.Type == watch.Error {
+		// the payload is a status in this case
+		logrus.Debugf("job in error, status: [ %v ]", apiErrors.FromObject(event.Object))
+		return nil
+	}
+
+	payload := reflect.ValueOf(event.Object).Interface().(*v1.Job)
+	logrus.Debugf("received JOB event with payload type [ %v ]", payloadType)
+
+	switch event.Type {
+	case watch.Added:
+		logrus.Debugf("job added; name: [ %s ], status: [ %s ], ", payload.GetName(), payload.Status.String())
+
+		if p.jobCompleted(payload) {
+			// an attached job may already be completed
+			return p.handleJobCompletion(ctx, payload, watcher, clientSet)
+		}
+
+		// an attached job may be running already and not change till it completes, its pods are watched right away
+		return p.startPodWatch(ctx, clientSet)
+	case watch.Modified:
+		logrus.Debugf("job modified, status: %s", payload.Status.String())
+
+		if p.jobCompleted(payload) {
+			return p.handleJobCompletion(ctx, payload, watcher, clientSet)
+		}
+
+		return p.startPodWatch(ctx, clientSet)
+	case watch.Deleted:
+		logrus.Debugf("job deleted; name: [ %s ]", payload.GetName())
+		logrus.Debugf("closing the job watcher")
+		p.stopJobWatch(watcher)
+	default:
+		logrus.Debugf("received (unhandled) event of type: [ %v ]", payloadType)
+	}
+
+	return nil
+
+}
+
+// startPodWatch starts watching the pods of the job (streaming their logs) unless they are watched already
+func (p *Plugin) startPodWatch(ctx context.Context, clientSet kubernetes.Interface) error {
+	if p.watchers.watching(PodWatcherStatusKey) {
+		logrus.Debugf("pod is already being watched")
+		return nil
+	}
+
+	podWatcher, err := p.WatchPod(ctx, clientSet)
+	if err != nil {
+		logrus.Errorf("could not watch pod")
+		return err
+	}
+
+	// new goroutine as it blocks
+	go func() {
+		if err := p.PodEvents(ctx, podWatcher, clientSet); err != nil {
+			logrus.Errorf("pod failed. err: %s", err)
+			p.abort(err)
+		}
+	}()
+	return nil
+}
+
+// jobCompleted checks whether the job is completed
+// Jobs with a success policy may tolerate failed pods, their completion is signaled by the job conditions
+func (p *Plugin) jobCompleted(job *v1.Job) bool {
+	if p.SuccessPolicy == nil {
+		// the job may be terminated without failed pods (eg. by its active deadline)
+		return job.Status.Failed > 0 || job.Status.Succeeded >= p.completions() || jobCondition(job, v1.JobFailed)
+	}
+	return jobCondition(job, v1.JobSuccessCriteriaMet) || jobCondition(job, v1.JobComplete) || jobCondition(job, v1.JobFailed)
+}
+
+// completions returns the number of pods that need to succeed for the job to succeed
+func (p *Plugin) completions() int32 {
+	if p.Completions > 0 {
+		return p.Completions
+	}
+	return 1
+}
+
+// jobFailed checks whether the (completed) job failed
+func (p *Plugin) jobFailed(job *v1.Job) bool {
+	if p.SuccessPolicy == nil {
+		return job.Status.Failed > 0 || jobCondition(job, v1.JobFailed)
+	}
+	return jobCondition(job, v1.JobFailed)
+}
+
+// jobCondition checks whether the job has the given condition
+func jobCondition(job *v1.Job, conditionType v1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == coreV1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionDetails describes the terminal conditions of the job (type, reason and message), eg. to tell a job killed by
+// its deadline (DeadlineExceeded) from one with failing pods (BackoffLimitExceeded)
+func conditionDetails(job *v1.Job) string {
+	details := make([]string, 0)
+	for _, condition := range job.Status.Conditions {
+		terminal := condition.Type == v1.JobComplete || condition.Type == v1.JobFailed
+		if terminal && condition.Status == coreV1.ConditionTrue {
+			details = append(details, fmt.Sprintf("job condition [ %s ], reason: [ %s ], message: [ %s ]",
+				condition.Type, condition.Reason, condition.Message))
+		}
+	}
+	return strings.Join(details, "; ")
+}
+
+// handleJobCompletion stops watching the completed job, the returned error signals the failure of the job
+func (p *Plugin) handleJobCompletion(ctx context.Context, job *v1.Job, watcher watch.Interface, clientSet kubernetes.Interface) error {
+	p.recordJobCompleted()
+
+	conditions := conditionDetails(job)
+	if conditions != "" {
+		logrus.Infof("job [ %s ] completed; %s", job.GetName(), conditions)
+	}
+
+	if p.jobFailed(job) {
+		p.stopJobWatch(watcher)
+		p.printCompletedLogs(ctx, clientSet)
+		p.reportStatus(StatusFailure)
+
+		message := fmt.Sprintf("there are [ %d ] failed pods", job.Status.Failed)
+		if conditions != "" {
+			message = fmt.Sprintf("%s; %s", message, conditions)
+		}
+		if details := p.terminationDetails(ctx, clientSet); details != "" {
+			message = fmt.Sprintf("%s; %s", message, details)
+		}
+		return errors.New(message)
+	}
+
+	if p.SuccessPolicy != nil {
+		logrus.Infof("job succeeded by its success policy; succeeded indexes: [ %s ], failed pods: [ %d ]",
+			job.Status.CompletedIndexes, job.Status.Failed)
+	}
+
+	if job.Status.Succeeded > 0 {
+		p.failureLock.Lock()
+		p.jobSucceeded = true
+		p.failureLock.Unlock()
+	}
+
+	// watcher stopped + nil == app is quitting
+	p.stopJobWatch(watcher)
+	p.printCompletedLogs(ctx, clientSet)
+	p.reportStatus(StatusSuccess)
+	return nil
+
+}
+
+// terminationDetails describes how the failed containers of the job pods terminated (exit code, reason and message)
+func (p *Plugin) terminationDetails(ctx context.Context, clientSet kubernetes.Interface) string {
+	var pods *coreV1.PodList
+	err := p.withRetry("listing the job pods", func() error {
+		var err error
+		pods, err = clientSet.CoreV1().Pods(p.Namespace).List(ctx, metaV1.ListOptions{LabelSelector: p.selector()})
+		return err
+	})
+	if err != nil {
+		logrus.Debugf("could not list the job pods. error: %s", err)
+		return ""
+	}
+
+	details := make([]string, 0)
+	for _, pod := range pods.Items {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			terminated := status.State.Terminated
+			if terminated == nil {
+				// restarted containers
+				terminated = status.LastTerminationState.Terminated
+			}
+
+			if terminated != nil && terminated.ExitCode != 0 {
+				details = append(details, fmt.Sprintf("container [ %s ] of pod [ %s ] exited with code [ %d ], reason: [ %s ], message: [ %s ]",
+					status.Name, pod.GetName(), terminated.ExitCode, terminated.Reason, strings.TrimSpace(terminated.Message)))
+			}
+		}
+	}
+	return strings.Join(details, "; ")
+}
+
+// handlePodEvent handles the events of the job pod, the returned error signals that the pod is stuck
+func (p *Plugin) handlePodEvent(ctx context.Context, event watch.Event, watcher watch.Interface, clientSet kubernetes.Interface) error {
+
+	if event.Type == watch.Error {
+		// the payload is a status in this case
+		logrus.Debugf("pod in error, status: [ %v ]", apiErrors.FromObject(event.Object))
+		return nil
+	}
+
+	payload := reflect.ValueOf(event.Object).Interface().(*coreV1.Pod)
+
+	switch event.Type {
+	case watch.Added:
+		logrus.Debugf("pod [ %s ] added, phase: [ %s ]", payload.GetName(), payload.Status.Phase)
+		p.failureLock.Lock()
+		p.podObserved = true
+		p.failureLock.Unlock()
+		p.recordPod(payload.GetName())
+		p.reportStatus(podPhaseStatus[payload.Status.Phase])
+		p.recordExitCode(payload)
+
+		if err := p.podStuck(payload); err != nil {
+			watcher.Stop()
+			p.watchers.off(PodWatcherStatusKey)
+			return err
+		}
+
+		// the pod may be running already (eg. when the watch is re-established)
+		p.streamStartedPod(ctx, payload, clientSet)
+	case watch.Modified:
+		logrus.Debugf("pod [ %s ] modified, phase: [ %s ]", payload.GetName(), payload.Status.Phase)
+		p.recordPod(payload.GetName())
+		p.reportStatus(podPhaseStatus[payload.Status.Phase])
+		p.recordExitCode(payload)
+
+		if err := p.podStuck(payload); err != nil {
+			watcher.Stop()
+			p.watchers.off(PodWatcherStatusKey)
+			return err
+		}
+
+		p.streamStartedPod(ctx, payload, clientSet)
+	case watch.Deleted:
+		logrus.Debugf("pod [ %s] deleted", payload.GetName())
+		p.recordDeleted("pod", payload.GetName())
+		logrus.Debugf("closing the pod watcher")
+		watcher.Stop()
+		p.watchers.off(PodWatcherStatusKey)
+	default:
+		logrus.Debugf("received (unhandled) event of type: [ %s ]", event.Type)
+	}
+
+	return nil
+
+}
+
+// streamStartedPod starts streaming the logs of the pod once it started, unless its logs are streamed already
+func (p *Plugin) streamStartedPod(ctx context.Context, pod *coreV1.Pod, clientSet kubernetes.Interface) {
+	if p.SkipLogs {
+		return
+	}
+
+	if !podStarted(pod) {
+		// the logs of the containers aren't available yet
+		logrus.Debugf("pod [ %s ] not started yet", pod.GetName())
+		return
+	}
+
+	if !p.startLogStream(pod.GetName()) {
+		logrus.Debugf("logs of pod [ %s ] already being watched", pod.GetName())
+		return
+	}
+
+	// new thread not to block here
+	go p.StreamLogs(ctx, pod, clientSet)
+}
+
+// podStarted checks whether the pod is running (or done) or any of its containers started already (eg. an init container
+// of a pending pod)
+func podStarted(pod *coreV1.Pod) bool {
+	switch pod.Status.Phase {
+	case coreV1.PodRunning, coreV1.PodSucceeded, coreV1.PodFailed:
+		return true
+	}
+
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if status.State.Running != nil || status.State.Terminated != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// podStuck checks whether a container of the pod is waiting for a reason it won't recover from by itself (eg. the image
+// can't be pulled), returns the error describing the reason if so
+// Containers restarted in place (OnFailure restart policy) back off between the restarts, it's bounded by the backoff
+// limit of the job
+func (p *Plugin) podStuck(pod *coreV1.Pod) error {
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if status.State.Waiting == nil {
+			continue
+		}
+
+		reason := status.State.Waiting.Reason
+		if reason == "CrashLoopBackOff" && p.RestartPolicy == coreV1.RestartPolicyOnFailure {
+			logrus.Infof("container [ %s ] of pod [ %s ] failed, restarting", status.Name, pod.GetName())
+			continue
+		}
+
+		if stuckReasons[reason] {
+			return fmt.Errorf("container [ %s ] of pod [ %s ] is stuck: [ %s ] %s", status.Name, pod.GetName(),
+				status.State.Waiting.Reason, status.State.Waiting.Message)
+		}
+	}
+	return nil
+}
+
+// abort records the failure of a pod and stops watching the job, the failure is returned by JobEvents
+func (p *Plugin) abort(err error) {
+	p.failureLock.Lock()
+	p.failure = err
+	jobWatcher := p.jobWatcher
+	p.jobWatchStopped = true
+	p.failureLock.Unlock()
+
+	p.reportStatus(StatusFailure)
+	if jobWatcher != nil {
+		jobWatcher.Stop()
+	}
+}
+
+// StartPodDeadline fails the build if the job doesn't create a pod in time (eg. the quota of the namespace is exhausted),
+// the returned function stops the deadline
+// Attached jobs are left alone, they belong to another run of the plugin (which would be aborted otherwise)
+func (p *Plugin) StartPodDeadline(ctx context.Context, clientSet kubernetes.Interface) func() {
+	if p.PodStartTimeout <= 0 || p.attached {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(p.PodStartTimeout, func() {
+		if p.podsExist(ctx, clientSet) {
+			return
+		}
+		p.abort(fmt.Errorf("no pod started for job [ %s ] within [ %s ]", p.CurrentJobName(), p.PodStartTimeout))
+	})
+
+	return func() {
+		timer.Stop()
+	}
+}
+
+// podsExist checks whether a pod of the job has been seen, the pods are listed as well in case the pod watch is lagging
+func (p *Plugin) podsExist(ctx context.Context, clientSet kubernetes.Interface) bool {
+	p.failureLock.Lock()
+	observed := p.podObserved
+	p.failureLock.Unlock()
+	if observed {
+		return true
+	}
+
+	var pods *coreV1.PodList
+	err := p.withRetry("listing the job pods", func() error {
+		var err error
+		pods, err = clientSet.CoreV1().Pods(p.Namespace).List(ctx, metaV1.ListOptions{LabelSelector: p.selector()})
+		return err
+	})
+	if err != nil {
+		// the deadline isn't enforced on a guess
+		logrus.Warnf("could not list the pods of job [ %s ]. error: %s", p.CurrentJobName(), err)
+		return true
+	}
+	return len(pods.Items) > 0
+}
+
+// stopJobWatch stops watching the job for good (the watch is not re-established)
+func (p *Plugin) stopJobWatch(watcher watch.Interface) {
+	p.failureLock.Lock()
+	p.jobWatchStopped = true
+	p.failureLock.Unlock()
+
+	watcher.Stop()
+}
+
+// jobWatchIsStopped checks whether watching the job has been stopped for good
+func (p *Plugin) jobWatchIsStopped() bool {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	return p.jobWatchStopped
+}
+
+// watchingJob records the job watcher in use (it changes when the watch is restarted)
+func (p *Plugin) watchingJob(jobWatcher watch.Interface) {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	p.jobWatcher = jobWatcher
+}
+
+func (p *Plugin) failureError() error {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	return p.failure
+}
+
+// withRetry runs the API call, retrying it with exponential backoff as long as it fails with transient errors
+func (p *Plugin) withRetry(operation string, apiCall func() error) error {
+	backoff := wait.Backoff{
+		Duration: retryInitialInterval,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    p.APIMaxRetries + 1,
+	}
+	if backoff.Steps < 1 {
+		backoff.Steps = 1
+	}
+
+	var lastErr error
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		lastErr = apiCall()
+		if lastErr == nil {
+			return true, nil
+		}
+
+		if !transientError(lastErr) {
+			return false, lastErr
+		}
+
+		logrus.Warnf("%s failed with a transient error. error: %s", operation, lastErr)
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		// out of retries
+		return lastErr
+	}
+	return err
+}
+
+// transientError checks whether the API server failed with an error that's worth retrying
+func transientError(err error) bool {
+	return apiErrors.IsTooManyRequests(err) || apiErrors.IsServerTimeout(err) || apiErrors.IsTimeout(err) ||
+		apiErrors.IsInternalError(err) || apiErrors.IsServiceUnavailable(err) || apiErrors.IsUnexpectedServerError(err)
+}
+
+// Run runs the job: creates its resources, streams its logs till it completes and cleans up after it
+// The returned error signals the failure of the job (or of running it); cancelling the context stops watching the job
+// and streaming its logs
+func (p *Plugin) Run(ctx context.Context, clientSet kubernetes.Interface) error {
+	err := p.run(ctx, clientSet)
+	if p.DryRun {
+		// nothing is run, there is nothing to report
+		return err
+	}
+	p.pushMetrics(err)
+	p.writeResult(err)
+	p.logSummary()
+	return err
+}
+
+func (p *Plugin) run(ctx context.Context, clientSet kubernetes.Interface) error {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	if err := p.Validate(); err != nil {
+		logrus.Errorf("invalid configuration. err: %s", err)
+		return err
+	}
+
+	stopCheckpoints := p.StartCheckpoints()
+	defer stopCheckpoints()
+
+	stopLogServer, err := p.StartLogServer()
+	if err != nil {
+		return err
+	}
+	defer stopLogServer()
+
+	closeLogFile, err := p.OpenLogFile()
+	if err != nil {
+		return err
+	}
+	defer closeLogFile()
+
+	if p.AdoptExisting {
+		// the job is created elsewhere, it's only watched
+		return p.watchToCompletion(ctx, clientSet)
+	}
+
+	err = p.CheckImageRegistry()
+	if err != nil {
+		logrus.Errorf("image not allowed. err [ %s ]", err)
+		return err
+	}
+
+	if p.ValidateServiceAccount {
+		if err := p.CheckServiceAccount(ctx, clientSet); err != nil {
+			logrus.Errorf("service account not usable. err [ %s ]", err)
+			return err
+		}
+	}
+
+	if p.WorkspaceType == WorkspaceTypePVC {
+		claim, err := p.CreateOrGetPVC(ctx, clientSet)
+		if err != nil {
+			logrus.Errorf("could not create PVC. err [ %s ]", err)
+			return err
+		}
+
+		if p.WaitPVCBound && !p.DryRun {
+			if err := p.WaitForPVCBound(ctx, claim, clientSet); err != nil {
+				logrus.Errorf("PVC not bound. err [ %s ]", err)
+				return err
+			}
+		}
+	}
+
+	if p.DryRun {
+		// nothing is created, so there is nothing to watch
+		return p.CreateJob(ctx, clientSet)
+	}
+
+	return p.watchToCompletion(ctx, clientSet)
+}
+
+// watchToCompletion creates (or adopts) the job and watches it till it completes, then cleans up
+func (p *Plugin) watchToCompletion(ctx context.Context, clientSet kubernetes.Interface) error {
+	jobWatcher, resourceVersion, err := p.WatchJob(ctx, clientSet)
+	if err != nil {
+		logrus.Errorf("could not watch jobs. err [ %s ]", err)
+		return err
+	}
+
+	if p.AdoptExisting {
+		err = p.adoptJob(ctx, p.CurrentJobName(), clientSet)
+	} else {
+		err = p.CreateJob(ctx, clientSet)
+	}
+	if err != nil {
+		jobWatcher.Stop()
+		return err
+	}
+
+	if p.attached {
+		// the watcher needs to select the attached job, watched from the most recent state so that the job is received
+		// (as added) even if it doesn't change anymore
+		jobWatcher.Stop()
+		resourceVersion = ""
+		jobWatcher, err = p.watchJob(ctx, resourceVersion, clientSet)
+		if err != nil {
+			logrus.Errorf("could not watch the attached job. err [ %s ]", err)
+			return err
+		}
+	}
+
+	stopEvents, err := p.WatchEvents(ctx, clientSet)
+	if err != nil {
+		jobWatcher.Stop()
+		return err
+	}
+	defer stopEvents()
+
+	stopHeartbeat := p.StartHeartbeat()
+	stopPodDeadline := p.StartPodDeadline(ctx, clientSet)
+	err = p.JobEvents(ctx, jobWatcher, resourceVersion, clientSet)
+	stopPodDeadline()
+	stopHeartbeat()
+
+	// the context may be done already, the cleanup gets a context of its own
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	if err != nil {
+		logrus.Errorf("error encountered: %s", err)
+		p.SnapshotWorkspace(cleanupCtx, clientSet)
+		p.cleanupAfterFailure(cleanupCtx, err, clientSet)
+		return err
+	}
+
+	if err := p.waitForLogs(ctx); err != nil {
+		p.SnapshotWorkspace(cleanupCtx, clientSet)
+		p.cleanupAfterFailure(cleanupCtx, err, clientSet)
+		return err
+	}
+
+	err = p.Cleanup(cleanupCtx, clientSet)
+	if err != nil {
+		logrus.Errorf("could not clean up. err: %s", err)
+	}
+
+	return nil
+
+}
+
+// waitForLogs waits for the log streams to end, the wait is bounded by the context
+func (p *Plugin) waitForLogs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.Wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		logrus.Errorf("gave up waiting for the logs to be streamed. err: %s", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// cleanupAfterFailure deletes the resources of the failed build (a timed out job would keep running otherwise), unless
+// they are kept for debugging
+func (p *Plugin) cleanupAfterFailure(ctx context.Context, failure error, clientSet kubernetes.Interface) {
+	if errors.Is(failure, context.DeadlineExceeded) {
+		logrus.Errorf("the plugin timed out after [ %s ]", p.Timeout)
+	}
+
+	if p.KeepOnFailure {
+		logrus.Infof("keeping the job: [ %s ] of the failed build", p.CurrentJobName())
+		return
+	}
+
+	if err := p.Cleanup(ctx, clientSet); err != nil {
+		logrus.Errorf("could not clean up. err: %s", err)
+	}
+}
+
+// Validate checks that the required values are set, all the missing values are reported at once
+func (p *Plugin) Validate() error {
+	var errs []error
+	if p.Image == "" && !p.AdoptExisting {
+		errs = append(errs, errors.New("the image is missing (plugin.original.image)"))
+	}
+
+	if p.Namespace == "" {
+		errs = append(errs, errors.New("the namespace is missing (plugin.job.namespace)"))
+	}
+
+	if p.TokenAudience != "" {
+		if p.TokenExpiration < minTokenExpiration {
+			errs = append(errs, fmt.Errorf("the service account token must be valid for at least %s (plugin.job.sa.token.expiration)",
+				minTokenExpiration))
+		}
+		if !path.IsAbs(p.TokenPath) {
+			errs = append(errs, fmt.Errorf("the service account token path must be absolute: [ %s ] (plugin.job.sa.token.path)",
+				p.TokenPath))
+		}
+	}
+
+	if p.Shell != "" && !shellName.MatchString(p.Shell) {
+		errs = append(errs, fmt.Errorf("invalid shell: [ %s ], it must be the name of an executable (plugin.job.shell)", p.Shell))
+	}
+
+	if msgs := validation.IsDNS1123Label(p.ContainerName); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("invalid container name: [ %s ], %s (plugin.job.container.name)",
+			p.ContainerName, strings.Join(msgs, ", ")))
+	}
+
+	if p.Completions < 0 || p.Parallelism < 0 {
+		errs = append(errs, errors.New("the completions and the parallelism can't be negative"))
+	}
+
+	if p.RestartPolicy != "" && p.RestartPolicy != coreV1.RestartPolicyNever &&
+		p.RestartPolicy != coreV1.RestartPolicyOnFailure {
+		errs = append(errs, fmt.Errorf("unsupported restart policy: [ %s ], jobs support Never or OnFailure "+
+			"(plugin.job.restart.policy)", p.RestartPolicy))
+	}
+
+	if p.DryRun && p.AdoptExisting {
+		errs = append(errs, errors.New("an adopted job can't be dry run (plugin.dry.run)"))
+	}
+
+	switch p.OnExists {
+	case "", JobExistsFail, JobExistsAdopt, JobExistsReplace:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported mode: [ %s ], fail, adopt or replace expected (plugin.job.on.exists)",
+			p.OnExists))
+	}
+
+	for _, constraint := range p.TopologySpread {
+		if constraint.MaxSkew < 1 || constraint.TopologyKey == "" ||
+			(constraint.WhenUnsatisfiable != coreV1.DoNotSchedule && constraint.WhenUnsatisfiable != coreV1.ScheduleAnyway) {
+			errs = append(errs, fmt.Errorf("invalid topology spread constraint: a positive maxSkew, a topologyKey and "+
+				"DoNotSchedule or ScheduleAnyway are required, got: %s (plugin.job.topology.spread)", constraint.String()))
+		}
+	}
+
+	switch p.TerminationMessagePolicy {
+	case "", coreV1.TerminationMessageReadFile, coreV1.TerminationMessageFallbackToLogsOnError:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported termination message policy: [ %s ], File or FallbackToLogsOnError "+
+			"expected (plugin.job.termination.message.policy)", p.TerminationMessagePolicy))
+	}
+
+	switch p.DNSPolicy {
+	case "", coreV1.DNSClusterFirst, coreV1.DNSClusterFirstWithHostNet, coreV1.DNSDefault:
+	case coreV1.DNSNone:
+		if len(p.DNSNameservers) == 0 {
+			errs = append(errs, errors.New("the None DNS policy requires nameservers (plugin.job.dns.nameservers)"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported DNS policy: [ %s ] (plugin.job.dns.policy)", p.DNSPolicy))
+	}
+
+	if p.WorkspaceType != WorkspaceTypePVC && p.WorkspaceType != WorkspaceTypeEmptyDir {
+		errs = append(errs, fmt.Errorf("unsupported workspace type: [ %s ] (plugin.job.workspace.type)", p.WorkspaceType))
+	}
+
+	if _, err := p.validatedSelector(); err != nil {
+		errs = append(errs, err)
+	}
+
+	sidecarNames := map[string]bool{p.ContainerName: true}
+	for _, sidecar := range p.Sidecars {
+		if sidecar.Name == "" || sidecar.Image == "" {
+			errs = append(errs, errors.New("the sidecars need a name and an image (plugin.job.sidecars)"))
+			continue
+		}
+		if sidecarNames[sidecar.Name] {
+			errs = append(errs, fmt.Errorf("duplicate container name: [ %s ] (plugin.job.sidecars)", sidecar.Name))
+		}
+		sidecarNames[sidecar.Name] = true
+	}
+
+	// the extra mounts may reference the extra volumes and the volumes set up by the plugin
+	volumeNames := map[string]bool{p.ContainerName: true}
+	for i := range p.HostPaths {
+		volumeNames[fmt.Sprintf("host-path-%d", i)] = true
+	}
+	if p.TokenAudience != "" {
+		volumeNames[tokenVolumeName] = true
+	}
+	for _, volume := range p.Volumes {
+		if volumeNames[volume.Name] {
+			errs = append(errs, fmt.Errorf("duplicate volume name: [ %s ] (plugin.job.volumes)", volume.Name))
+		}
+		volumeNames[volume.Name] = true
+	}
+	for _, mount := range p.VolumeMounts {
+		if !volumeNames[mount.Name] {
+			errs = append(errs, fmt.Errorf("volume mount [ %s ] references an undeclared volume (plugin.job.volume.mounts)", mount.Name))
+		}
+	}
+
+	if (p.EphemeralStorageRequest != nil && p.EphemeralStorageRequest.Sign() < 0) ||
+		(p.EphemeralStorageLimit != nil && p.EphemeralStorageLimit.Sign() < 0) {
+		errs = append(errs, errors.New("the ephemeral storage request and limit can't be negative"))
+	}
+
+	if p.EphemeralStorageRequest != nil && p.EphemeralStorageLimit != nil &&
+		p.EphemeralStorageRequest.Cmp(*p.EphemeralStorageLimit) > 0 {
+		errs = append(errs, fmt.Errorf("the ephemeral storage request [ %s ] exceeds the limit [ %s ]",
+			p.EphemeralStorageRequest, p.EphemeralStorageLimit))
+	}
+
+	return utilErrors.NewAggregate(errs)
+}
+
+// CheckServiceAccount verifies that the service account of the job exists, otherwise the job pod wouldn't be created
+func (p *Plugin) CheckServiceAccount(ctx context.Context, clientSet kubernetes.Interface) error {
+	if p.ServiceAccount == "" {
+		return nil
+	}
+
+	if p.DryRun {
+		logrus.Infof("dry run, the service account [ %s ] is not checked", p.ServiceAccount)
+		return nil
+	}
+
+	err := p.withRetry("getting the service account", func() error {
+		_, err := clientSet.CoreV1().ServiceAccounts(p.Namespace).Get(ctx, p.ServiceAccount, metaV1.GetOptions{})
+		return err
+	})
+	if apiErrors.IsNotFound(err) {
+		return fmt.Errorf("service account [ %s ] doesn't exist in namespace [ %s ] (plugin.proxy.service.account)",
+			p.ServiceAccount, p.Namespace)
+	}
+	return err
+}
+
+// CheckImageRegistry verifies that the image to be run comes from one of the allowed registries (if any is configured)
+func (p *Plugin) CheckImageRegistry() error {
+	if len(p.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	image := normalizeImage(p.Image)
+	for _, allowed := range p.AllowedRegistries {
+		allowed = normalizeRegistry(strings.TrimSuffix(allowed, "/"))
+		if image == allowed || strings.HasPrefix(image, allowed+"/") {
+			logrus.Debugf("image [ %s ] allowed by: [ %s ]", image, allowed)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("image [ %s ] is not from an allowed registry %v", p.Image, p.AllowedRegistries)
+}
+
+// normalizeImage expands the image reference to its fully qualified form (eg. bash -> docker.io/library/bash)
+func normalizeImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	registry, repository := defaultRegistry, image
+	// the first component is a registry only if it looks like a host
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, repository = normalizeRegistry(parts[0]), parts[1]
+	}
+
+	if registry == defaultRegistry && !strings.Contains(repository, "/") {
+		// official images
+		repository = "library/" + repository
+	}
+	return registry + "/" + repository
+}
+
+// normalizeRegistry maps the aliases of the default registry to the default registry
+func normalizeRegistry(registry string) string {
+	for _, alias := range []string{"index.docker.io", "registry-1.docker.io"} {
+		if registry == alias || strings.HasPrefix(registry, alias+"/") {
+			return defaultRegistry + strings.TrimPrefix(registry, alias)
+		}
+	}
+	return registry
+}
+
+// CreateJob creates and launches a Job resource on the k8s cluster
+func (p *Plugin) CreateJob(ctx context.Context, clientSet kubernetes.Interface) error {
+	jobToRun, err := p.assembleJob()
+	if err != nil {
+		logrus.Errorf("could not set up job. error: %s", err)
+		return err
+	}
+
+	jobToRun, err = p.DecorateJob(jobToRun)
+	if err != nil {
+		logrus.Errorf("could not decorate job. error: %s", err)
+		return err
+	}
+
+	hash, err := p.specHash(jobToRun)
+	if err != nil {
+		logrus.Errorf("could not compute the job spec hash. error: %s", err)
+		return err
+	}
+
+	if p.DryRun {
+		jobToRun.Labels = withSpecHash(jobToRun.Labels, hash)
+		return printResource(jobToRun, v1.SchemeGroupVersion.WithKind("Job"))
+	}
+
+	if p.TrackImageDigest {
+		// not part of the spec hash, the digest may change between identical jobs
+		p.trackImageDigest(ctx, jobToRun, clientSet)
+	}
+
+	if p.Idempotent {
+		identicalJob, err := p.findJob(ctx, hash, clientSet)
+		if err != nil {
+			logrus.Errorf("could not look up identical jobs. error: %s", err)
+			return err
+		}
+
+		if identicalJob != nil {
+			p.attachJob(identicalJob)
+			return nil
+		}
+	}
+
+	if jobToRun.Spec.SuccessPolicy != nil && !p.supportsSuccessPolicy(ctx, clientSet) {
+		logrus.Warnf("the cluster doesn't support job success policies (1.31+), the success policy is ignored")
+		jobToRun.Spec.SuccessPolicy = nil
+	}
+
+	jobToRun.Labels = withSpecHash(jobToRun.Labels, hash)
+
+	var job *v1.Job
+	err = p.withRetry("creating the job", func() error {
+		job, err = clientSet.BatchV1().Jobs(p.Namespace).Create(ctx, jobToRun, metaV1.CreateOptions{})
+		return err
+	})
+	if apiErrors.IsAlreadyExists(err) {
+		// eg. the plugin is retried after a partial failure
+		switch p.OnExists {
+		case JobExistsAdopt:
+			return p.adoptJob(ctx, jobToRun.GetName(), clientSet)
+		case JobExistsReplace:
+			job, err = p.replaceJob(ctx, jobToRun, clientSet)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("could not create job. error: %s", err)
+		return err
+	}
+
+	logrus.Debugf("created job: [ %s ]", job.GetName())
+	if p.GenerateName {
+		// the job is referred to by the name generated by the API server from now on (eg. by the cleanup)
+		p.setJobName(job.GetName())
+	}
+	p.recordJobCreated(time.Now())
+	p.reportStatus(StatusPending)
+	p.writeOutput(job)
+
+	if p.OwnedWorkspace && p.WorkspaceType == WorkspaceTypePVC {
+		p.ownWorkspace(ctx, job, clientSet)
+	}
+	return nil
+}
+
+// adoptJob attaches to the existing job of the same name instead of creating one
+func (p *Plugin) adoptJob(ctx context.Context, name string, clientSet kubernetes.Interface) error {
+	var existing *v1.Job
+	err := p.withRetry("getting the existing job", func() error {
+		var err error
+		existing, err = clientSet.BatchV1().Jobs(p.Namespace).Get(ctx, name, metaV1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not get the existing job: [ %s ]. error: %s", name, err)
+		return err
+	}
+
+	p.attachJob(existing)
+	return nil
+}
+
+// replaceJob deletes the existing job of the same name (its pods first, so that they aren't watched as the pods of the
+// new job) and creates the job again
+func (p *Plugin) replaceJob(ctx context.Context, jobToRun *v1.Job, clientSet kubernetes.Interface) (*v1.Job, error) {
+	logrus.Infof("replacing the existing job: [ %s ]", jobToRun.GetName())
+
+	var existing *v1.Job
+	err := p.withRetry("getting the existing job", func() error {
+		var err error
+		existing, err = clientSet.BatchV1().Jobs(p.Namespace).Get(ctx, jobToRun.GetName(), metaV1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	propagation := metaV1.DeletePropagationForeground
+	err = p.withRetry("deleting the existing job", func() error {
+		return clientSet.BatchV1().Jobs(p.Namespace).Delete(ctx, existing.GetName(), metaV1.DeleteOptions{
+			GracePeriodSeconds: &p.GracePeriodSeconds,
+			PropagationPolicy:  &propagation,
+		})
+	})
+	if err != nil && !apiErrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err := p.waitForJobDeleted(ctx, existing, clientSet); err != nil {
+		return nil, err
+	}
+
+	var job *v1.Job
+	err = p.withRetry("creating the job", func() error {
+		var err error
+		job, err = clientSet.BatchV1().Jobs(p.Namespace).Create(ctx, jobToRun, metaV1.CreateOptions{})
+		return err
+	})
+	return job, err
+}
+
+// waitForJobDeleted waits for the deleted job to be gone
+func (p *Plugin) waitForJobDeleted(ctx context.Context, job *v1.Job, clientSet kubernetes.Interface) error {
+	ctx, cancel := context.WithTimeout(ctx, jobDeletedTimeout)
+	defer cancel()
+
+	options := metaV1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", job.GetName()).String(),
+		ResourceVersion: job.GetResourceVersion(),
+	}
+	var jobWatcher watch.Interface
+	err := p.withRetry("watching the deleted job", func() error {
+		var err error
+		jobWatcher, err = clientSet.BatchV1().Jobs(p.Namespace).Watch(ctx, options)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer jobWatcher.Stop()
+
+	logrus.Infof("waiting for the job: [ %s ] to be deleted", job.GetName())
+	for event := range jobWatcher.ResultChan() {
+		if event.Type == watch.Deleted {
+			logrus.Debugf("job: [ %s ] deleted", job.GetName())
+			return nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("the job: [ %s ] didn't get deleted: %s", job.GetName(), err)
+	}
+	return fmt.Errorf("stopped watching the job: [ %s ] before it got deleted", job.GetName())
+}
+
+// ownWorkspace adds the job to the owners of the workspace PVC, so that the PVC gets garbage collected once all of its
+// owner jobs are deleted. The job references the PVC, so it can only be owned after the job is created
+func (p *Plugin) ownWorkspace(ctx context.Context, job *v1.Job, clientSet kubernetes.Interface) {
+	ownerReference := metaV1.NewControllerRef(job, v1.SchemeGroupVersion.WithKind("Job"))
+	// multiple jobs may share the workspace, none of them controls it
+	ownerReference.Controller = nil
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metaV1.OwnerReference{*ownerReference},
+		},
+	})
+	if err != nil {
+		logrus.Errorf("could not assemble the owner reference of the PVC. error: %s", err)
+		return
+	}
+
+	err = p.withRetry("setting the owner of the PVC", func() error {
+		_, err := clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Patch(ctx, p.WorkspacePVC,
+			types.StrategicMergePatchType, patch, metaV1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Warnf("could not set the job as the owner of the PVC: [ %s ], error: %s", p.WorkspacePVC, err)
+		return
+	}
+	logrus.Debugf("job: [ %s ] owns the PVC: [ %s ]", job.GetName(), p.WorkspacePVC)
+}
+
+// withSpecHash copies the labels adding the spec hash
+// The labels are shared with the other resources, the spec hash belongs to the job only
+func withSpecHash(labels map[string]string, hash string) map[string]string {
+	jobLabels := map[string]string{specHashLabel: hash}
+	for key, val := range labels {
+		jobLabels[key] = val
+	}
+	return jobLabels
+}
+
+// copyLabels returns a copy of the labels
+func copyLabels(original map[string]string) map[string]string {
+	copied := make(map[string]string, len(original))
+	for key, val := range original {
+		copied[key] = val
+	}
+	return copied
+}
+
+// printResource prints the resource as YAML to the stdout (instead of applying it in dry run mode)
+func printResource(object runtime.Object, kind schema.GroupVersionKind) error {
+	object.GetObjectKind().SetGroupVersionKind(kind)
+	content, err := yaml.Marshal(object)
+	if err != nil {
+		logrus.Errorf("could not marshal the %s. error: %s", kind.Kind, err)
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "---\n%s", content)
+	return err
+}
+
+// supportsSuccessPolicy checks whether the cluster is recent enough to handle job success policies
+func (p *Plugin) supportsSuccessPolicy(ctx context.Context, clientSet kubernetes.Interface) bool {
+	serverVersion, err := p.serverVersion(ctx, clientSet)
+	if err != nil {
+		logrus.Debugf("could not get the server version. error: %s", err)
+		return false
+	}
+
+	// minor versions may have a suffix (eg. 31+)
+	minor, err := strconv.Atoi(strings.TrimRight(serverVersion.Minor, "+"))
+	if err != nil {
+		logrus.Debugf("could not parse the server version: [ %s ]. error: %s", serverVersion.String(), err)
+		return false
+	}
+	return serverVersion.Major == "1" && minor >= 31
+}
+
+// serverVersion gets the version of the cluster, the request is bounded by the context
+func (p *Plugin) serverVersion(ctx context.Context, clientSet kubernetes.Interface) (*version.Info, error) {
+	restClient := clientSet.Discovery().RESTClient()
+	if restClient == nil {
+		// fake clients have no REST client
+		return clientSet.Discovery().ServerVersion()
+	}
+
+	body, err := restClient.Get().AbsPath("/version").Do(ctx).Raw()
+	if err != nil {
+		return nil, err
+	}
+	info := &version.Info{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// specHash computes the hash of the job specification
+// The job name (which is unique for every plugin run) is masked out so that jobs differing in their names only match
+func (p *Plugin) specHash(job *v1.Job) (string, error) {
+	spec, err := json.Marshal(job.Spec)
+	if err != nil {
+		return "", err
+	}
+
+	hash := fnv.New64a()
+	hash.Write(bytes.Replace(spec, []byte(p.CurrentJobName()), []byte{}, -1))
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// findJob looks up a job with the given spec hash that has not failed, returns nil if there is no such job
+func (p *Plugin) findJob(ctx context.Context, hash string, clientSet kubernetes.Interface) (*v1.Job, error) {
+	options := metaV1.ListOptions{
+		LabelSelector: strings.Join([]string{specHashLabel, hash}, "="),
+	}
+
+	jobs, err := clientSet.BatchV1().Jobs(p.Namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range jobs.Items {
+		if jobs.Items[i].Status.Failed == 0 {
+			return &jobs.Items[i], nil
+		}
+	}
+
+	logrus.Debugf("no job found with spec hash: [ %s ]", hash)
+	return nil, nil
+}
+
+// attachJob makes the plugin watch (and clean up) the given job instead of the one it would create
+func (p *Plugin) attachJob(job *v1.Job) {
+	logrus.Infof("attaching to the existing job: [ %s ]", job.GetName())
+	p.setJobName(job.GetName())
+	// the selector is copied, neither the given options nor the job are modified
+	if p.AdoptExisting && job.Spec.Selector != nil {
+		// the pods of the job created elsewhere don't have the labels of the build
+		p.LabelSelector = copyLabels(job.Spec.Selector.MatchLabels)
+	} else {
+		p.LabelSelector = copyLabels(p.LabelSelector)
+		p.LabelSelector[Label] = job.GetLabels()[Label]
+	}
+	p.attached = true
+	p.recordJobCreated(job.CreationTimestamp.Time)
+	p.writeOutput(job)
+}
+
+// writeOutput appends the name, namespace and UID of the job to the output file as key=value lines, so that
+// downstream steps can reference the job
+func (p *Plugin) writeOutput(job *v1.Job) {
+	if p.OutputFile == "" {
+		return
+	}
+
+	outputFile, err := os.OpenFile(p.OutputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logrus.Errorf("could not open output file: [ %s ], error: %s", p.OutputFile, err)
+		return
+	}
+	defer outputFile.Close()
+
+	_, err = fmt.Fprintf(outputFile, "%s=%s\n%s=%s\n%s=%s\n", jobNameKey, job.GetName(),
+		jobNamespaceKey, job.GetNamespace(), jobUIDKey, job.GetUID())
+	if err != nil {
+		logrus.Errorf("could not write the job to the output file: [ %s ], error: %s", p.OutputFile, err)
+		return
+	}
+	logrus.Debugf("job [ %s ] written to the output file: [ %s ]", job.GetName(), p.OutputFile)
+}
+
+// reportStatus records the status of the job in the checkpoint and appends it to the status file as a key=value line
+// (the last line wins). This way the cluster side status of the build can be surfaced by Drone; repeated statuses are
+// not reported
+func (p *Plugin) reportStatus(status string) {
+	if status == "" {
+		return
+	}
+	p.recordPhase(status)
+
+	if p.StatusFile == "" {
+		return
+	}
+
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+
+	if status == p.reportedStatus {
+		return
+	}
+
+	statusFile, err := os.OpenFile(p.StatusFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logrus.Errorf("could not open status file: [ %s ], error: %s", p.StatusFile, err)
+		return
+	}
+	defer statusFile.Close()
+
+	if _, err := fmt.Fprintf(statusFile, "%s=%s\n", statusKey, status); err != nil {
+		logrus.Errorf("could not report status: [ %s ], error: %s", status, err)
+		return
+	}
+
+	logrus.Debugf("reported status: [ %s ]", status)
+	p.reportedStatus = status
+}
+
+// DeleteJob deletes a job from the k8s cluster
+func (p *Plugin) DeleteJob(ctx context.Context, clientSet kubernetes.Interface) error {
+
+	deleteOptions := metaV1.DeleteOptions{GracePeriodSeconds: &p.GracePeriodSeconds}
+
+	err := clientSet.BatchV1().Jobs(p.Namespace).Delete(ctx, p.CurrentJobName(), deleteOptions)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("deleted job: [ %s ]", p.CurrentJobName())
+	return nil
+
+}
+
+// assembleJob builds the Job struct based on the plugin
+func (p *Plugin) assembleJob() (*v1.Job, error) {
+
+	privileged := p.Privileged
+	if privileged {
+		logrus.Warnf("the job container of [ %s ] runs PRIVILEGED, it has full access to the node", p.CurrentJobName())
+	}
+
+	batchJob := &v1.Job{
+		TypeMeta: metaV1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:   p.CurrentJobName(),
+			Labels: p.jobLabels(),
+		},
+		Spec: v1.JobSpec{
+			SuccessPolicy: p.SuccessPolicy,
+			Template: coreV1.PodTemplateSpec{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:   p.CurrentJobName(),
+					Labels: p.jobLabels(),
+				},
+				Spec: coreV1.PodSpec{
+					ServiceAccountName:           p.ServiceAccount,
+					AutomountServiceAccountToken: p.AutomountToken,
+					SecurityContext:              p.podSecurityContext(),
+					Containers: []coreV1.Container{
+						{
+							Name:       p.ContainerName,
+							Image:      p.Image,
+							WorkingDir: p.Workspace,
+							SecurityContext: &coreV1.SecurityContext{
+								Privileged:   &privileged,
+								Capabilities: p.capabilities(),
+								RunAsUser:    p.RunAsUser,
+								RunAsGroup:   p.RunAsGroup,
+							},
+							Ports:                    p.Ports,
+							ReadinessProbe:           p.ReadinessProbe,
+							TerminationMessagePolicy: p.TerminationMessagePolicy,
+							Resources:                p.resources(),
+							ImagePullPolicy:          coreV1.PullPolicy(coreV1.PullIfNotPresent),
+							Env:                      p.envVars(),
+							VolumeMounts: []coreV1.VolumeMount{
+								coreV1.VolumeMount{
+									Name:      p.ContainerName,
+									MountPath: p.mountPath(),
+									ReadOnly:  p.WorkspaceReadOnly,
+								},
+							},
+						},
+					},
+					RestartPolicy: p.restartPolicy(),
+					Volumes: []coreV1.Volume{
+						coreV1.Volume{
+							Name:         p.ContainerName,
+							VolumeSource: p.workspaceVolumeSource(),
+						},
+					},
+					ImagePullSecrets:          p.imagePullSecrets(),
+					Affinity:                  p.Affinity,
+					TopologySpreadConstraints: p.TopologySpread,
+					PriorityClassName:         p.PriorityClass,
+					DNSPolicy:                 p.DNSPolicy,
+					DNSConfig:                 p.dnsConfig(),
+					RuntimeClassName:          p.runtimeClassName(),
+				},
+			},
+		},
+	}
+
+	if p.GenerateName {
+		// the API server appends a random suffix to the name, retried builds can't collide
+		batchJob.Name = ""
+		batchJob.GenerateName = p.CurrentJobName() + "-"
+	}
+
+	podSpec := &batchJob.Spec.Template.Spec
+	for i, hostPath := range p.HostPaths {
+		volumeName := fmt.Sprintf("host-path-%d", i)
+		podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+			Name: volumeName,
+			VolumeSource: coreV1.VolumeSource{
+				HostPath: &coreV1.HostPathVolumeSource{
+					Path: hostPath.Path,
+					Type: hostPath.Type,
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, coreV1.VolumeMount{
+			Name:      volumeName,
+			MountPath: hostPath.MountPath,
+		})
+	}
+
+	if p.TokenAudience != "" {
+		podSpec.Volumes = append(podSpec.Volumes, p.tokenVolume())
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, coreV1.VolumeMount{
+			Name:      tokenVolumeName,
+			MountPath: p.TokenPath,
+			ReadOnly:  true,
+		})
+	}
+
+	podSpec.Volumes = append(podSpec.Volumes, p.Volumes...)
+	podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, p.VolumeMounts...)
+
+	// native sidecars (restartable init containers) run beside the job container and are stopped once it exits, so the
+	// job completes with the job container
+	for _, sidecar := range p.Sidecars {
+		restartPolicy := coreV1.ContainerRestartPolicyAlways
+		sidecar.RestartPolicy = &restartPolicy
+		podSpec.InitContainers = append(podSpec.InitContainers, sidecar)
+	}
+
+	if p.Completions > 0 {
+		completions := p.Completions
+		batchJob.Spec.Completions = &completions
+	}
+
+	if p.Parallelism > 0 {
+		parallelism := p.Parallelism
+		batchJob.Spec.Parallelism = &parallelism
+	}
+
+	if p.SuccessPolicy != nil {
+		// success policies apply to indexed jobs only
+		completionMode := v1.IndexedCompletion
+		batchJob.Spec.CompletionMode = &completionMode
+	}
+
+	return batchJob, nil
+
+}
+
+// tokenVolume projects a service account token issued for the audience (eg. for workload identity) into the job pod
+func (p *Plugin) tokenVolume() coreV1.Volume {
+	expiration := int64(p.TokenExpiration.Seconds())
+	return coreV1.Volume{
+		Name: tokenVolumeName,
+		VolumeSource: coreV1.VolumeSource{
+			Projected: &coreV1.ProjectedVolumeSource{
+				Sources: []coreV1.VolumeProjection{
+					{
+						ServiceAccountToken: &coreV1.ServiceAccountTokenProjection{
+							Audience:          p.TokenAudience,
+							ExpirationSeconds: &expiration,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// runtimeClassName references the runtime class of the job pod if set
+func (p *Plugin) runtimeClassName() *string {
+	if p.RuntimeClass == "" {
+		return nil
+	}
+	runtimeClass := p.RuntimeClass
+	return &runtimeClass
+}
+
+// capabilities returns the capabilities added to and dropped from the job container if any
+func (p *Plugin) capabilities() *coreV1.Capabilities {
+	if len(p.CapAdd) == 0 && len(p.CapDrop) == 0 {
+		return nil
+	}
+	return &coreV1.Capabilities{Add: p.CapAdd, Drop: p.CapDrop}
+}
+
+// resources returns the resource requirements of the job container
+func (p *Plugin) resources() coreV1.ResourceRequirements {
+	resources := coreV1.ResourceRequirements{}
+	if p.EphemeralStorageRequest != nil {
+		resources.Requests = coreV1.ResourceList{coreV1.ResourceEphemeralStorage: *p.EphemeralStorageRequest}
+	}
+	if p.EphemeralStorageLimit != nil {
+		resources.Limits = coreV1.ResourceList{coreV1.ResourceEphemeralStorage: *p.EphemeralStorageLimit}
+	}
+	return resources
+}
+
+// dnsConfig returns the DNS config of the job pod if nameservers are set
+func (p *Plugin) dnsConfig() *coreV1.PodDNSConfig {
+	if len(p.DNSNameservers) == 0 {
+		return nil
+	}
+	return &coreV1.PodDNSConfig{Nameservers: p.DNSNameservers}
+}
+
+// restartPolicy returns the restart policy of the job pod, Never by default
+func (p *Plugin) restartPolicy() coreV1.RestartPolicy {
+	if p.RestartPolicy == "" {
+		return coreV1.RestartPolicyNever
+	}
+	return p.RestartPolicy
+}
+
+// workspaceVolumeSource returns the source of the workspace volume according to the workspace type
+func (p *Plugin) workspaceVolumeSource() coreV1.VolumeSource {
+	if p.WorkspaceType == WorkspaceTypeEmptyDir {
+		return coreV1.VolumeSource{
+			EmptyDir: &coreV1.EmptyDirVolumeSource{
+				SizeLimit: p.WorkspaceSizeLimit,
+			},
+		}
+	}
+
+	return coreV1.VolumeSource{
+		PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+			ClaimName: p.WorkspacePVC,
+		},
+	}
+}
+
+// imagePullSecrets references the secrets used to pull the image of the job
+func (p *Plugin) imagePullSecrets() []coreV1.LocalObjectReference {
+	secrets := make([]coreV1.LocalObjectReference, 0, len(p.ImagePullSecrets))
+	for _, secret := range p.ImagePullSecrets {
+		secrets = append(secrets, coreV1.LocalObjectReference{Name: secret})
+	}
+	return secrets
+}
+
+// podSecurityContext assembles the security context of the job pod, nil if there's nothing to be set
+func (p *Plugin) podSecurityContext() *coreV1.PodSecurityContext {
+	if len(p.Sysctls) == 0 && p.FSGroup == nil && p.FSGroupChangePolicy == nil {
+		return nil
+	}
+
+	return &coreV1.PodSecurityContext{
+		Sysctls:             p.Sysctls,
+		FSGroup:             p.FSGroup,
+		FSGroupChangePolicy: p.FSGroupChangePolicy,
+	}
+}
+
+// DecorateJob sets the command of the container
+// The command and args configured explicitly are set as they are, otherwise the original commands are run by a shell
+func (p *Plugin) DecorateJob(job *v1.Job) (*v1.Job, error) {
+	// we assume there is a single container only in the job/pod specification
+	container := &job.Spec.Template.Spec.Containers[0]
+
+	if len(p.Command) > 0 || len(p.Args) > 0 {
+		if len(p.Command) > 0 {
+			container.Command = p.Command
+		}
+		if len(p.Args) > 0 {
+			container.Args = p.Args
+		}
+		logrus.Debugf("set command: [ %s ] with argument(s): [ %s ]", container.Command, container.Args)
+		return job, nil
+	}
+
+	if p.OriginalCommands != nil && len(p.OriginalCommands) > 0 {
+		container.Command = []string{p.Shell, "-c"}
+		container.Args = []string{script(p.OriginalCommands)}
+		logrus.Debugf("set original command: [ %s ] with argument(s): [ %s ]", container.Command, container.Args)
+	}
+	return job, nil
+}
+
+// mountPath returns the path the workspace PVC is mounted at, the workspace itself by default
+func (p *Plugin) mountPath() string {
+	if p.MountPath != "" {
+		return p.MountPath
+	}
+	return p.Workspace
+}
+
+// logWriter returns the destination of the streamed logs
+func (p *Plugin) logWriter() io.Writer {
+	writers := []io.Writer{os.Stdout}
+	if p.logServer != nil {
+		writers = append(writers, p.logServer)
+	}
+	if p.logFile != nil {
+		writers = append(writers, p.logFile)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// OpenLogFile creates (truncates) the log file once, the reconnecting log streams append to it
+// The returned function closes the file
+func (p *Plugin) OpenLogFile() (func(), error) {
+	if p.LogFile == "" {
+		return func() {}, nil
+	}
+
+	logFile, err := os.OpenFile(p.LogFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		logrus.Errorf("could not open the log file: [ %s ], error: %s", p.LogFile, err)
+		return nil, err
+	}
+	p.logFile = logFile
+	logrus.Debugf("writing the logs to: [ %s ]", p.LogFile)
+
+	return func() {
+		if err := logFile.Close(); err != nil {
+			logrus.Errorf("could not close the log file: [ %s ], error: %s", p.LogFile, err)
+		}
+	}, nil
+}
+
+// script assembles a shell script from the commands, the script aborts on the first failing command
+func script(commands []string) string {
+	return "set -e\n" + strings.Join(commands, "\n")
+}
+
+// logOptions assembles the options for streaming the pod logs
+// The configured tail lines / since seconds limit the history of the first stream only, reconnecting streams follow from
+// the moment the previous stream ended not to replay the logs already written
+func (p *Plugin) logOptions(podName string) *coreV1.PodLogOptions {
+	logOptions := coreV1.PodLogOptions{
+		Follow: true,
+	}
+
+	p.logStreamsLock.Lock()
+	defer p.logStreamsLock.Unlock()
+	if stream, ok := p.logStreams[podName]; ok && stream.streamedUntil != nil {
+		logOptions.SinceTime = stream.streamedUntil
+		return &logOptions
+	}
+
+	if p.LogTailLines > 0 {
+		tailLines := p.LogTailLines
+		logOptions.TailLines = &tailLines
+	}
+
+	if p.LogSinceSeconds > 0 {
+		sinceSeconds := p.LogSinceSeconds
+		logOptions.SinceSeconds = &sinceSeconds
+	}
+
+	return &logOptions
+}
+
+// StreamLogs follows the logs of every container of the pod
+// The stream has to be started by startLogStream
+func (p *Plugin) StreamLogs(ctx context.Context, pod *coreV1.Pod, clientSet kubernetes.Interface) {
+
+	err := p.streamPodLogs(ctx, pod, true, clientSet)
+	if err != nil {
+		// the logs will be streamed again on the next pod event
+		logrus.Debugf("could not stream the logs of every container. error: %s", err)
+	}
+	p.endLogStream(pod.GetName(), err)
+
+}
+
+// startLogStream marks the logs of the pod as being streamed, returns false if they are already being (or have been)
+// streamed; the streams are waited for by the wait group of the plugin
+func (p *Plugin) startLogStream(podName string) bool {
+	p.logStreamsLock.Lock()
+	defer p.logStreamsLock.Unlock()
+
+	stream, ok := p.logStreams[podName]
+	if !ok {
+		stream = &logStream{}
+		p.logStreams[podName] = stream
+	}
+
+	if stream.active || stream.done {
+		return false
+	}
+
+	stream.active = true
+	p.Wg.Add(1)
+	return true
+}
+
+// endLogStream marks the stream of the pod logs ended, the logs of the pod can be streamed again if the stream failed
+func (p *Plugin) endLogStream(podName string, err error) {
+	p.logStreamsLock.Lock()
+	defer p.logStreamsLock.Unlock()
+
+	streamedUntil := metaV1.Now()
+	stream := p.logStreams[podName]
+	stream.active = false
+	stream.done = err == nil
+	stream.streamedUntil = &streamedUntil
+	p.Wg.Done()
+}
+
+// streamPodLogs streams the logs of every container of the pod
+// Init containers run one after the other so their logs are streamed sequentially, the app containers run side by side
+// so their logs are streamed concurrently
+func (p *Plugin) streamPodLogs(ctx context.Context, pod *coreV1.Pod, follow bool, clientSet kubernetes.Interface) error {
+
+	podName := pod.GetName()
+	logrus.Infof("***** streaming the logs for pod [ %s ] *****", podName)
+
+	var streamErr error
+	for _, container := range pod.Spec.InitContainers {
+		if sidecarContainer(container) {
+			// sidecars run till the job container exits, their logs would hold back the rest of the logs
+			logrus.Debugf("skipping the logs of sidecar [ %s ]", container.Name)
+			continue
+		}
+		if err := p.WatchLogs(ctx, podName, container.Name, follow, clientSet); err != nil {
+			streamErr = err
+		}
+	}
+
+	var containersWg sync.WaitGroup
+	var errLock sync.Mutex
+	for _, container := range pod.Spec.Containers {
+		containersWg.Add(1)
+		go func(containerName string) {
+			defer containersWg.Done()
+			if err := p.WatchLogs(ctx, podName, containerName, follow, clientSet); err != nil {
+				errLock.Lock()
+				streamErr = err
+				errLock.Unlock()
+			}
+		}(container.Name)
+	}
+	containersWg.Wait()
+
+	if streamErr != nil {
+		return streamErr
+	}
+
+	logrus.Infof("***** end of the logs for pod [ %s ] *****", podName)
+	return nil
+
+}
+
+// sidecarContainer checks whether the init container is a native sidecar (restarted till the pod terminates)
+func sidecarContainer(container coreV1.Container) bool {
+	return container.RestartPolicy != nil && *container.RestartPolicy == coreV1.ContainerRestartPolicyAlways
+}
+
+// printCompletedLogs prints the logs of the pods of a job that completed before its pods could be watched
+// (very fast jobs may already be completed by the time the first job event is received)
+// Only the pods whose logs haven't been streamed yet are printed
+func (p *Plugin) printCompletedLogs(ctx context.Context, clientSet kubernetes.Interface) {
+	if p.SkipLogs {
+		return
+	}
+
+	options := metaV1.ListOptions{
+		LabelSelector: p.selector(),
+	}
+
+	pods, err := clientSet.CoreV1().Pods(p.Namespace).List(ctx, options)
+	if err != nil {
+		logrus.Errorf("could not list the pods of the completed job. err: %s", err)
+		return
+	}
+
+	for i := range pods.Items {
+		podName := pods.Items[i].GetName()
+		if !p.startLogStream(podName) {
+			logrus.Debugf("logs of pod [ %s ] already being watched", podName)
+			continue
+		}
+
+		err := p.streamPodLogs(ctx, &pods.Items[i], false, clientSet)
+		if err != nil {
+			logrus.Errorf("could not print the logs of pod [ %s ]. err: %s", podName, err)
+		}
+		p.endLogStream(podName, err)
+	}
+
+}
+
+// WatchLogs streams the logs of a single container of the pod, every line is prefixed with the name of the pod and container
+// Blocks till the logs are written (till the container terminates when following the logs, the stream is reconnected if
+// it drops earlier). Concurrent streams of the same pod are prevented by startLogStream
+// Failing to open the stream is retried LogMaxRetries times in a row before giving up on the logs of the container
+func (p *Plugin) WatchLogs(ctx context.Context, podName string, containerName string, follow bool, clientSet kubernetes.Interface) error {
+
+	logOptions := p.logOptions(podName)
+	logOptions.Container = containerName
+	logOptions.Follow = follow
+
+	transformer := logLineTransformer{
+		prefix:     fmt.Sprintf("[%s] [%s] ", podName, containerName),
+		timestamps: p.LogTimestamps,
+	}
+
+	failedAttempts := 0
+	for {
+		logrus.Debugf("streaming logs with options: %#v", logOptions)
+		req := clientSet.CoreV1().Pods(p.Namespace).GetLogs(podName, logOptions)
+		streamStarted := time.Now()
+
+		readCloser, err := openLogStream(ctx, req, containerName)
+		if err != nil {
+			logrus.Debugf("could not stream the logs of container [ %s ]. error: %s", containerName, err)
+			if failedAttempts >= p.LogMaxRetries || ctx.Err() != nil {
+				return err
+			}
+
+			// the attempts back off linearly
+			failedAttempts++
+			logrus.Infof("retrying to stream the logs of container [ %s ] (%d/%d)", containerName, failedAttempts,
+				p.LogMaxRetries)
+			if err := sleep(ctx, time.Duration(failedAttempts)*logsReconnectInterval); err != nil {
+				return err
+			}
+			continue
+		}
+		failedAttempts = 0
+
+		// this is blocking till logs are written
+		written, err := transformer.Copy(progressWriter{writer: p.logWriter(), progress: &p.progress}, readCloser)
+		readCloser.Close()
+
+		if err != nil {
+			logrus.Debugf("bytes written: [ %d ], error: [ %s ]", written, err)
+		} else {
+			logrus.Debugf("bytes written: [ %d ]", written)
+		}
+
+		if !follow || p.containerTerminated(ctx, podName, containerName, clientSet) {
+			return nil
+		}
+
+		// the stream dropped while the container is still running, reconnect from the last received line (the logs since
+		// have a precision of seconds, so lines received in the same second may be repeated)
+		logrus.Infof("log stream of container [ %s ] dropped, reconnecting", containerName)
+		since := metaV1.NewTime(streamStarted)
+		if !transformer.lastLine.IsZero() {
+			since = metaV1.NewTime(transformer.lastLine)
+		}
+		logOptions.SinceTime = &since
+		logOptions.SinceSeconds = nil
+		logOptions.TailLines = nil
+		if err := sleep(ctx, logsReconnectInterval); err != nil {
+			return err
+		}
+	}
+
+}
+
+// containerTerminated checks whether there are no more logs to stream from the container: the container terminated or
+// the pod completed (or is gone)
+func (p *Plugin) containerTerminated(ctx context.Context, podName string, containerName string, clientSet kubernetes.Interface) bool {
+	var pod *coreV1.Pod
+	err := p.withRetry("getting the pod", func() error {
+		var err error
+		pod, err = clientSet.CoreV1().Pods(p.Namespace).Get(ctx, podName, metaV1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Debugf("could not get pod [ %s ]. error: %s", podName, err)
+		return true
+	}
+
+	if pod.Status.Phase == coreV1.PodSucceeded || pod.Status.Phase == coreV1.PodFailed {
+		return true
+	}
+
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if status.Name != containerName {
+			continue
+		}
+
+		if p.RestartPolicy == coreV1.RestartPolicyOnFailure {
+			// the failed container is restarted in place, its logs are followed further
+			return status.State.Terminated != nil && status.State.Terminated.ExitCode == 0
+		}
+		return status.State.Terminated != nil
+	}
+	return false
+}
+
+// openLogStream opens the log stream of the container
+// Right after the pod gets scheduled its containers may not be started yet, in this case opening the stream is retried
+// with backoff for a bounded time; any other error (eg. the container or the pod is gone) is returned right away
+func openLogStream(ctx context.Context, req *rest.Request, containerName string) (io.ReadCloser, error) {
+	deadline := time.Now().Add(logsAvailableTimeout)
+	backoff := wait.Backoff{
+		Duration: time.Second,
+		Factor:   1.5,
+		Steps:    math.MaxInt32,
+		Cap:      10 * time.Second,
+	}
+
+	for {
+		readCloser, err := req.Stream(ctx)
+		if err == nil || !containerNotAvailable(err) || time.Now().After(deadline) {
+			return readCloser, err
+		}
+
+		logrus.Debugf("container [ %s ] is not available yet. error: %s", containerName, err)
+		if err := sleep(ctx, backoff.Step()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for the given duration, the wait is cut short (returning the error of the context) if the context is done
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// containerNotAvailable checks whether the logs could not be fetched as the container is not started yet
+func containerNotAvailable(err error) bool {
+	if !apiErrors.IsBadRequest(err) {
+		return false
+	}
+
+	for _, reason := range []string{"is waiting to start", "is not available", "ContainerCreating", "PodInitializing"} {
+		if strings.Contains(err.Error(), reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// logLineTransformer transforms the streamed log lines so that lines written concurrently by several pods / containers
+// can be told apart: every line gets prefixed with its source and optionally with the time it has been received
+type logLineTransformer struct {
+	prefix     string
+	timestamps bool
+
+	// the time the last line has been received
+	lastLine time.Time
+}
+
+// Copy copies the source to the destination line by line, transforming every line
+// Lines of any length are read without truncation, the last line is copied even if it's not terminated; lines are written
+// with a single call not to get interleaved with the lines written concurrently by other streams
+func (t *logLineTransformer) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	reader := bufio.NewReader(src)
+	written := int64(0)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			t.lastLine = time.Now()
+			n, err := dst.Write(t.transform(line))
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+func (t *logLineTransformer) transform(line []byte) []byte {
+	prefix := t.prefix
+	if t.timestamps {
+		prefix = time.Now().Format(time.RFC3339) + " " + prefix
+	}
+	return append([]byte(prefix), line...)
+}
+
+// selector assembles the label selector of the resources of the build
+// The labels are escaped by the selector, their validity is checked by validatedSelector
+func (p *Plugin) selector() string {
+	return labels.SelectorFromSet(p.selectorLabels()).String()
+}
+
+// validatedSelector assembles the label selector of the resources of the build, invalid label values are rejected (an
+// invalid selector would select every resource)
+func (p *Plugin) validatedSelector() (string, error) {
+	selector, err := labels.ValidatedSelectorFromSet(p.selectorLabels())
+	if err != nil {
+		return "", fmt.Errorf("invalid label selector: %s", err)
+	}
+	return selector.String(), nil
+}
+
+// jobLabels returns the labels of the job and its pods: the build metadata from the Drone env and the selector labels
+func (p *Plugin) jobLabels() map[string]string {
+	jobLabels := make(map[string]string)
+	for label, envVar := range droneLabels {
+		if value := labelValue(p.Env[envVar]); value != "" {
+			jobLabels[label] = value
+		}
+	}
+	for key, value := range p.LabelSelector {
+		jobLabels[key] = value
+	}
+	return jobLabels
+}
+
+// labelValue sanitizes the value to a valid label value: at most 63 alphanumerics, dashes, underscores and dots,
+// starting and ending with an alphanumeric (eg. the slashes of branch names are replaced by dashes)
+func labelValue(value string) string {
+	value = invalidLabelValueChars.ReplaceAllString(value, "-")
+	if len(value) > maxLabelValueLength {
+		value = value[:maxLabelValueLength]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// selectorLabels returns the labels selecting the resources of the build, every label of the resources is matched
+func (p *Plugin) selectorLabels() labels.Set {
+	return labels.Set(p.LabelSelector)
+}
+
+// jobListOptions selects the job of the build by the labels of the build; an adopted job (created elsewhere, without the
+// labels of the build) is selected by its name
+func (p *Plugin) jobListOptions() (metaV1.ListOptions, error) {
+	if p.AdoptExisting {
+		selector := fields.OneTermEqualSelector("metadata.name", p.CurrentJobName())
+		return metaV1.ListOptions{FieldSelector: selector.String()}, nil
+	}
+
+	selector, err := p.validatedSelector()
+	if err != nil {
+		return metaV1.ListOptions{}, err
+	}
+	return metaV1.ListOptions{LabelSelector: selector}, nil
+}
+
+// WatchJob watches the job from the current resource version of the jobs, captured by listing them first; the resource
+// version is returned to restart the watch from it if it gets closed before any event is received
+func (p *Plugin) WatchJob(ctx context.Context, clientSet kubernetes.Interface) (watch.Interface, string, error) {
+	var jobs *v1.JobList
+	err := p.withRetry("listing the jobs", func() error {
+		var err error
+		options, err := p.jobListOptions()
+		if err != nil {
+			return err
+		}
+		options.Limit = 1
+		jobs, err = clientSet.BatchV1().Jobs(p.Namespace).List(ctx, options)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not list jobs. err: %s", err)
+		return nil, "", err
+	}
+
+	watcher, err := p.watchJob(ctx, jobs.ResourceVersion, clientSet)
+	if err != nil {
+		return nil, "", err
+	}
+	logrus.Debugf("watching the jobs from resource version: [ %s ]", jobs.ResourceVersion)
+	return watcher, jobs.ResourceVersion, nil
+}
+
+// watchJob watches the job starting from the given resource version (the most recent one if empty)
+func (p *Plugin) watchJob(ctx context.Context, resourceVersion string, clientSet kubernetes.Interface) (watch.Interface, error) {
+
+	options, err := p.jobListOptions()
+	if err != nil {
+		p.watchers.off(JobWatcherStatusKey)
+		return nil, err
+	}
+	options.Watch = true
+	options.ResourceVersion = resourceVersion
+
+	var jobWatcher watch.Interface
+	err = p.withRetry("watching the jobs", func() error {
+		var err error
+		jobWatcher, err = clientSet.BatchV1().Jobs(p.Namespace).Watch(ctx, options)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not watch jobs. err: %s", err)
+		p.watchers.off(JobWatcherStatusKey)
+		return nil, err
+	}
+	p.watchers.on(JobWatcherStatusKey)
+	logrus.Debugf("job watcher started")
+	return jobWatcher, nil
+
+}
+
+func (p *Plugin) WatchPod(ctx context.Context, clientSet kubernetes.Interface) (watch.Interface, error) {
+	return p.watchPod(ctx, "", clientSet)
+}
+
+// watchPod watches the pods of the job starting from the given resource version (the most recent one if empty)
+func (p *Plugin) watchPod(ctx context.Context, resourceVersion string, clientSet kubernetes.Interface) (watch.Interface, error) {
+
+	selector, err := p.validatedSelector()
+	if err != nil {
+		p.watchers.off(PodWatcherStatusKey)
+		return nil, err
+	}
+
+	// set up the proper list options, use labels
+	options := metaV1.ListOptions{
+		LabelSelector:   selector,
+		ResourceVersion: resourceVersion,
+	}
+
+	// at his point we don't know the name of the pod
+	podWatcher, err := clientSet.CoreV1().Pods(p.Namespace).Watch(ctx, options)
+	if err != nil {
+		logrus.Errorf("could not watch pod. err: %s", err)
+		p.watchers.off(PodWatcherStatusKey)
+		return nil, err
+	}
+
+	p.watchers.on(PodWatcherStatusKey)
+	logrus.Debugf("pod watcher started")
+	return podWatcher, nil
+
+}
+
+// JobEvents handles job related events. Blocks till watcher is closed
+// The watch is restarted if its resource version expires (410 Gone) as it happens with long running watches
+// The watch closed by the server is re-established from the last resource version seen (the one the watch started from
+// before any event), unless the job completed
+func (p *Plugin) JobEvents(ctx context.Context, watcher watch.Interface, resourceVersion string, clientSet kubernetes.Interface) error {
+	p.watchingJob(watcher)
+	for {
+		expired := false
+		for event := range watcher.ResultChan() {
+			if resourceVersionExpired(event) {
+				expired = true
+				watcher.Stop()
+				break
+			}
+
+			if object, err := meta.Accessor(event.Object); err == nil && event.Type != watch.Error {
+				resourceVersion = object.GetResourceVersion()
+			}
+
+			p.writeCheckpoint()
+			err := p.handleJobEvent(ctx, event, watcher, clientSet)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		switch {
+		case expired:
+			logrus.Debugf("job watch expired, restarting it")
+			if watcher, err = p.rewatchJob(ctx, clientSet); err != nil {
+				return err
+			}
+		case p.jobWatchIsStopped() || ctx.Err() != nil:
+			return p.jobEventsResult(ctx)
+		default:
+			logrus.Debugf("job watch closed, re-establishing it from resource version: [ %s ]", resourceVersion)
+			if watcher, err = p.watchJob(ctx, resourceVersion, clientSet); err != nil {
+				return err
+			}
+			p.watchingJob(watcher)
+		}
+
+		if p.jobWatchIsStopped() || ctx.Err() != nil {
+			// stopped while the watch was re-established, the new watch ends right away
+			watcher.Stop()
+		}
+	}
+}
+
+// jobEventsResult returns the result of watching the job events
+func (p *Plugin) jobEventsResult(ctx context.Context) error {
+	if err := p.failureError(); err != nil {
+		return err
+	}
+
+	// the watches (and the log streams) end when the context is cancelled
+	if err := ctx.Err(); err != nil {
+		p.reportStatus(StatusFailure)
+		return err
+	}
+
+	p.failureLock.Lock()
+	succeeded := p.jobSucceeded
+	p.failureLock.Unlock()
+	if !succeeded {
+		// the job got deleted or the watch ended without the job completing
+		p.reportStatus(StatusFailure)
+		return errors.New(fmt.Sprintf("watching job [ %s ] ended before it succeeded", p.CurrentJobName()))
+	}
+
+	logrus.Debugf("job [%s] succeeded", p.CurrentJobName())
+	// wait till the log reader goroutine is done
+	return nil
+}
+
+// PodEvents handles pod related events. Blocks till watcher is closed
+// The watch is restarted if its resource version expires (410 Gone) as it happens with long running watches
+func (p *Plugin) PodEvents(ctx context.Context, watcher watch.Interface, clientSet kubernetes.Interface) error {
+	for {
+		expired := false
+		for event := range watcher.ResultChan() {
+			if resourceVersionExpired(event) {
+				expired = true
+				watcher.Stop()
+				break
+			}
+
+			p.writeCheckpoint()
+			err := p.handlePodEvent(ctx, event, watcher, clientSet)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !expired {
+			return nil
+		}
+
+		var err error
+		logrus.Debugf("pod watch expired, restarting it")
+		if watcher, err = p.rewatchPod(ctx, clientSet); err != nil {
+			return err
+		}
+	}
+}
+
+// rewatchJob restarts watching the job from a fresh resource version
+// The job is listed first to get the resource version; as the changes till that version won't be watched, the listed
+// job is handled as if it was modified
+func (p *Plugin) rewatchJob(ctx context.Context, clientSet kubernetes.Interface) (watch.Interface, error) {
+	var jobs *v1.JobList
+	err := p.withRetry("listing the jobs", func() error {
+		var err error
+		options, err := p.jobListOptions()
+		if err != nil {
+			return err
+		}
+		jobs, err = clientSet.BatchV1().Jobs(p.Namespace).List(ctx, options)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not list jobs. err: %s", err)
+		return nil, err
+	}
+
+	watcher, err := p.watchJob(ctx, jobs.ResourceVersion, clientSet)
+	if err != nil {
+		return nil, err
+	}
+	p.watchingJob(watcher)
+
+	for i := range jobs.Items {
+		if err := p.handleJobEvent(ctx, watch.Event{Type: watch.Modified, Object: &jobs.Items[i]}, watcher, clientSet); err != nil {
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// rewatchPod restarts watching the pods of the job from a fresh resource version
+// The pods are listed first to get the resource version; as the changes till that version won't be watched, the listed
+// pods are handled as if they were modified
+func (p *Plugin) rewatchPod(ctx context.Context, clientSet kubernetes.Interface) (watch.Interface, error) {
+	var pods *coreV1.PodList
+	err := p.withRetry("listing the pods", func() error {
+		var err error
+		pods, err = clientSet.CoreV1().Pods(p.Namespace).List(ctx, metaV1.ListOptions{LabelSelector: p.selector()})
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not list pods. err: %s", err)
+		return nil, err
+	}
+
+	watcher, err := p.watchPod(ctx, pods.ResourceVersion, clientSet)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pods.Items {
+		if err := p.handlePodEvent(ctx, watch.Event{Type: watch.Modified, Object: &pods.Items[i]}, watcher, clientSet); err != nil {
+			return nil, err
+		}
+	}
+	return watcher, nil
+}
+
+// resourceVersionExpired checks whether the watch failed as its resource version is too old (410 Gone)
+func resourceVersionExpired(event watch.Event) bool {
+	if event.Type != watch.Error {
+		return false
+	}
+
+	err := apiErrors.FromObject(event.Object)
+	return apiErrors.IsGone(err) || apiErrors.IsResourceExpired(err)
+}
+
+// OriginalEnvVars processes the environment passed to the job (selects specially prefixed env vars)
+func (p *Plugin) originalEnvVars() []coreV1.EnvVar {
+	originalEnv := make([]coreV1.EnvVar, 0)
+	for key, val := range p.Env {
+		if (strings.HasPrefix(key, pluginEnvPrefix) || strings.HasPrefix(key, droneEnvPrefix)) && p.envForwarded(key) {
+			originalEnv = append(originalEnv, coreV1.EnvVar{
+				Name:  key,
+				Value: val,
+			})
+		}
+	}
+	// sorted, as the order of iterating the env map is random (the spec hash depends on the order as well)
+	sort.Slice(originalEnv, func(i, j int) bool {
+		return originalEnv[i].Name < originalEnv[j].Name
+	})
+
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		redactedEnv := make([]coreV1.EnvVar, 0, len(originalEnv))
+		for _, envVar := range originalEnv {
+			redactedEnv = append(redactedEnv, coreV1.EnvVar{Name: envVar.Name, Value: redacted(envVar.Name, envVar.Value, p.RedactKeys)})
+		}
+		logrus.Debugf("original env passed to the job: %#v", redactedEnv)
+	}
+	return originalEnv
+}
+
+// envVars returns the env vars of the job container: the forwarded original env followed by the pod field
+// and the container resource references
+func (p *Plugin) envVars() []coreV1.EnvVar {
+	return append(append(append(p.originalEnvVars(), p.FileEnvs...), p.FieldEnvs...), p.ResourceEnvs...)
+}
+
+// envForwarded checks the env var against the allowlist and denylist patterns, the denylist takes precedence
+// An empty allowlist allows every env var
+func (p *Plugin) envForwarded(key string) bool {
+	if matchesAny(key, p.EnvDenylist) {
+		logrus.Debugf("env var denied: [ %s ]", key)
+		return false
+	}
+	return len(p.EnvAllowlist) == 0 || matchesAny(key, p.EnvAllowlist)
+}
+
+// matchesAny checks whether the name matches any of the glob patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateOrGetPVC creates a persistent volume claim resource in case it doesn't already exist
+func (p *Plugin) CreateOrGetPVC(ctx context.Context, clientSet kubernetes.Interface) (*coreV1.PersistentVolumeClaim, error) {
+	pvc := coreV1.PersistentVolumeClaim{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:   p.WorkspacePVC,
+			Labels: p.LabelSelector,
+		},
+		Spec: coreV1.PersistentVolumeClaimSpec{
+			AccessModes: []coreV1.PersistentVolumeAccessMode{coreV1.ReadWriteOnce},
+			Resources: coreV1.VolumeResourceRequirements{
+				Requests: map[coreV1.ResourceName]resource.Quantity{
+					coreV1.ResourceStorage: resource.MustParse("3Gi"),
+				},
+			},
+		},
+	}
+
+	if p.DryRun {
+		return &pvc, printResource(&pvc, coreV1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"))
+	}
+
+	var claim *coreV1.PersistentVolumeClaim
+	err := p.withRetry("getting the PVC", func() error {
+		var err error
+		claim, err = clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Get(ctx, p.WorkspacePVC, metaV1.GetOptions{})
+		return err
+	})
+	switch {
+	case err != nil:
+		logrus.Debugf("could not find the PVC: [ %s ], msg: [ %s ];", p.WorkspacePVC, err.Error())
+	case claim.DeletionTimestamp != nil:
+		// a PVC of a previous build may still be terminating, it can't be reused
+		if !p.WaitPVCDelete {
+			return nil, fmt.Errorf("the PVC: [ %s ] is being deleted (plugin.job.wait.pvc.delete waits for it)", p.WorkspacePVC)
+		}
+		if err := p.WaitForPVCDeleted(ctx, claim, clientSet); err != nil {
+			logrus.Errorf("PVC not deleted. err [ %s ]", err)
+			return nil, err
+		}
+	default:
+		if err := pvcCompatible(claim, &pvc); err != nil {
+			logrus.Errorf("could not reuse the existing PVC: [ %s ], error: %s", p.WorkspacePVC, err)
+			return nil, err
+		}
+		logrus.Debugf("using existing PVC: [ %s ]", claim.String())
+		return claim, nil
+	}
+
+	err = p.withRetry("creating the PVC", func() error {
+		claim, err = clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Create(ctx, &pvc, metaV1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("could not create PVC, error %s", err)
+		return nil, err
+	}
+	logrus.Debugf("created PVC: [ %s ]", claim.GetName())
+	return claim, nil
+}
+
+// pvcCompatible checks whether the existing PVC can be reused as the workspace: it must belong to the build (have the
+// labels of the build) and its access mode and size must meet the ones of the workspace
+func pvcCompatible(existing *coreV1.PersistentVolumeClaim, workspace *coreV1.PersistentVolumeClaim) error {
+	for key, value := range workspace.GetLabels() {
+		if existing.GetLabels()[key] != value {
+			return fmt.Errorf("the PVC doesn't belong to the build, label [ %s ] is [ %s ] instead of [ %s ]", key,
+				existing.GetLabels()[key], value)
+		}
+	}
+
+	for _, accessMode := range workspace.Spec.AccessModes {
+		found := false
+		for _, existingMode := range existing.Spec.AccessModes {
+			found = found || existingMode == accessMode
+		}
+		if !found {
+			return fmt.Errorf("the PVC doesn't support the access mode [ %s ]", accessMode)
+		}
+	}
+
+	size := workspace.Spec.Resources.Requests[coreV1.ResourceStorage]
+	existingSize := existing.Spec.Resources.Requests[coreV1.ResourceStorage]
+	if existingSize.Cmp(size) < 0 {
+		return fmt.Errorf("the PVC requests [ %s ], less than the [ %s ] needed", existingSize.String(), size.String())
+	}
+	return nil
+}
+
+// WaitForPVCBound waits till the PVC gets bound to a volume (for at most the PVC bound timeout)
+// PVCs of storage classes binding the volume to the first consumer don't get bound before the job pod is scheduled, these
+// are not waited for
+func (p *Plugin) WaitForPVCBound(ctx context.Context, claim *coreV1.PersistentVolumeClaim, clientSet kubernetes.Interface) error {
+	if claim.Status.Phase == coreV1.ClaimBound {
+		return nil
+	}
+
+	if p.bindsOnFirstConsumer(ctx, claim, clientSet) {
+		logrus.Debugf("the PVC: [ %s ] gets bound when the job pod is scheduled, not waiting for it", claim.GetName())
+		return nil
+	}
+
+	if p.PVCBoundTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.PVCBoundTimeout)
+		defer cancel()
+	}
+
+	options := metaV1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", claim.GetName()).String(),
+		ResourceVersion: claim.GetResourceVersion(),
+	}
+	var pvcWatcher watch.Interface
+	err := p.withRetry("watching the PVC", func() error {
+		var err error
+		pvcWatcher, err = clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Watch(ctx, options)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer pvcWatcher.Stop()
+
+	logrus.Infof("waiting for the PVC: [ %s ] to be bound", claim.GetName())
+	for event := range pvcWatcher.ResultChan() {
+		payload, ok := event.Object.(*coreV1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+
+		switch payload.Status.Phase {
+		case coreV1.ClaimBound:
+			logrus.Debugf("PVC: [ %s ] bound to volume: [ %s ]", payload.GetName(), payload.Spec.VolumeName)
+			return nil
+		case coreV1.ClaimLost:
+			return fmt.Errorf("the PVC: [ %s ] lost its volume", payload.GetName())
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("the PVC: [ %s ] didn't get bound: %s", claim.GetName(), err)
+	}
+	return fmt.Errorf("stopped watching the PVC: [ %s ] before it got bound", claim.GetName())
+}
+
+// WaitForPVCDeleted waits for the terminating PVC to be gone (eg. the PVC of a previous build still protected by its pod)
+func (p *Plugin) WaitForPVCDeleted(ctx context.Context, claim *coreV1.PersistentVolumeClaim, clientSet kubernetes.Interface) error {
+	ctx, cancel := context.WithTimeout(ctx, pvcDeletedTimeout)
+	defer cancel()
+
+	options := metaV1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", claim.GetName()).String(),
+		ResourceVersion: claim.GetResourceVersion(),
+	}
+	var pvcWatcher watch.Interface
+	err := p.withRetry("watching the PVC", func() error {
+		var err error
+		pvcWatcher, err = clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Watch(ctx, options)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer pvcWatcher.Stop()
+
+	logrus.Infof("waiting for the terminating PVC: [ %s ] to be deleted", claim.GetName())
+	for event := range pvcWatcher.ResultChan() {
+		if event.Type == watch.Deleted {
+			logrus.Debugf("PVC: [ %s ] deleted", claim.GetName())
+			return nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("the PVC: [ %s ] didn't get deleted: %s", claim.GetName(), err)
+	}
+	return fmt.Errorf("stopped watching the PVC: [ %s ] before it got deleted", claim.GetName())
+}
+
+// bindsOnFirstConsumer checks whether the storage class of the PVC binds the volume when the first pod using it gets
+// scheduled; the storage classes may not be accessible, in this case the PVC is assumed to get bound right away
+func (p *Plugin) bindsOnFirstConsumer(ctx context.Context, claim *coreV1.PersistentVolumeClaim, clientSet kubernetes.Interface) bool {
+	var storageClasses *storageV1.StorageClassList
+	err := p.withRetry("listing the storage classes", func() error {
+		var err error
+		storageClasses, err = clientSet.StorageV1().StorageClasses().List(ctx, metaV1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Debugf("could not list the storage classes. error: %s", err)
+		return false
+	}
+
+	for _, storageClass := range storageClasses.Items {
+		selected := claim.Spec.StorageClassName != nil && *claim.Spec.StorageClassName == storageClass.GetName()
+		if claim.Spec.StorageClassName == nil {
+			selected = storageClass.GetAnnotations()[defaultStorageClassAnnotation] == "true"
+		}
+
+		if selected {
+			return storageClass.VolumeBindingMode != nil &&
+				*storageClass.VolumeBindingMode == storageV1.VolumeBindingWaitForFirstConsumer
+		}
+	}
+	return false
+}
+
+// DeletePVC deletes a persistent volume claim resource
+func (p *Plugin) DeletePVC(ctx context.Context, clientSet kubernetes.Interface) error {
+	deleteOptions := metaV1.DeleteOptions{
+		GracePeriodSeconds: &p.GracePeriodSeconds,
+	}
+
+	err := clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Delete(ctx, p.WorkspacePVC, deleteOptions)
+	if err != nil {
+		logrus.Errorf("could not delete pvc:[ %s ], error: %s", p.WorkspacePVC, err)
+		return err
+	}
+	logrus.Debugf("deleted PVC: [ %s ]", p.WorkspacePVC)
+	return nil
+}
+
+// DeletePod deletes a pod of the job
+func (p *Plugin) DeletePod(ctx context.Context, name string, clientSet kubernetes.Interface) error {
+	deleteOptions := metaV1.DeleteOptions{GracePeriodSeconds: &p.GracePeriodSeconds}
+
+	err := clientSet.CoreV1().Pods(p.Namespace).Delete(ctx, name, deleteOptions)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("deleted pod: [ %s ]", name)
+	return nil
+}
+
+// cleanupTask deletes a resource created for the build
+type cleanupTask struct {
+	resource string
+	name     string
+	delete   func(ctx context.Context, clientSet kubernetes.Interface) error
+}
+
+// Cleanup deletes the resources created for the build
+// Stages are run one after the other so that resources can be deleted in order (eg. the pods before the PVC they use),
+// the resources of a stage are deleted concurrently. Resources already gone are not considered failures
+func (p *Plugin) Cleanup(ctx context.Context, clientSet kubernetes.Interface) error {
+	if p.AdoptExisting {
+		logrus.Debugf("the adopted job: [ %s ] is left to its creator", p.CurrentJobName())
+		return nil
+	}
+
+	// deleting the job orphans its pods, they are deleted along with it; the workspace is deleted once its pods are gone
+	// The snapshot of the workspace and the recorded image digests outlive the build on purpose
+	stages := [][]cleanupTask{
+		append([]cleanupTask{{resource: "job", name: p.CurrentJobName(), delete: p.DeleteJob}},
+			p.podCleanupTasks(ctx, clientSet)...),
+	}
+	if p.WorkspaceType != WorkspaceTypeEmptyDir {
+		stages = append(stages, []cleanupTask{{resource: "pvc", name: p.WorkspacePVC, delete: p.DeletePVC}})
+	}
+
+	errs := make([]error, 0)
+	for _, stage := range stages {
+		errs = append(errs, p.cleanupStage(ctx, stage, clientSet)...)
+	}
+	return utilErrors.NewAggregate(errs)
+}
+
+// podCleanupTasks lists the pods of the job to delete them one by one
+func (p *Plugin) podCleanupTasks(ctx context.Context, clientSet kubernetes.Interface) []cleanupTask {
+	var pods *coreV1.PodList
+	err := p.withRetry("listing the job pods", func() error {
+		var err error
+		pods, err = clientSet.CoreV1().Pods(p.Namespace).List(ctx, metaV1.ListOptions{LabelSelector: p.selector()})
+		return err
+	})
+	if err != nil {
+		logrus.Warnf("could not list the pods of job [ %s ], they are left behind. error: %s", p.CurrentJobName(), err)
+		return nil
+	}
+
+	tasks := make([]cleanupTask, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		name := pod.GetName()
+		tasks = append(tasks, cleanupTask{resource: "pod", name: name,
+			delete: func(ctx context.Context, clientSet kubernetes.Interface) error {
+				return p.DeletePod(ctx, name, clientSet)
+			}})
+	}
+	return tasks
+}
+
+// cleanupStage runs the cleanup tasks concurrently, at most CleanupConcurrency of them at a time
+func (p *Plugin) cleanupStage(ctx context.Context, tasks []cleanupTask, clientSet kubernetes.Interface) []error {
+	concurrency := p.CleanupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var tasksWg sync.WaitGroup
+	var errLock sync.Mutex
+	errs := make([]error, 0)
+
+	for _, task := range tasks {
+		tasksWg.Add(1)
+		slots <- struct{}{}
+		go func(task cleanupTask) {
+			defer func() {
+				<-slots
+				tasksWg.Done()
+			}()
+
+			err := task.delete(ctx, clientSet)
+			if err != nil && !apiErrors.IsNotFound(err) {
+				errLock.Lock()
+				errs = append(errs, fmt.Errorf("could not delete %s [ %s ]: %s", task.resource, task.name, err))
+				errLock.Unlock()
+				return
+			}
+			p.recordDeleted(task.resource, task.name)
+		}(task)
+	}
+
+	tasksWg.Wait()
+	return errs
+}
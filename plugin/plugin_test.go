@@ -0,0 +1,2721 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+// newTestPlugin sets up a plugin with the required options, the given options override them
+func newTestPlugin(opts Options) *Plugin {
+	if opts.JobName == "" {
+		opts.JobName = "repo-1-1600000000"
+	}
+	if opts.Image == "" {
+		opts.Image = "alpine:3.20"
+	}
+	if opts.LabelSelector == nil {
+		opts.LabelSelector = map[string]string{Label: opts.JobName}
+	}
+	return New(opts)
+}
+
+// testJob returns a job of the plugin with the given status
+func testJob(p *Plugin, status v1.JobStatus) *v1.Job {
+	return &v1.Job{
+		ObjectMeta: metaV1.ObjectMeta{Name: p.JobName, Namespace: p.Namespace, Labels: p.LabelSelector},
+		Status:     status,
+	}
+}
+
+func TestHandleJobEventWatchesThePodsOfAnAddedRunningJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := newTestPlugin(Options{})
+	event := watch.Event{Type: watch.Added, Object: testJob(p, v1.JobStatus{Active: 1})}
+	if err := p.handleJobEvent(ctx, event, watch.NewFake(), fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !p.watchers.watching(PodWatcherStatusKey) {
+		t.Errorf("the pods of the running job are not watched")
+	}
+}
+
+func TestRunFailsIfNoPodStartsInTime(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	p := newTestPlugin(Options{PodStartTimeout: 100 * time.Millisecond, WorkspaceType: WorkspaceTypeEmptyDir})
+
+	err := p.Run(context.Background(), clientSet)
+	if err == nil || !strings.Contains(err.Error(), "no pod started") {
+		t.Fatalf("expected the no pod started error, got: %v", err)
+	}
+
+	_, err = clientSet.BatchV1().Jobs(p.Namespace).Get(context.Background(), p.JobName, metaV1.GetOptions{})
+	if !apiErrors.IsNotFound(err) {
+		t.Errorf("the job is not cleaned up, error: %v", err)
+	}
+}
+
+func TestPodDeadlineCountsTheExistingPods(t *testing.T) {
+	p := newTestPlugin(Options{PodStartTimeout: 10 * time.Millisecond})
+	pod := &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Name: p.JobName + "-abcde", Namespace: p.Namespace, Labels: p.LabelSelector}}
+	p.watchingJob(watch.NewFake())
+
+	stop := p.StartPodDeadline(context.Background(), fake.NewSimpleClientset(pod))
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := p.failureError(); err != nil {
+		t.Errorf("the build is aborted although the pod exists: %s", err)
+	}
+}
+
+func TestPodDeadlineLeavesAttachedJobsAlone(t *testing.T) {
+	p := newTestPlugin(Options{PodStartTimeout: 10 * time.Millisecond})
+	p.attached = true
+	p.watchingJob(watch.NewFake())
+
+	stop := p.StartPodDeadline(context.Background(), fake.NewSimpleClientset())
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := p.failureError(); err != nil {
+		t.Errorf("the attached job is aborted: %s", err)
+	}
+}
+
+// testPod returns a pod of the plugin's job
+func testPod(p *Plugin, name string) *coreV1.Pod {
+	return &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: p.Namespace, Labels: p.LabelSelector}}
+}
+
+func TestCleanupDeletesThePodsBeforeTheWorkspace(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace", CleanupConcurrency: 4})
+	pvc := &coreV1.PersistentVolumeClaim{ObjectMeta: metaV1.ObjectMeta{Name: p.WorkspacePVC, Namespace: p.Namespace}}
+	otherPod := &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Name: "other", Namespace: p.Namespace}}
+	clientSet := fake.NewSimpleClientset(testJob(p, v1.JobStatus{}), testPod(p, "pod-1"), testPod(p, "pod-2"), pvc, otherPod)
+
+	var lock sync.Mutex
+	deleted := make([]string, 0)
+	clientSet.PrependReactor("delete", "*", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		deleted = append(deleted, action.GetResource().Resource+"/"+action.(k8sTesting.DeleteAction).GetName())
+		return false, nil, nil
+	})
+
+	if err := p.Cleanup(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(deleted) != 4 || deleted[3] != "persistentvolumeclaims/"+p.WorkspacePVC {
+		t.Errorf("expected the job and its pods deleted before the PVC, got: %v", deleted)
+	}
+	if _, err := clientSet.CoreV1().Pods(p.Namespace).Get(context.Background(), "other", metaV1.GetOptions{}); err != nil {
+		t.Errorf("a pod of another job got deleted: %s", err)
+	}
+}
+
+func TestCleanupToleratesMissingResources(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+
+	if err := p.Cleanup(context.Background(), fake.NewSimpleClientset()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// logServerClientSet returns a clientset of an API server answering the log requests by the handler
+func logServerClientSet(t *testing.T, handler http.HandlerFunc) kubernetes.Interface {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("could not set up the clientset: %s", err)
+	}
+	return clientSet
+}
+
+// containerWaiting answers the log requests as the API server does while the container is not started yet
+func containerWaiting(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"BadRequest","code":400,`+
+		`"message":"container \"build\" in pod \"pod-1\" is waiting to start: ContainerCreating"}`)
+}
+
+func TestOpenLogStreamRetriesTillTheContainerIsAvailable(t *testing.T) {
+	var requests int32
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			containerWaiting(w)
+			return
+		}
+		fmt.Fprint(w, "hello\n")
+	})
+
+	req := clientSet.CoreV1().Pods("default").GetLogs("pod-1", &coreV1.PodLogOptions{Container: "build"})
+	stream, err := openLogStream(context.Background(), req, "build")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stream.Close()
+
+	if requests := atomic.LoadInt32(&requests); requests != 2 {
+		t.Errorf("expected the stream opened at the 2nd attempt, attempts: %d", requests)
+	}
+}
+
+func TestOpenLogStreamBackoffIsCutShortByTheContext(t *testing.T) {
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		containerWaiting(w)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	req := clientSet.CoreV1().Pods("default").GetLogs("pod-1", &coreV1.PodLogOptions{Container: "build"})
+	_, err := openLogStream(ctx, req, "build")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline of the context exceeded, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("waited out the backoff after the context was done: %s", elapsed)
+	}
+}
+
+// podGone answers the log requests as the API server does for a missing pod
+func podGone(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404,`+
+		`"message":"pods \"pod-1\" not found"}`)
+}
+
+func TestWatchLogsGivesUpAfterTheMaxRetries(t *testing.T) {
+	defer func(interval time.Duration) { logsReconnectInterval = interval }(logsReconnectInterval)
+	logsReconnectInterval = time.Millisecond
+
+	var requests int32
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		podGone(w)
+	})
+
+	p := newTestPlugin(Options{LogMaxRetries: 2})
+	if err := p.WatchLogs(context.Background(), "pod-1", "build", true, clientSet); err == nil {
+		t.Fatalf("expected the stream error")
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 3 {
+		t.Errorf("expected 1 attempt and 2 retries, attempts: %d", requests)
+	}
+}
+
+func TestStreamLogsEndsTheStreamOnceAfterRetries(t *testing.T) {
+	defer func(interval time.Duration) { logsReconnectInterval = interval }(logsReconnectInterval)
+	logsReconnectInterval = time.Millisecond
+
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		podGone(w)
+	})
+
+	p := newTestPlugin(Options{LogMaxRetries: 3})
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	if !p.startLogStream(pod.GetName()) {
+		t.Fatalf("the logs of the pod are streamed already")
+	}
+	p.StreamLogs(context.Background(), pod, clientSet)
+
+	// a negative wait group counter panics, a missing Done blocks
+	done := make(chan struct{})
+	go func() {
+		p.Wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("the log stream is not ended")
+	}
+}
+
+func TestWatchLogsRetriesAreCutShortByTheContext(t *testing.T) {
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		podGone(w)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	p := newTestPlugin(Options{LogMaxRetries: 10})
+	if err := p.WatchLogs(ctx, "pod-1", "build", true, clientSet); err == nil {
+		t.Errorf("expected an error")
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("waited out the backoff after the context was done: %s", elapsed)
+	}
+}
+
+func TestLogOptionsCarryTheTailLinesAndSinceSeconds(t *testing.T) {
+	p := newTestPlugin(Options{LogTailLines: 50, LogSinceSeconds: 300})
+
+	options := p.logOptions("pod-1")
+	if !options.Follow {
+		t.Errorf("the logs are not followed")
+	}
+	if options.TailLines == nil || *options.TailLines != 50 {
+		t.Errorf("expected 50 tail lines, got: %v", options.TailLines)
+	}
+	if options.SinceSeconds == nil || *options.SinceSeconds != 300 {
+		t.Errorf("expected the logs since 300 seconds, got: %v", options.SinceSeconds)
+	}
+}
+
+func TestLogOptionsOfARestartedStreamContinueFromTheEndOfThePreviousOne(t *testing.T) {
+	p := newTestPlugin(Options{LogTailLines: 50})
+	p.startLogStream("pod-1")
+	p.endLogStream("pod-1", errors.New("stream dropped"))
+
+	options := p.logOptions("pod-1")
+	if options.SinceTime == nil {
+		t.Errorf("the restarted stream doesn't continue from the end of the previous one")
+	}
+	if options.TailLines != nil {
+		t.Errorf("the restarted stream replays %d lines", *options.TailLines)
+	}
+}
+
+// captureLogs writes the streamed logs of the plugin to a file as well, the returned function reads them
+func captureLogs(t *testing.T, p *Plugin) func() string {
+	p.LogFile = filepath.Join(t.TempDir(), "build.log")
+	closeLogFile, err := p.OpenLogFile()
+	if err != nil {
+		t.Fatalf("could not open the log file: %s", err)
+	}
+	t.Cleanup(closeLogFile)
+
+	return func() string {
+		content, err := os.ReadFile(p.LogFile)
+		if err != nil {
+			t.Fatalf("could not read the log file: %s", err)
+		}
+		return string(content)
+	}
+}
+
+// containerLogs answers the log requests by a line naming the container
+func containerLogs(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hello from %s\n", r.URL.Query().Get("container"))
+}
+
+func TestStreamPodLogsReadsEveryContainer(t *testing.T) {
+	clientSet := logServerClientSet(t, containerLogs)
+	p := newTestPlugin(Options{})
+	logs := captureLogs(t, p)
+
+	pod := testPod(p, "pod-1")
+	pod.Spec.InitContainers = []coreV1.Container{{Name: "clone"}}
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}, {Name: "cache"}}
+	if err := p.streamPodLogs(context.Background(), pod, false, clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, container := range []string{"clone", "build", "cache"} {
+		line := fmt.Sprintf("[pod-1] [%s] hello from %s\n", container, container)
+		if !strings.Contains(logs(), line) {
+			t.Errorf("the logs of container [ %s ] are missing: %q", container, logs())
+		}
+	}
+}
+
+func TestAssembleJobSetsTheSysctls(t *testing.T) {
+	podSysctls := []coreV1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}}
+	p := newTestPlugin(Options{Sysctls: podSysctls})
+
+	job, err := p.assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	securityContext := job.Spec.Template.Spec.SecurityContext
+	if securityContext == nil || !reflect.DeepEqual(securityContext.Sysctls, podSysctls) {
+		t.Errorf("expected the sysctls %v, got the security context: %v", podSysctls, securityContext)
+	}
+}
+
+func TestAssembleJobWithoutSysctls(t *testing.T) {
+	job, err := newTestPlugin(Options{}).assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if securityContext := job.Spec.Template.Spec.SecurityContext; securityContext != nil {
+		t.Errorf("expected no pod security context, got: %v", securityContext)
+	}
+}
+
+func TestLogLineTransformerPrefixesEveryLine(t *testing.T) {
+	transformer := logLineTransformer{prefix: "[pod] [build] "}
+	var output strings.Builder
+
+	input := "first\nsecond\n\nunterminated"
+	written, err := transformer.Copy(&output, strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "[pod] [build] first\n[pod] [build] second\n[pod] [build] \n[pod] [build] unterminated"
+	if output.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output.String())
+	}
+	if written != int64(len(expected)) {
+		t.Errorf("expected %d bytes written, got: %d", len(expected), written)
+	}
+}
+
+func TestLogLineTransformerKeepsLongLines(t *testing.T) {
+	transformer := logLineTransformer{prefix: "[pod] [build] "}
+	var output strings.Builder
+
+	// longer than the buffer of the reader (and the default token size of a scanner)
+	long := strings.Repeat("x", 100*1024)
+	if _, err := transformer.Copy(&output, strings.NewReader(long+"\nshort\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "[pod] [build] " + long + "\n[pod] [build] short\n"
+	if output.String() != expected {
+		t.Errorf("the long line is not copied intact, got %d bytes instead of %d", output.Len(), len(expected))
+	}
+}
+
+func TestLogLineTransformerTimestamps(t *testing.T) {
+	transformer := logLineTransformer{prefix: "[pod] [build] ", timestamps: true}
+	var output strings.Builder
+
+	if _, err := transformer.Copy(&output, strings.NewReader("first\nsecond\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n") {
+		timestamp, rest, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339, timestamp); err != nil {
+			t.Errorf("the line [ %s ] doesn't start with an RFC3339 timestamp: %s", line, err)
+		}
+		if !strings.HasPrefix(rest, "[pod] [build] ") {
+			t.Errorf("the line [ %s ] is not prefixed with the pod and the container", line)
+		}
+	}
+}
+
+func TestHandleJobEventPrintsTheLogsOfAnImmediatelySucceededJob(t *testing.T) {
+	p := newTestPlugin(Options{})
+	logs := captureLogs(t, p)
+
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	// the logs of the fake clientset read "fake logs"
+	clientSet := fake.NewSimpleClientset(pod)
+
+	// the job succeeded before its pods could be watched
+	event := watch.Event{Type: watch.Modified, Object: testJob(p, v1.JobStatus{Succeeded: 1})}
+	if err := p.handleJobEvent(context.Background(), event, watch.NewFake(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !strings.Contains(logs(), "[pod-1] [build] fake logs") {
+		t.Errorf("the logs of the completed pod are not printed: %q", logs())
+	}
+	if p.watchers.watching(PodWatcherStatusKey) {
+		t.Errorf("the pods of the completed job are watched")
+	}
+}
+
+func TestCheckImageRegistry(t *testing.T) {
+	tests := []struct {
+		image   string
+		allowed []string
+		valid   bool
+	}{
+		{image: "alpine:3.20", allowed: nil, valid: true},
+		{image: "alpine:3.20", allowed: []string{"docker.io"}, valid: true},
+		{image: "alpine:3.20", allowed: []string{"docker.io/library"}, valid: true},
+		{image: "alpine:3.20", allowed: []string{"index.docker.io/"}, valid: true},
+		{image: "banzaicloud/pipeline:latest", allowed: []string{"docker.io/banzaicloud"}, valid: true},
+		{image: "banzaicloud/pipeline:latest", allowed: []string{"docker.io/library"}, valid: false},
+		{image: "registry-1.docker.io/library/bash@sha256:1234", allowed: []string{"docker.io/library"}, valid: true},
+		{image: "ghcr.io/banzaicloud/pipeline:1.0", allowed: []string{"docker.io"}, valid: false},
+		{image: "ghcr.io/banzaicloud/pipeline:1.0", allowed: []string{"quay.io", "ghcr.io"}, valid: true},
+		// a registry is not allowed by another one sharing its prefix
+		{image: "ghcr.io.example.com/pipeline:1.0", allowed: []string{"ghcr.io"}, valid: false},
+		{image: "registry.local:5000/team/app:1.0", allowed: []string{"registry.local:5000"}, valid: true},
+		{image: "localhost/app", allowed: []string{"localhost"}, valid: true},
+		{image: "localhost/app", allowed: []string{"docker.io"}, valid: false},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{Image: test.image, AllowedRegistries: test.allowed})
+		if err := p.CheckImageRegistry(); (err == nil) != test.valid {
+			t.Errorf("image [ %s ] with the allowed registries %v: expected valid: %t, got the error: %v",
+				test.image, test.allowed, test.valid, err)
+		}
+	}
+}
+
+// fastRetries shortens the backoff of the retried API calls for the test
+func fastRetries(t *testing.T) {
+	interval := retryInitialInterval
+	retryInitialInterval = time.Millisecond
+	t.Cleanup(func() { retryInitialInterval = interval })
+}
+
+// failingCalls makes the first calls of the verb on the resource fail with the error, the number of calls is counted
+func failingCalls(clientSet *fake.Clientset, verb, resource string, failures int, err error) *int32 {
+	var calls int32
+	clientSet.PrependReactor(verb, resource, func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&calls, 1) <= int32(failures) {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	return &calls
+}
+
+func TestCreateJobRetriesTransientErrors(t *testing.T) {
+	fastRetries(t)
+	clientSet := fake.NewSimpleClientset()
+	calls := failingCalls(clientSet, "create", "jobs", 1, apiErrors.NewTooManyRequests("slow down", 1))
+	p := newTestPlugin(Options{APIMaxRetries: 3, WorkspaceType: WorkspaceTypeEmptyDir})
+
+	if err := p.CreateJob(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if *calls != 2 {
+		t.Errorf("expected the job created by the second call, got %d calls", *calls)
+	}
+	if _, err := clientSet.BatchV1().Jobs(p.Namespace).Get(context.Background(), p.JobName, metaV1.GetOptions{}); err != nil {
+		t.Errorf("the job is not created: %s", err)
+	}
+}
+
+func TestCreateJobDoesNotRetryPermanentErrors(t *testing.T) {
+	fastRetries(t)
+	clientSet := fake.NewSimpleClientset()
+	calls := failingCalls(clientSet, "create", "jobs", 1,
+		apiErrors.NewForbidden(v1.Resource("jobs"), "repo-1", errors.New("no access")))
+	p := newTestPlugin(Options{APIMaxRetries: 3, WorkspaceType: WorkspaceTypeEmptyDir})
+
+	if err := p.CreateJob(context.Background(), clientSet); !apiErrors.IsForbidden(err) {
+		t.Errorf("expected the forbidden error, got: %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected a single call, got %d calls", *calls)
+	}
+}
+
+func TestCreateOrGetPVCGivesUpAfterTheMaxRetries(t *testing.T) {
+	fastRetries(t)
+	clientSet := fake.NewSimpleClientset()
+	calls := failingCalls(clientSet, "create", "persistentvolumeclaims", 10, apiErrors.NewInternalError(errors.New("etcd is down")))
+	p := newTestPlugin(Options{APIMaxRetries: 2, WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+
+	if _, err := p.CreateOrGetPVC(context.Background(), clientSet); !apiErrors.IsInternalError(err) {
+		t.Errorf("expected the internal error, got: %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected the call retried twice, got %d calls", *calls)
+	}
+}
+
+func TestWatchLogsReconnectsADroppedStream(t *testing.T) {
+	defer func(interval time.Duration) { logsReconnectInterval = interval }(logsReconnectInterval)
+	logsReconnectInterval = time.Millisecond
+
+	var streams int32
+	sinceTimes := make(chan string, 2)
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/log") {
+			// the first stream drops (EOF) while the container is running
+			stream := atomic.AddInt32(&streams, 1)
+			sinceTimes <- r.URL.Query().Get("sinceTime")
+			fmt.Fprintf(w, "line %d\n", stream)
+			return
+		}
+
+		pod := testPod(newTestPlugin(Options{}), "pod-1")
+		pod.Status.Phase = coreV1.PodRunning
+		if atomic.LoadInt32(&streams) > 1 {
+			pod.Status.Phase = coreV1.PodSucceeded
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pod)
+	})
+
+	p := newTestPlugin(Options{})
+	logs := captureLogs(t, p)
+	if err := p.WatchLogs(context.Background(), "pod-1", "build", true, clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if logs() != "[pod-1] [build] line 1\n[pod-1] [build] line 2\n" {
+		t.Errorf("expected the logs of both streams, got: %q", logs())
+	}
+	if since := <-sinceTimes; since != "" {
+		t.Errorf("the first stream starts from: [ %s ]", since)
+	}
+	if since := <-sinceTimes; since == "" {
+		t.Errorf("the reconnected stream doesn't continue from the last received line")
+	}
+}
+
+// waitingPod returns a pending pod whose build container waits for the reason
+func waitingPod(p *Plugin, reason string) *coreV1.Pod {
+	pod := testPod(p, "pod-1")
+	pod.Status.Phase = coreV1.PodPending
+	pod.Status.ContainerStatuses = []coreV1.ContainerStatus{{
+		Name:  "build",
+		State: coreV1.ContainerState{Waiting: &coreV1.ContainerStateWaiting{Reason: reason, Message: "details"}},
+	}}
+	return pod
+}
+
+func TestHandlePodEventFailsFastOnStuckContainers(t *testing.T) {
+	for _, reason := range []string{"ImagePullBackOff", "ErrImagePull", "CrashLoopBackOff"} {
+		p := newTestPlugin(Options{})
+		p.watchers.on(PodWatcherStatusKey)
+		event := watch.Event{Type: watch.Modified, Object: waitingPod(p, reason)}
+
+		err := p.handlePodEvent(context.Background(), event, watch.NewFake(), fake.NewSimpleClientset())
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected the pod waiting for [ %s ] failed, got: %v", reason, err)
+		}
+		if p.watchers.watching(PodWatcherStatusKey) {
+			t.Errorf("the pod is still watched after it got stuck on [ %s ]", reason)
+		}
+	}
+}
+
+func TestHandlePodEventWaitsForStartingContainers(t *testing.T) {
+	p := newTestPlugin(Options{})
+	event := watch.Event{Type: watch.Modified, Object: waitingPod(p, "ContainerCreating")}
+
+	if err := p.handlePodEvent(context.Background(), event, watch.NewFake(), fake.NewSimpleClientset()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHandlePodEventToleratesCrashLoopsRestartedInPlace(t *testing.T) {
+	p := newTestPlugin(Options{RestartPolicy: coreV1.RestartPolicyOnFailure})
+	event := watch.Event{Type: watch.Modified, Object: waitingPod(p, "CrashLoopBackOff")}
+
+	if err := p.handlePodEvent(context.Background(), event, watch.NewFake(), fake.NewSimpleClientset()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHandlePodEventStartsTheStreamOnceThePodRuns(t *testing.T) {
+	var streams int32
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/log") {
+			podGone(w)
+			return
+		}
+		atomic.AddInt32(&streams, 1)
+		containerLogs(w, r)
+	})
+	p := newTestPlugin(Options{})
+	captureLogs(t, p)
+
+	pending := waitingPod(p, "ContainerCreating")
+	pending.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	running := pending.DeepCopy()
+	running.Status.Phase = coreV1.PodRunning
+	running.Status.ContainerStatuses[0].State = coreV1.ContainerState{Running: &coreV1.ContainerStateRunning{}}
+
+	for _, pod := range []*coreV1.Pod{pending, pending, running, running} {
+		event := watch.Event{Type: watch.Modified, Object: pod}
+		if err := p.handlePodEvent(context.Background(), event, watch.NewFake(), clientSet); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		p.Wg.Wait()
+		if pod == pending && streams != 0 {
+			t.Fatalf("the stream started while the pod is pending")
+		}
+	}
+
+	if streams != 1 {
+		t.Errorf("expected the stream started once, got: %d", streams)
+	}
+}
+
+func TestHandlePodEventStreamsTheLogsOfAnAddedRunningPod(t *testing.T) {
+	var streams int32
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/log") {
+			podGone(w)
+			return
+		}
+		atomic.AddInt32(&streams, 1)
+		containerLogs(w, r)
+	})
+	p := newTestPlugin(Options{})
+	captureLogs(t, p)
+
+	// the pod is running by the time it's watched, no modification follows
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	pod.Status.Phase = coreV1.PodRunning
+	if err := p.handlePodEvent(context.Background(), watch.Event{Type: watch.Added, Object: pod}, watch.NewFake(),
+		clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.Wg.Wait()
+
+	if streams != 1 {
+		t.Errorf("expected the logs of the added pod streamed, got %d streams", streams)
+	}
+}
+
+func TestHandlePodEventOpensNoStreamWhenTheLogsAreSkipped(t *testing.T) {
+	var requests int32
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		containerLogs(w, r)
+	})
+	p := newTestPlugin(Options{SkipLogs: true})
+
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	pod.Status.Phase = coreV1.PodRunning
+	if err := p.handlePodEvent(context.Background(), watch.Event{Type: watch.Modified, Object: pod}, watch.NewFake(),
+		clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.printCompletedLogs(context.Background(), clientSet)
+
+	// nothing to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.waitForLogs(ctx); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no stream opened, got %d requests", requests)
+	}
+}
+
+func TestPodEventsPropagatesTheFailureOfAStuckPod(t *testing.T) {
+	p := newTestPlugin(Options{})
+	watcher := watch.NewFake()
+	go watcher.Add(waitingPod(p, "ErrImagePull"))
+
+	err := p.PodEvents(context.Background(), watcher, fake.NewSimpleClientset())
+	if err == nil || !strings.Contains(err.Error(), "ErrImagePull") {
+		t.Errorf("expected the stuck pod failed, got: %v", err)
+	}
+}
+
+func TestFailedJobErrorCarriesTheExitCode(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	pod := testPod(p, "pod-1")
+	pod.Status.Phase = coreV1.PodFailed
+	pod.Status.ContainerStatuses = []coreV1.ContainerStatus{{
+		Name: "build",
+		State: coreV1.ContainerState{Terminated: &coreV1.ContainerStateTerminated{
+			ExitCode: 137, Reason: "OOMKilled", Message: "out of memory\n"}},
+	}}
+	clientSet := fake.NewSimpleClientset(pod)
+
+	event := watch.Event{Type: watch.Modified, Object: testJob(p, v1.JobStatus{Failed: 1})}
+	err := p.handleJobEvent(context.Background(), event, watch.NewFake(), clientSet)
+	if err == nil {
+		t.Fatalf("expected the job failed")
+	}
+
+	for _, detail := range []string{"there are [ 1 ] failed pods", "exited with code [ 137 ]", "[ OOMKilled ]", "[ out of memory ]"} {
+		if !strings.Contains(err.Error(), detail) {
+			t.Errorf("the error [ %s ] doesn't contain: %s", err, detail)
+		}
+	}
+}
+
+func TestJobKilledByItsDeadline(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	job := testJob(p, v1.JobStatus{Conditions: []v1.JobCondition{{
+		Type: v1.JobFailed, Status: coreV1.ConditionTrue, Reason: "DeadlineExceeded",
+		Message: "Job was active longer than specified deadline",
+	}}})
+
+	err := p.handleJobEvent(context.Background(), watch.Event{Type: watch.Modified, Object: job}, watch.NewFake(),
+		fake.NewSimpleClientset())
+	if err == nil {
+		t.Fatalf("expected the job failed")
+	}
+
+	for _, detail := range []string{"job condition [ Failed ]", "reason: [ DeadlineExceeded ]",
+		"message: [ Job was active longer than specified deadline ]"} {
+		if !strings.Contains(err.Error(), detail) {
+			t.Errorf("the error [ %s ] doesn't contain: %s", err, detail)
+		}
+	}
+}
+
+func TestJobCompleteCondition(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	job := testJob(p, v1.JobStatus{Succeeded: 1, Conditions: []v1.JobCondition{
+		// the non-terminal conditions are not reported
+		{Type: v1.JobSuspended, Status: coreV1.ConditionFalse, Reason: "JobResumed"},
+		{Type: v1.JobComplete, Status: coreV1.ConditionTrue},
+	}})
+
+	err := p.handleJobEvent(context.Background(), watch.Event{Type: watch.Modified, Object: job}, watch.NewFake(),
+		fake.NewSimpleClientset())
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	expected := "job condition [ Complete ], reason: [  ], message: [  ]"
+	if details := conditionDetails(job); details != expected {
+		t.Errorf("expected the details: %s, got: %s", expected, details)
+	}
+}
+
+func TestAssembleJobSetsTheReadinessProbe(t *testing.T) {
+	probe := &coreV1.Probe{ProbeHandler: coreV1.ProbeHandler{Exec: &coreV1.ExecAction{Command: []string{"sh", "-c", "true"}}}}
+	job, err := newTestPlugin(Options{ReadinessProbe: probe}).assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if actual := job.Spec.Template.Spec.Containers[0].ReadinessProbe; actual != probe {
+		t.Errorf("expected the readiness probe %v, got: %v", probe, actual)
+	}
+}
+
+func TestJobEventsRelistsTheJobOnceTheWatchExpires(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	// the job completed while the watch was expired
+	clientSet := fake.NewSimpleClientset(testJob(p, v1.JobStatus{Succeeded: 1}))
+
+	watcher := watch.NewFake()
+	go watcher.Error(&apiErrors.NewResourceExpired("too old resource version: 1 (2)").ErrStatus)
+
+	if err := p.JobEvents(context.Background(), watcher, "1", clientSet); err != nil {
+		t.Fatalf("expected the job succeeded, got: %s", err)
+	}
+
+	listed := false
+	for _, action := range clientSet.Actions() {
+		listed = listed || action.Matches("list", "jobs")
+	}
+	if !listed {
+		t.Errorf("the job is not re-listed after the watch expired")
+	}
+}
+
+func TestPodEventsRelistsThePodsOnceTheWatchExpires(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	// the pod got stuck while the watch was expired
+	clientSet := fake.NewSimpleClientset(waitingPod(p, "ImagePullBackOff"))
+
+	watcher := watch.NewFake()
+	go watcher.Error(&apiErrors.NewGone("the resource version is gone").ErrStatus)
+
+	err := p.PodEvents(context.Background(), watcher, clientSet)
+	if err == nil || !strings.Contains(err.Error(), "ImagePullBackOff") {
+		t.Errorf("expected the re-listed pod handled, got: %v", err)
+	}
+}
+
+func TestDecorateJobRunsTheOriginalCommandsAsAScript(t *testing.T) {
+	p := newTestPlugin(Options{OriginalCommands: []string{"go vet ./...", "go test ./..."}})
+	job, err := p.assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job, err = p.DecorateJob(job); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	container := job.Spec.Template.Spec.Containers[0]
+	if !reflect.DeepEqual(container.Command, []string{"sh", "-c"}) ||
+		!reflect.DeepEqual(container.Args, []string{"set -e\ngo vet ./...\ngo test ./..."}) {
+		t.Errorf("unexpected command: %q, args: %q", container.Command, container.Args)
+	}
+}
+
+func TestDecorateJobWithoutCommands(t *testing.T) {
+	p := newTestPlugin(Options{})
+	job, err := p.assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job, err = p.DecorateJob(job); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the entrypoint of the image is run
+	if container := job.Spec.Template.Spec.Containers[0]; container.Command != nil || container.Args != nil {
+		t.Errorf("unexpected command: %q, args: %q", container.Command, container.Args)
+	}
+}
+
+func TestScriptAbortsOnTheFirstFailingCommand(t *testing.T) {
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+
+	output, err := exec.Command(shell, "-c", script([]string{"echo first", "false", "echo unreachable"})).Output()
+	if err == nil {
+		t.Errorf("expected the script failed")
+	}
+	if string(output) != "first\n" {
+		t.Errorf("expected the script aborted after the failing command, output: %q", output)
+	}
+}
+
+func TestDecorateJobCommandAndArgs(t *testing.T) {
+	original := []string{"make test"}
+	tests := []struct {
+		command, args, originalCommands []string
+		expectedCommand, expectedArgs   []string
+	}{
+		{command: []string{"/bin/server"}, expectedCommand: []string{"/bin/server"}},
+		{args: []string{"--port", "8080"}, expectedArgs: []string{"--port", "8080"}},
+		{command: []string{"/bin/server"}, args: []string{"--port", "8080"},
+			expectedCommand: []string{"/bin/server"}, expectedArgs: []string{"--port", "8080"}},
+		// the command and the args take precedence over the original commands
+		{command: []string{"/bin/server"}, originalCommands: original, expectedCommand: []string{"/bin/server"}},
+		{args: []string{"--verbose"}, originalCommands: original, expectedArgs: []string{"--verbose"}},
+		{originalCommands: original, expectedCommand: []string{"sh", "-c"}, expectedArgs: []string{"set -e\nmake test"}},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{Command: test.command, Args: test.args, OriginalCommands: test.originalCommands})
+		job, err := p.assembleJob()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if job, err = p.DecorateJob(job); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		container := job.Spec.Template.Spec.Containers[0]
+		if !reflect.DeepEqual(container.Command, test.expectedCommand) || !reflect.DeepEqual(container.Args, test.expectedArgs) {
+			t.Errorf("command: %q, args: %q, original commands: %q: expected the command %q with the args %q, got: %q, %q",
+				test.command, test.args, test.originalCommands, test.expectedCommand, test.expectedArgs,
+				container.Command, container.Args)
+		}
+	}
+}
+
+func TestDecorateJobRunsTheCommandsByTheChosenShell(t *testing.T) {
+	p := newTestPlugin(Options{Shell: "bash", OriginalCommands: []string{"[[ -f go.mod ]] && go test ./..."}})
+	if err := p.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	job, err := p.assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job, err = p.DecorateJob(job); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if command := job.Spec.Template.Spec.Containers[0].Command; !reflect.DeepEqual(command, []string{"bash", "-c"}) {
+		t.Errorf("expected the commands run by bash, got: %q", command)
+	}
+
+	for _, shell := range []string{"/bin/bash", "bash -x", "sh;reboot"} {
+		if err := newTestPlugin(Options{Shell: shell}).Validate(); err == nil || !strings.Contains(err.Error(), "invalid shell") {
+			t.Errorf("expected the shell [ %s ] rejected, got: %v", shell, err)
+		}
+	}
+}
+
+// envNames returns the names of the env vars
+func envNames(envVars []coreV1.EnvVar) []string {
+	names := make([]string, 0, len(envVars))
+	for _, envVar := range envVars {
+		names = append(names, envVar.Name)
+	}
+	return names
+}
+
+func TestOriginalEnvVarsFiltering(t *testing.T) {
+	env := map[string]string{
+		"PLUGIN_PROXY_SERVICE_ACCOUNT": "builder",
+		"PLUGIN_TARGET":                "linux",
+		"DRONE_COMMIT_SHA":             "abcdef",
+		"DRONE_BRANCH":                 "main",
+		"HOME":                         "/root",
+	}
+	tests := []struct {
+		allowlist, denylist, expected []string
+	}{
+		{expected: []string{"DRONE_BRANCH", "DRONE_COMMIT_SHA", "PLUGIN_PROXY_SERVICE_ACCOUNT", "PLUGIN_TARGET"}},
+		{allowlist: []string{"DRONE_*"}, expected: []string{"DRONE_BRANCH", "DRONE_COMMIT_SHA"}},
+		{denylist: []string{"PLUGIN_PROXY_*"}, expected: []string{"DRONE_BRANCH", "DRONE_COMMIT_SHA", "PLUGIN_TARGET"}},
+		// the denylist wins
+		{allowlist: []string{"PLUGIN_*", "DRONE_BRANCH"}, denylist: []string{"PLUGIN_PROXY_*"},
+			expected: []string{"DRONE_BRANCH", "PLUGIN_TARGET"}},
+		// only the plugin and the Drone env vars are forwarded
+		{allowlist: []string{"HOME"}, expected: []string{}},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{Env: env, EnvAllowlist: test.allowlist, EnvDenylist: test.denylist})
+		if names := envNames(p.originalEnvVars()); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("allowlist: %v, denylist: %v: expected %v, got: %v", test.allowlist, test.denylist, test.expected, names)
+		}
+	}
+}
+
+func TestOriginalEnvVarsAreSorted(t *testing.T) {
+	env := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		env[fmt.Sprintf("PLUGIN_VAR_%02d", i)] = "value"
+		env[fmt.Sprintf("DRONE_VAR_%02d", i)] = "value"
+	}
+	p := newTestPlugin(Options{Env: env})
+
+	// the order of iterating the map differs from run to run
+	for i := 0; i < 10; i++ {
+		if names := envNames(p.originalEnvVars()); len(names) != 100 || !sort.StringsAreSorted(names) {
+			t.Fatalf("the env vars are not sorted: %v", names)
+		}
+	}
+}
+
+// captureStdout returns what the function writes to the standard output
+func captureStdout(t *testing.T, write func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create a pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var content strings.Builder
+		io.Copy(&content, reader)
+		output <- content.String()
+	}()
+
+	write()
+	writer.Close()
+	return <-output
+}
+
+func TestDryRunMakesNoAPICalls(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected metrics push: %s %s", r.Method, r.URL.Path)
+	}))
+	defer gateway.Close()
+
+	clientSet := fake.NewSimpleClientset()
+	p := newTestPlugin(Options{DryRun: true, WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace",
+		WaitPVCBound: true, ServiceAccount: "deployer", ValidateServiceAccount: true, MetricsPushGateway: gateway.URL})
+
+	var err error
+	output := captureStdout(t, func() {
+		err = p.Run(context.Background(), clientSet)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if actions := clientSet.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got: %v", actions)
+	}
+	for _, resource := range []string{"kind: PersistentVolumeClaim", "kind: Job", "name: " + p.JobName} {
+		if !strings.Contains(output, resource) {
+			t.Errorf("the printed resources don't contain [ %s ]:\n%s", resource, output)
+		}
+	}
+}
+
+func TestValidateRequiredFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(p *Plugin)
+		expected []string
+	}{
+		{name: "complete", modify: func(p *Plugin) {}},
+		{name: "no image", modify: func(p *Plugin) { p.Image = "" }, expected: []string{"plugin.original.image"}},
+		{name: "no namespace", modify: func(p *Plugin) { p.Namespace = "" }, expected: []string{"plugin.job.namespace"}},
+		{name: "no image nor namespace", modify: func(p *Plugin) {
+			p.Image = ""
+			p.Namespace = ""
+		}, expected: []string{"plugin.original.image", "plugin.job.namespace"}},
+		// the image of an adopted job is set already
+		{name: "adopted job", modify: func(p *Plugin) {
+			p.Image = ""
+			p.AdoptExisting = true
+		}},
+		{name: "dry run of an adopted job", modify: func(p *Plugin) {
+			p.DryRun = true
+			p.AdoptExisting = true
+		}, expected: []string{"plugin.dry.run"}},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{})
+		test.modify(p)
+
+		err := p.Validate()
+		if len(test.expected) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		for _, missing := range test.expected {
+			if !strings.Contains(err.Error(), missing) {
+				t.Errorf("%s: the error [ %s ] doesn't mention [ %s ]", test.name, err, missing)
+			}
+		}
+	}
+}
+
+// assembledJob assembles the job of a test plugin with the options
+func assembledJob(t *testing.T, opts Options) *v1.Job {
+	job, err := newTestPlugin(opts).assembleJob()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return job
+}
+
+func TestAssembleJobMountsTheWorkspaceAtTheMountPath(t *testing.T) {
+	tests := []struct {
+		mountPath, expectedMountPath string
+	}{
+		// the working directory by default
+		{mountPath: "", expectedMountPath: "/drone/src"},
+		{mountPath: "/cache", expectedMountPath: "/cache"},
+	}
+
+	for _, test := range tests {
+		job := assembledJob(t, Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace", MountPath: test.mountPath})
+
+		container := job.Spec.Template.Spec.Containers[0]
+		if container.WorkingDir != "/drone/src" {
+			t.Errorf("expected the working directory /drone/src, got: [ %s ]", container.WorkingDir)
+		}
+		if mount := container.VolumeMounts[0]; mount.Name != "build" || mount.MountPath != test.expectedMountPath {
+			t.Errorf("expected the workspace mounted at [ %s ], got: %v", test.expectedMountPath, mount)
+		}
+	}
+}
+
+func TestAssembleJobWorkspaceVolumeSource(t *testing.T) {
+	sizeLimit := resource.MustParse("1Gi")
+
+	job := assembledJob(t, Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	source := job.Spec.Template.Spec.Volumes[0].VolumeSource
+	if source.PersistentVolumeClaim == nil || source.PersistentVolumeClaim.ClaimName != "repo-1-workspace" || source.EmptyDir != nil {
+		t.Errorf("expected the PVC workspace, got: %v", source)
+	}
+
+	job = assembledJob(t, Options{WorkspaceType: WorkspaceTypeEmptyDir, WorkspaceSizeLimit: &sizeLimit})
+	source = job.Spec.Template.Spec.Volumes[0].VolumeSource
+	if source.EmptyDir == nil || source.EmptyDir.SizeLimit.Cmp(sizeLimit) != 0 || source.PersistentVolumeClaim != nil {
+		t.Errorf("expected the empty dir workspace of 1Gi, got: %v", source)
+	}
+}
+
+func TestRunCreatesNoPVCForEmptyDirWorkspace(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	// the job succeeds as soon as it's created
+	clientSet.PrependReactor("create", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		action.(k8sTesting.CreateAction).GetObject().(*v1.Job).Status.Succeeded = 1
+		return false, nil, nil
+	})
+
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypeEmptyDir, SkipLogs: true})
+	if err := p.Run(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, action := range clientSet.Actions() {
+		if action.GetResource().Resource == "persistentvolumeclaims" {
+			t.Errorf("unexpected PVC call: %v", action)
+		}
+	}
+}
+
+func TestAssembleJobMountsTheHostPaths(t *testing.T) {
+	socket := coreV1.HostPathSocket
+	job := assembledJob(t, Options{HostPaths: []HostPath{
+		{Path: "/var/run/docker.sock", MountPath: "/var/run/docker.sock", Type: &socket},
+		{Path: "/opt/cache", MountPath: "/cache"},
+	}})
+
+	podSpec := job.Spec.Template.Spec
+	volumes, mounts := podSpec.Volumes[1:], podSpec.Containers[0].VolumeMounts[1:]
+	if len(volumes) != 2 || len(mounts) != 2 {
+		t.Fatalf("expected 2 host path volumes and mounts, got: %v, %v", volumes, mounts)
+	}
+
+	if source := volumes[0].HostPath; source == nil || source.Path != "/var/run/docker.sock" || source.Type == nil || *source.Type != socket {
+		t.Errorf("expected the docker socket mounted, got: %v", volumes[0])
+	}
+	if source := volumes[1].HostPath; source == nil || source.Path != "/opt/cache" || source.Type != nil {
+		t.Errorf("expected the cache directory mounted, got: %v", volumes[1])
+	}
+	for i, mountPath := range []string{"/var/run/docker.sock", "/cache"} {
+		if mounts[i].Name != volumes[i].Name || mounts[i].MountPath != mountPath {
+			t.Errorf("expected the volume [ %s ] mounted at [ %s ], got: %v", volumes[i].Name, mountPath, mounts[i])
+		}
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy, expected coreV1.RestartPolicy
+		invalid          bool
+	}{
+		{policy: "", expected: coreV1.RestartPolicyNever},
+		{policy: coreV1.RestartPolicyNever, expected: coreV1.RestartPolicyNever},
+		{policy: coreV1.RestartPolicyOnFailure, expected: coreV1.RestartPolicyOnFailure},
+		// not supported by jobs
+		{policy: coreV1.RestartPolicyAlways, invalid: true},
+		{policy: "Sometimes", invalid: true},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{RestartPolicy: test.policy})
+		if err := p.Validate(); (err != nil) != test.invalid {
+			t.Errorf("restart policy [ %s ]: expected invalid: %t, got: %v", test.policy, test.invalid, err)
+		}
+		if test.invalid {
+			continue
+		}
+
+		if policy := assembledJob(t, Options{RestartPolicy: test.policy}).Spec.Template.Spec.RestartPolicy; policy != test.expected {
+			t.Errorf("restart policy [ %s ]: expected the pod restart policy [ %s ], got: [ %s ]", test.policy, test.expected, policy)
+		}
+	}
+}
+
+func TestJobCompletedRespectsTheCompletions(t *testing.T) {
+	tests := []struct {
+		completions int32
+		status      v1.JobStatus
+		completed   bool
+	}{
+		{completions: 0, status: v1.JobStatus{Active: 1}, completed: false},
+		{completions: 0, status: v1.JobStatus{Succeeded: 1}, completed: true},
+		{completions: 3, status: v1.JobStatus{Succeeded: 2, Active: 1}, completed: false},
+		{completions: 3, status: v1.JobStatus{Succeeded: 3}, completed: true},
+		{completions: 3, status: v1.JobStatus{Succeeded: 1, Failed: 1}, completed: true},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{Completions: test.completions})
+		if completed := p.jobCompleted(testJob(p, test.status)); completed != test.completed {
+			t.Errorf("completions: %d, status: %v: expected completed: %t", test.completions, test.status, test.completed)
+		}
+	}
+}
+
+func TestHandleJobEventWaitsForEveryCompletion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := newTestPlugin(Options{Completions: 2, Parallelism: 2})
+	event := watch.Event{Type: watch.Modified, Object: testJob(p, v1.JobStatus{Succeeded: 1, Active: 1})}
+	if err := p.handleJobEvent(ctx, event, watch.NewFake(), fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if p.jobSucceeded {
+		t.Errorf("the job succeeded before every completion")
+	}
+}
+
+func TestAssembleJobSetsTheParallelismAndCompletions(t *testing.T) {
+	spec := assembledJob(t, Options{Completions: 4, Parallelism: 2}).Spec
+	if spec.Completions == nil || *spec.Completions != 4 || spec.Parallelism == nil || *spec.Parallelism != 2 {
+		t.Errorf("expected 4 completions with the parallelism of 2, got: %v, %v", spec.Completions, spec.Parallelism)
+	}
+
+	spec = assembledJob(t, Options{}).Spec
+	if spec.Completions != nil || spec.Parallelism != nil {
+		t.Errorf("expected the defaults of the API server, got: %v, %v", spec.Completions, spec.Parallelism)
+	}
+}
+
+func TestHandlePodEventStreamsTheLogsOfEveryPodOnce(t *testing.T) {
+	p := newTestPlugin(Options{Parallelism: 2})
+	logs := captureLogs(t, p)
+
+	clientSet := fake.NewSimpleClientset()
+	pods := make([]*coreV1.Pod, 0)
+	for _, name := range []string{"pod-1", "pod-2"} {
+		pod := testPod(p, name)
+		pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+		pod.Status.Phase = coreV1.PodRunning
+		pods = append(pods, pod)
+
+		// the pods are done by the time their logs are streamed
+		completed := pod.DeepCopy()
+		completed.Status.Phase = coreV1.PodSucceeded
+		clientSet.Tracker().Add(completed)
+	}
+
+	// every pod is modified several times
+	for i := 0; i < 3; i++ {
+		for _, pod := range pods {
+			event := watch.Event{Type: watch.Modified, Object: pod}
+			if err := p.handlePodEvent(context.Background(), event, watch.NewFake(), clientSet); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the log streams didn't end")
+	}
+
+	for _, pod := range pods {
+		line := fmt.Sprintf("[%s] [build] fake logs", pod.GetName())
+		if count := strings.Count(logs(), line); count != 1 {
+			t.Errorf("expected the logs of [ %s ] streamed once, got them %d times: %q", pod.GetName(), count, logs())
+		}
+	}
+}
+
+// TestConcurrentWatcherToggles is meant to be run with -race
+func TestConcurrentWatcherToggles(t *testing.T) {
+	p := newTestPlugin(Options{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := []string{JobWatcherStatusKey, PodWatcherStatusKey}[i%2]
+			podName := fmt.Sprintf("pod-%d", i%4)
+			for j := 0; j < 100; j++ {
+				p.watchers.on(key)
+				p.watchers.watching(key)
+				p.watchers.off(key)
+
+				if p.startLogStream(podName) {
+					p.logOptions(podName)
+					p.endLogStream(podName, errors.New("stream dropped"))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if p.watchers.watching(JobWatcherStatusKey) || p.watchers.watching(PodWatcherStatusKey) {
+		t.Errorf("the watchers are left on")
+	}
+}
+
+func TestNewSetsTheDefaultsOfTheFlags(t *testing.T) {
+	p := New(Options{})
+	if p.Namespace != "default" || p.ContainerName != "build" || p.Workspace != "/drone/src" ||
+		p.WorkspaceType != WorkspaceTypePVC || p.Shell != "sh" {
+		t.Errorf("expected the defaults of the flags, got: %+v", p.Options)
+	}
+
+	p = New(Options{Namespace: "builds", WorkspaceType: WorkspaceTypeEmptyDir, Shell: "bash"})
+	if p.Namespace != "builds" || p.WorkspaceType != WorkspaceTypeEmptyDir || p.Shell != "bash" {
+		t.Errorf("expected the given options kept, got: %+v", p.Options)
+	}
+}
+
+func TestPluginsDoNotShareState(t *testing.T) {
+	first := newTestPlugin(Options{JobName: "repo-1-1", GracePeriodSeconds: 30})
+	second := newTestPlugin(Options{JobName: "repo-2-1"})
+
+	first.watchers.on(PodWatcherStatusKey)
+	if second.watchers.watching(PodWatcherStatusKey) {
+		t.Errorf("the watchers of the plugins are shared")
+	}
+
+	if !first.startLogStream("pod-1") || !second.startLogStream("pod-1") {
+		t.Errorf("the log streams of the plugins are shared")
+	}
+	first.endLogStream("pod-1", nil)
+	second.endLogStream("pod-1", nil)
+
+	if first.GracePeriodSeconds != 30 || second.GracePeriodSeconds != defaultGracePeriodSeconds {
+		t.Errorf("expected the grace periods 30 and %d, got: %d, %d", defaultGracePeriodSeconds,
+			first.GracePeriodSeconds, second.GracePeriodSeconds)
+	}
+	if first.selector() == second.selector() {
+		t.Errorf("the label selectors of the plugins are shared: [ %s ]", first.selector())
+	}
+}
+
+// hangingAPIServer answers the API calls of a build whose job never completes: the watches and the log streams hang till
+// the request is cancelled
+func hangingAPIServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Query().Get("watch") == "true" || strings.HasSuffix(r.URL.Path, "/log"):
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	case r.Method == http.MethodPost:
+		// the created resource is the one posted
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	case r.Method == http.MethodDelete:
+		fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Success"}`)
+	case strings.HasSuffix(r.URL.Path, "/jobs"):
+		fmt.Fprint(w, `{"kind":"JobList","apiVersion":"batch/v1","metadata":{"resourceVersion":"1"},"items":[]}`)
+	case strings.HasSuffix(r.URL.Path, "/pods"):
+		fmt.Fprint(w, `{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[]}`)
+	default:
+		podGone(w)
+	}
+}
+
+func TestCancelledContextUnwindsTheWatches(t *testing.T) {
+	clientSet := logServerClientSet(t, hangingAPIServer)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	result := make(chan error)
+	go func() {
+		result <- newTestPlugin(Options{WorkspaceType: WorkspaceTypeEmptyDir}).Run(ctx, clientSet)
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the context error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the build is not stopped by the context")
+	}
+}
+
+func TestCancelledContextEndsTheLogStream(t *testing.T) {
+	clientSet := logServerClientSet(t, hangingAPIServer)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan error)
+	go func() {
+		result <- newTestPlugin(Options{}).WatchLogs(ctx, "pod-1", "build", true, clientSet)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the log stream is not ended by the context")
+	}
+}
+
+func TestSuccessPolicySupportedFromServerVersion(t *testing.T) {
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"major":"1","minor":"31+"}`)
+	})
+	if !newTestPlugin(Options{}).supportsSuccessPolicy(context.Background(), clientSet) {
+		t.Errorf("expected the success policy supported from 1.31")
+	}
+}
+
+func TestCancelledContextEndsTheServerVersionCheck(t *testing.T) {
+	clientSet := logServerClientSet(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	result := make(chan bool)
+	go func() {
+		result <- newTestPlugin(Options{}).supportsSuccessPolicy(ctx, clientSet)
+	}()
+
+	select {
+	case supported := <-result:
+		if supported {
+			t.Errorf("expected the success policy unsupported without the server version")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the server version check is not ended by the context")
+	}
+}
+
+func TestStuckLogStreamDoesNotPreventTheTimeout(t *testing.T) {
+	p := newTestPlugin(Options{})
+	// a log stream that never ends
+	p.startLogStream("pod-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if err := p.waitForLogs(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline exceeded, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("waited for the stuck log stream for %s", elapsed)
+	}
+}
+
+func TestRunTimesOut(t *testing.T) {
+	clientSet := logServerClientSet(t, hangingAPIServer)
+	p := newTestPlugin(Options{Timeout: 200 * time.Millisecond, WorkspaceType: WorkspaceTypeEmptyDir})
+
+	result := make(chan error)
+	go func() {
+		result <- p.Run(context.Background(), clientSet)
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the plugin timed out, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the plugin didn't time out")
+	}
+}
+
+func TestAssembleJobSetsTheAffinity(t *testing.T) {
+	podAffinity := &coreV1.Affinity{PodAntiAffinity: &coreV1.PodAntiAffinity{}}
+	if actual := assembledJob(t, Options{Affinity: podAffinity}).Spec.Template.Spec.Affinity; actual != podAffinity {
+		t.Errorf("expected the affinity %v, got: %v", podAffinity, actual)
+	}
+}
+
+func TestAssembleJobSetsThePriorityClass(t *testing.T) {
+	if priorityClass := assembledJob(t, Options{PriorityClass: "ci-low"}).Spec.Template.Spec.PriorityClassName; priorityClass != "ci-low" {
+		t.Errorf("expected the priority class ci-low, got: [ %s ]", priorityClass)
+	}
+	if priorityClass := assembledJob(t, Options{}).Spec.Template.Spec.PriorityClassName; priorityClass != "" {
+		t.Errorf("expected no priority class, got: [ %s ]", priorityClass)
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	tests := []struct {
+		policy      coreV1.DNSPolicy
+		nameservers []string
+		invalid     bool
+	}{
+		{policy: ""},
+		{policy: coreV1.DNSClusterFirst},
+		{policy: coreV1.DNSNone, nameservers: []string{"10.0.0.10", "8.8.8.8"}},
+		// the pod would have no DNS at all
+		{policy: coreV1.DNSNone, invalid: true},
+		{policy: "ClusterLast", invalid: true},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{DNSPolicy: test.policy, DNSNameservers: test.nameservers})
+		if err := p.Validate(); (err != nil) != test.invalid {
+			t.Errorf("DNS policy [ %s ]: expected invalid: %t, got: %v", test.policy, test.invalid, err)
+		}
+		if test.invalid {
+			continue
+		}
+
+		podSpec := assembledJob(t, Options{DNSPolicy: test.policy, DNSNameservers: test.nameservers}).Spec.Template.Spec
+		if podSpec.DNSPolicy != test.policy {
+			t.Errorf("expected the DNS policy [ %s ], got: [ %s ]", test.policy, podSpec.DNSPolicy)
+		}
+		if len(test.nameservers) == 0 && podSpec.DNSConfig != nil {
+			t.Errorf("DNS policy [ %s ]: expected no DNS config, got: %v", test.policy, podSpec.DNSConfig)
+		}
+		if len(test.nameservers) > 0 && (podSpec.DNSConfig == nil || !reflect.DeepEqual(podSpec.DNSConfig.Nameservers, test.nameservers)) {
+			t.Errorf("DNS policy [ %s ]: expected the nameservers %v, got: %v", test.policy, test.nameservers, podSpec.DNSConfig)
+		}
+	}
+}
+
+// pendingPVCWatch sets up a fake clientset holding the pending workspace PVC of the plugin, the returned watcher feeds
+// the PVC watch
+func pendingPVCWatch(p *Plugin) (*fake.Clientset, *coreV1.PersistentVolumeClaim, *watch.FakeWatcher) {
+	claim := &coreV1.PersistentVolumeClaim{
+		ObjectMeta: metaV1.ObjectMeta{Name: p.WorkspacePVC, Namespace: p.Namespace},
+		Status:     coreV1.PersistentVolumeClaimStatus{Phase: coreV1.ClaimPending},
+	}
+	clientSet := fake.NewSimpleClientset(claim)
+
+	watcher := watch.NewFake()
+	clientSet.PrependWatchReactor("persistentvolumeclaims", k8sTesting.DefaultWatchReactor(watcher, nil))
+	return clientSet, claim, watcher
+}
+
+func TestWaitForPVCBound(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	clientSet, claim, watcher := pendingPVCWatch(p)
+
+	go func() {
+		pending := claim.DeepCopy()
+		watcher.Modify(pending)
+
+		bound := claim.DeepCopy()
+		bound.Status.Phase = coreV1.ClaimBound
+		bound.Spec.VolumeName = "pv-1"
+		watcher.Modify(bound)
+	}()
+
+	if err := p.WaitForPVCBound(context.Background(), claim, clientSet); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestWaitForPVCBoundFailsIfTheVolumeIsLost(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	clientSet, claim, watcher := pendingPVCWatch(p)
+
+	go func() {
+		lost := claim.DeepCopy()
+		lost.Status.Phase = coreV1.ClaimLost
+		watcher.Modify(lost)
+	}()
+
+	if err := p.WaitForPVCBound(context.Background(), claim, clientSet); err == nil {
+		t.Errorf("expected the PVC failed to get bound")
+	}
+}
+
+func TestCreateOrGetPVCReusesOnlyCompatibleClaims(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	existingPVC := func(labels map[string]string, accessMode coreV1.PersistentVolumeAccessMode, size string) *coreV1.PersistentVolumeClaim {
+		return &coreV1.PersistentVolumeClaim{
+			ObjectMeta: metaV1.ObjectMeta{Name: p.WorkspacePVC, Namespace: p.Namespace, Labels: labels},
+			Spec: coreV1.PersistentVolumeClaimSpec{
+				AccessModes: []coreV1.PersistentVolumeAccessMode{accessMode},
+				Resources: coreV1.VolumeResourceRequirements{
+					Requests: coreV1.ResourceList{coreV1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		existing   *coreV1.PersistentVolumeClaim
+		compatible bool
+	}{
+		{name: "the claim of the build", existing: existingPVC(p.LabelSelector, coreV1.ReadWriteOnce, "3Gi"), compatible: true},
+		{name: "a larger claim", existing: existingPVC(p.LabelSelector, coreV1.ReadWriteOnce, "10Gi"), compatible: true},
+		{name: "a foreign claim", existing: existingPVC(map[string]string{Label: "other-build"}, coreV1.ReadWriteOnce, "3Gi")},
+		{name: "an unlabeled claim", existing: existingPVC(nil, coreV1.ReadWriteOnce, "3Gi")},
+		{name: "a read only claim", existing: existingPVC(p.LabelSelector, coreV1.ReadOnlyMany, "3Gi")},
+		{name: "a smaller claim", existing: existingPVC(p.LabelSelector, coreV1.ReadWriteOnce, "1Gi")},
+	}
+
+	for _, test := range tests {
+		claim, err := p.CreateOrGetPVC(context.Background(), fake.NewSimpleClientset(test.existing))
+		if test.compatible && (err != nil || claim.Spec.Resources.Requests.Storage().Cmp(*test.existing.Spec.Resources.Requests.Storage()) != 0) {
+			t.Errorf("%s: expected the existing claim reused, got: %v, error: %v", test.name, claim, err)
+		}
+		if !test.compatible && err == nil {
+			t.Errorf("%s: expected the existing claim rejected", test.name)
+		}
+	}
+}
+
+func TestOwnWorkspaceSetsTheJobAsTheOwnerOfThePVC(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	claim := &coreV1.PersistentVolumeClaim{ObjectMeta: metaV1.ObjectMeta{Name: p.WorkspacePVC, Namespace: p.Namespace}}
+	clientSet := fake.NewSimpleClientset(claim)
+
+	job := testJob(p, v1.JobStatus{})
+	job.UID = "6b3f0c1e-8d1a-4c8e-9d3e-1f2a3b4c5d6e"
+	p.ownWorkspace(context.Background(), job, clientSet)
+
+	claim, err := clientSet.CoreV1().PersistentVolumeClaims(p.Namespace).Get(context.Background(), p.WorkspacePVC, metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	owners := claim.GetOwnerReferences()
+	if len(owners) != 1 {
+		t.Fatalf("expected the job as the only owner, got: %v", owners)
+	}
+
+	owner := owners[0]
+	if owner.APIVersion != "batch/v1" || owner.Kind != "Job" || owner.Name != p.JobName || owner.UID != job.UID {
+		t.Errorf("the owner is not the job: %v", owner)
+	}
+	// jobs sharing the workspace don't control it
+	if owner.Controller != nil {
+		t.Errorf("the job controls the PVC")
+	}
+}
+
+// completingClientSet sets up a fake clientset whose jobs complete with the status as soon as they're created
+func completingClientSet(status v1.JobStatus) *fake.Clientset {
+	clientSet := fake.NewSimpleClientset()
+	clientSet.PrependReactor("create", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		action.(k8sTesting.CreateAction).GetObject().(*v1.Job).Status = status
+		return false, nil, nil
+	})
+	return clientSet
+}
+
+func TestKeepOnFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepOnFailure bool
+		status        v1.JobStatus
+		kept          bool
+	}{
+		{name: "kept failed job", keepOnFailure: true, status: v1.JobStatus{Failed: 1}, kept: true},
+		{name: "deleted failed job", keepOnFailure: false, status: v1.JobStatus{Failed: 1}, kept: false},
+		{name: "deleted succeeded job", keepOnFailure: true, status: v1.JobStatus{Succeeded: 1}, kept: false},
+	}
+
+	for _, test := range tests {
+		clientSet := completingClientSet(test.status)
+		p := newTestPlugin(Options{KeepOnFailure: test.keepOnFailure, SkipLogs: true,
+			WorkspaceType: WorkspaceTypeEmptyDir})
+		if err := p.Run(context.Background(), clientSet); (err != nil) != (test.status.Failed > 0) {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+
+		_, err := clientSet.BatchV1().Jobs(p.Namespace).Get(context.Background(), p.JobName, metaV1.GetOptions{})
+		if kept := err == nil; kept != test.kept {
+			t.Errorf("%s: expected the job kept: %t, got: %t", test.name, test.kept, kept)
+		}
+	}
+}
+
+func TestAssembleJobSetsTheRuntimeClass(t *testing.T) {
+	runtimeClass := assembledJob(t, Options{RuntimeClass: "gvisor"}).Spec.Template.Spec.RuntimeClassName
+	if runtimeClass == nil || *runtimeClass != "gvisor" {
+		t.Errorf("expected the gvisor runtime class, got: %v", runtimeClass)
+	}
+	if runtimeClass := assembledJob(t, Options{}).Spec.Template.Spec.RuntimeClassName; runtimeClass != nil {
+		t.Errorf("expected no runtime class, got: [ %s ]", *runtimeClass)
+	}
+}
+
+func TestJobEventsRewatchesAClosedWatch(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	clientSet := fake.NewSimpleClientset()
+
+	// the re-established watch receives the completion of the job
+	rewatched := watch.NewFake()
+	resourceVersions := make(chan string, 1)
+	clientSet.PrependWatchReactor("jobs", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		resourceVersions <- action.(k8sTesting.WatchAction).GetWatchRestrictions().ResourceVersion
+		go rewatched.Modify(testJob(p, v1.JobStatus{Succeeded: 1}))
+		return true, rewatched, nil
+	})
+
+	// the server closes the watch while the job is running
+	watcher := watch.NewFake()
+	go func() {
+		running := testJob(p, v1.JobStatus{Active: 1})
+		running.ResourceVersion = "5"
+		watcher.Modify(running)
+		watcher.Stop()
+	}()
+
+	if err := p.JobEvents(context.Background(), watcher, "1", clientSet); err != nil {
+		t.Fatalf("expected the job succeeded, got: %s", err)
+	}
+
+	select {
+	case resourceVersion := <-resourceVersions:
+		if resourceVersion != "5" {
+			t.Errorf("expected the watch re-established from the resource version 5, got: [ %s ]", resourceVersion)
+		}
+	default:
+		t.Errorf("the watch is not re-established")
+	}
+}
+
+func TestJobEventsStopsTheWatchReEstablishedAfterAbort(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	clientSet := fake.NewSimpleClientset()
+
+	// the build is aborted (eg. by a stuck pod) while the watch is re-established
+	aborted := errors.New("pod is stuck")
+	clientSet.PrependWatchReactor("jobs", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		p.abort(aborted)
+		return true, watch.NewFake(), nil
+	})
+
+	watcher := watch.NewFake()
+	go watcher.Stop()
+
+	result := make(chan error)
+	go func() {
+		result <- p.JobEvents(context.Background(), watcher, "1", clientSet)
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, aborted) {
+			t.Errorf("expected the abort error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the re-established watch is not stopped")
+	}
+}
+
+func TestJobEventsStopsTheWatchReEstablishedAfterCancel(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	clientSet := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientSet.PrependWatchReactor("jobs", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		cancel()
+		return true, watch.NewFake(), nil
+	})
+
+	watcher := watch.NewFake()
+	go watcher.Stop()
+
+	result := make(chan error)
+	go func() {
+		result <- p.JobEvents(ctx, watcher, "1", clientSet)
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the context error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the re-established watch is not stopped")
+	}
+}
+
+func TestJobEventsFailsIfTheJobIsDeletedBeforeItSucceeds(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	watcher := watch.NewFake()
+	go watcher.Delete(testJob(p, v1.JobStatus{Active: 1}))
+
+	err := p.JobEvents(context.Background(), watcher, "1", fake.NewSimpleClientset())
+	if err == nil || !strings.Contains(err.Error(), "ended before it succeeded") {
+		t.Errorf("expected the deleted job failed, got: %v", err)
+	}
+}
+
+func TestJobEventsFailsIfTheWatchIsStoppedBeforeTheJobSucceeds(t *testing.T) {
+	p := newTestPlugin(Options{SkipLogs: true})
+	watcher := watch.NewFake()
+	go func() {
+		watcher.Modify(testJob(p, v1.JobStatus{Active: 1}))
+		p.stopJobWatch(watcher)
+	}()
+
+	err := p.JobEvents(context.Background(), watcher, "1", fake.NewSimpleClientset())
+	if err == nil || !strings.Contains(err.Error(), "ended before it succeeded") {
+		t.Errorf("expected the job failed, got: %v", err)
+	}
+}
+
+func TestEphemeralStorage(t *testing.T) {
+	request, limit := resource.MustParse("1Gi"), resource.MustParse("4Gi")
+	resources := assembledJob(t, Options{EphemeralStorageRequest: &request, EphemeralStorageLimit: &limit}).
+		Spec.Template.Spec.Containers[0].Resources
+	if actual := resources.Requests[coreV1.ResourceEphemeralStorage]; actual.Cmp(request) != 0 {
+		t.Errorf("expected the ephemeral storage request of 1Gi, got: %v", resources.Requests)
+	}
+	if actual := resources.Limits[coreV1.ResourceEphemeralStorage]; actual.Cmp(limit) != 0 {
+		t.Errorf("expected the ephemeral storage limit of 4Gi, got: %v", resources.Limits)
+	}
+
+	resources = assembledJob(t, Options{}).Spec.Template.Spec.Containers[0].Resources
+	if resources.Requests != nil || resources.Limits != nil {
+		t.Errorf("expected no resources, got: %v", resources)
+	}
+
+	negative := resource.MustParse("-1Gi")
+	for _, opts := range []Options{
+		{EphemeralStorageRequest: &negative},
+		{EphemeralStorageLimit: &negative},
+		{EphemeralStorageRequest: &limit, EphemeralStorageLimit: &request},
+	} {
+		if err := newTestPlugin(opts).Validate(); err == nil {
+			t.Errorf("expected the request %v and the limit %v rejected", opts.EphemeralStorageRequest, opts.EphemeralStorageLimit)
+		}
+	}
+}
+
+func TestAssembleJobSetsThePorts(t *testing.T) {
+	ports := []coreV1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: coreV1.ProtocolTCP}}
+	if actual := assembledJob(t, Options{Ports: ports}).Spec.Template.Spec.Containers[0].Ports; !reflect.DeepEqual(actual, ports) {
+		t.Errorf("expected the ports %v, got: %v", ports, actual)
+	}
+}
+
+func TestAssembleJobSetsTheFieldEnvs(t *testing.T) {
+	fieldEnv := coreV1.EnvVar{Name: "MY_POD", ValueFrom: &coreV1.EnvVarSource{FieldRef: &coreV1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+	env := assembledJob(t, Options{FieldEnvs: []coreV1.EnvVar{fieldEnv}}).Spec.Template.Spec.Containers[0].Env
+
+	found := false
+	for _, envVar := range env {
+		found = found || reflect.DeepEqual(envVar, fieldEnv)
+	}
+	if !found {
+		t.Errorf("the field env var is missing: %v", env)
+	}
+}
+
+func TestCreateJobWritesTheOutputFile(t *testing.T) {
+	p := newTestPlugin(Options{OutputFile: filepath.Join(t.TempDir(), "output"), WorkspaceType: WorkspaceTypeEmptyDir})
+	clientSet := fake.NewSimpleClientset()
+	clientSet.PrependReactor("create", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		action.(k8sTesting.CreateAction).GetObject().(*v1.Job).UID = "6b3f0c1e"
+		return false, nil, nil
+	})
+
+	if err := p.CreateJob(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	output, err := os.ReadFile(p.OutputFile)
+	if err != nil {
+		t.Fatalf("could not read the output file: %s", err)
+	}
+	for _, line := range []string{jobNameKey + "=" + p.JobName, jobNamespaceKey + "=default", jobUIDKey + "=6b3f0c1e"} {
+		if !strings.Contains(string(output), line+"\n") {
+			t.Errorf("the output file doesn't contain [ %s ]:\n%s", line, output)
+		}
+	}
+}
+
+func TestAssembleJobRunsTheSidecarsBesideTheJobContainer(t *testing.T) {
+	for _, sidecars := range [][]coreV1.Container{
+		{{Name: "docker", Image: "docker:dind"}},
+		{{Name: "docker", Image: "docker:dind"}, {Name: "postgres", Image: "postgres:16"}},
+	} {
+		podSpec := assembledJob(t, Options{Sidecars: sidecars}).Spec.Template.Spec
+
+		// the job completes once the job container exits
+		if len(podSpec.Containers) != 1 || podSpec.Containers[0].Name != "build" {
+			t.Errorf("expected the job container only, got: %v", podSpec.Containers)
+		}
+		if len(podSpec.InitContainers) != len(sidecars) {
+			t.Fatalf("expected %d sidecars, got: %v", len(sidecars), podSpec.InitContainers)
+		}
+		for i, sidecar := range podSpec.InitContainers {
+			if sidecar.Name != sidecars[i].Name || !sidecarContainer(sidecar) {
+				t.Errorf("expected the sidecar [ %s ] restarted always, got: %v", sidecars[i].Name, sidecar)
+			}
+		}
+	}
+}
+
+func TestStreamPodLogsSkipsTheSidecars(t *testing.T) {
+	clientSet := logServerClientSet(t, containerLogs)
+	p := newTestPlugin(Options{})
+	logs := captureLogs(t, p)
+
+	restartPolicy := coreV1.ContainerRestartPolicyAlways
+	pod := testPod(p, "pod-1")
+	pod.Spec.InitContainers = []coreV1.Container{{Name: "docker", RestartPolicy: &restartPolicy}}
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	if err := p.streamPodLogs(context.Background(), pod, false, clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if logs() != "[pod-1] [build] hello from build\n" {
+		t.Errorf("expected the logs of the job container only, got: %q", logs())
+	}
+}
+
+func TestValidateSidecars(t *testing.T) {
+	for _, sidecars := range [][]coreV1.Container{
+		{{Name: "docker"}},
+		{{Image: "docker:dind"}},
+		{{Name: "build", Image: "docker:dind"}},
+		{{Name: "docker", Image: "docker:dind"}, {Name: "docker", Image: "docker:dind"}},
+	} {
+		if err := newTestPlugin(Options{Sidecars: sidecars}).Validate(); err == nil {
+			t.Errorf("expected the sidecars %v rejected", sidecars)
+		}
+	}
+}
+
+func TestAssembleJobMergesTheExtraVolumes(t *testing.T) {
+	volume := coreV1.Volume{Name: "config", VolumeSource: coreV1.VolumeSource{Projected: &coreV1.ProjectedVolumeSource{
+		Sources: []coreV1.VolumeProjection{{ConfigMap: &coreV1.ConfigMapProjection{
+			LocalObjectReference: coreV1.LocalObjectReference{Name: "build-config"}}}},
+	}}}
+	mount := coreV1.VolumeMount{Name: "config", MountPath: "/etc/build", ReadOnly: true}
+	opts := Options{Volumes: []coreV1.Volume{volume}, VolumeMounts: []coreV1.VolumeMount{mount}}
+
+	if err := newTestPlugin(opts).Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	podSpec := assembledJob(t, opts).Spec.Template.Spec
+	if volumes := podSpec.Volumes; len(volumes) != 2 || !reflect.DeepEqual(volumes[1], volume) {
+		t.Errorf("expected the projected volume beside the workspace, got: %v", volumes)
+	}
+	if mounts := podSpec.Containers[0].VolumeMounts; len(mounts) != 2 || !reflect.DeepEqual(mounts[1], mount) {
+		t.Errorf("expected the projected volume mounted beside the workspace, got: %v", mounts)
+	}
+}
+
+func TestValidateExtraVolumes(t *testing.T) {
+	for _, opts := range []Options{
+		{VolumeMounts: []coreV1.VolumeMount{{Name: "undeclared", MountPath: "/etc/build"}}},
+		// the name of the workspace volume
+		{Volumes: []coreV1.Volume{{Name: "build"}}},
+		{Volumes: []coreV1.Volume{{Name: "config"}, {Name: "config"}}},
+	} {
+		if err := newTestPlugin(opts).Validate(); err == nil {
+			t.Errorf("expected the volumes %v with the mounts %v rejected", opts.Volumes, opts.VolumeMounts)
+		}
+	}
+}
+
+func TestAssembleJobAutomountsTheToken(t *testing.T) {
+	for _, automount := range []bool{true, false} {
+		automount := automount
+		actual := assembledJob(t, Options{AutomountToken: &automount}).Spec.Template.Spec.AutomountServiceAccountToken
+		if actual == nil || *actual != automount {
+			t.Errorf("expected the token automounted: %t, got: %v", automount, actual)
+		}
+	}
+
+	// the service account decides
+	if actual := assembledJob(t, Options{}).Spec.Template.Spec.AutomountServiceAccountToken; actual != nil {
+		t.Errorf("expected the automount unset, got: %t", *actual)
+	}
+}
+
+func TestSelectorWithSpecialCharacters(t *testing.T) {
+	tests := []struct {
+		value, expected string
+		invalid         bool
+	}{
+		{value: "repo-1.build_2", expected: Label + "=repo-1.build_2"},
+		// the value would select other resources or break the selector
+		{value: "repo,other=x", invalid: true},
+		{value: "repo!=x", invalid: true},
+		{value: "feature/branch", invalid: true},
+		{value: "-repo", invalid: true},
+	}
+
+	for _, test := range tests {
+		p := newTestPlugin(Options{LabelSelector: map[string]string{Label: test.value}})
+		selector, err := p.validatedSelector()
+		if test.invalid {
+			if err == nil {
+				t.Errorf("expected the value [ %s ] rejected, got the selector: [ %s ]", test.value, selector)
+			}
+			continue
+		}
+		if err != nil || selector != test.expected {
+			t.Errorf("expected the selector [ %s ], got: [ %s ], error: %v", test.expected, selector, err)
+		}
+	}
+}
+
+func TestWatchJobRejectsAnInvalidSelector(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	p := newTestPlugin(Options{LabelSelector: map[string]string{Label: "repo,other=x"}})
+
+	if _, _, err := p.WatchJob(context.Background(), clientSet); err == nil {
+		t.Errorf("expected the invalid selector rejected")
+	}
+	if actions := clientSet.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got: %v", actions)
+	}
+}
+
+func TestMultiKeySelection(t *testing.T) {
+	selector := map[string]string{"team": "platform", "tier": "ci", Label: "42-label"}
+	p := newTestPlugin(Options{LabelSelector: selector})
+
+	if expected := Label + "=42-label,team=platform,tier=ci"; p.selector() != expected {
+		t.Errorf("expected the selector [ %s ], got: [ %s ]", expected, p.selector())
+	}
+
+	// the created resources carry every label of the selector
+	job := assembledJob(t, Options{LabelSelector: selector})
+	for key, value := range selector {
+		if job.Labels[key] != value || job.Spec.Template.Labels[key] != value {
+			t.Errorf("the label [ %s=%s ] is missing from the job or its pods", key, value)
+		}
+	}
+
+	// the job of another team is not selected
+	mine, theirs := testJob(p, v1.JobStatus{}), testJob(p, v1.JobStatus{})
+	theirs.Name, theirs.Labels = "other", map[string]string{"team": "data", "tier": "ci", Label: "42-label"}
+	clientSet := fake.NewSimpleClientset(mine, theirs)
+	jobs, err := clientSet.BatchV1().Jobs(p.Namespace).List(context.Background(), metaV1.ListOptions{LabelSelector: p.selector()})
+	if err != nil || len(jobs.Items) != 1 || jobs.Items[0].Name != p.JobName {
+		t.Errorf("expected the job of the build selected only, got: %v, error: %v", jobs, err)
+	}
+}
+
+func TestWatchersSelectByTheLabelSelector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := newTestPlugin(Options{LabelSelector: map[string]string{"team": "platform", Label: "42-label"}})
+	clientSet := fake.NewSimpleClientset()
+
+	jobWatcher, _, err := p.WatchJob(ctx, clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer jobWatcher.Stop()
+	podWatcher, err := p.WatchPod(ctx, clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer podWatcher.Stop()
+
+	watches := 0
+	for _, action := range clientSet.Actions() {
+		watchAction, ok := action.(k8sTesting.WatchAction)
+		if !ok {
+			continue
+		}
+		watches++
+		if selector := watchAction.GetWatchRestrictions().Labels.String(); selector != Label+"=42-label,team=platform" {
+			t.Errorf("the %s are watched with the selector [ %s ]", action.GetResource().Resource, selector)
+		}
+	}
+	if watches != 2 {
+		t.Errorf("expected the job and the pods watched, got %d watches", watches)
+	}
+}
+
+func TestLogFileReceivesTheStreamBesideTheStdout(t *testing.T) {
+	clientSet := logServerClientSet(t, containerLogs)
+	p := newTestPlugin(Options{LogFile: filepath.Join(t.TempDir(), "build.log")})
+
+	// a previous build left its logs behind
+	if err := os.WriteFile(p.LogFile, []byte("previous build\n"), 0644); err != nil {
+		t.Fatalf("could not write the log file: %s", err)
+	}
+	closeLogFile, err := p.OpenLogFile()
+	if err != nil {
+		t.Fatalf("could not open the log file: %s", err)
+	}
+	defer closeLogFile()
+
+	// the reconnecting stream appends to the file
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	stdout := captureStdout(t, func() {
+		for i := 0; i < 2; i++ {
+			if err := p.streamPodLogs(context.Background(), pod, false, clientSet); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}
+	})
+
+	expected := strings.Repeat("[pod-1] [build] hello from build\n", 2)
+	if stdout != expected {
+		t.Errorf("expected the stream on the stdout: %q, got: %q", expected, stdout)
+	}
+	if content, _ := os.ReadFile(p.LogFile); string(content) != expected {
+		t.Errorf("expected the stream in the truncated log file: %q, got: %q", expected, content)
+	}
+}
+
+func TestCheckServiceAccount(t *testing.T) {
+	p := newTestPlugin(Options{ServiceAccount: "builder"})
+	clientSet := fake.NewSimpleClientset(&coreV1.ServiceAccount{
+		ObjectMeta: metaV1.ObjectMeta{Name: "builder", Namespace: p.Namespace},
+	})
+	if err := p.CheckServiceAccount(context.Background(), clientSet); err != nil {
+		t.Errorf("unexpected error for the present service account: %s", err)
+	}
+
+	p = newTestPlugin(Options{ServiceAccount: "deployer"})
+	err := p.CheckServiceAccount(context.Background(), clientSet)
+	if err == nil || !strings.Contains(err.Error(), "deployer") {
+		t.Errorf("expected an error naming the absent service account, got: %v", err)
+	}
+
+	// the default service account of the namespace is not checked
+	p = newTestPlugin(Options{})
+	if err := p.CheckServiceAccount(context.Background(), fake.NewSimpleClientset()); err != nil {
+		t.Errorf("unexpected error without a service account: %s", err)
+	}
+}
+
+func TestRunRejectsAnAbsentServiceAccount(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	p := newTestPlugin(Options{ServiceAccount: "deployer", ValidateServiceAccount: true,
+		WorkspaceType: WorkspaceTypeEmptyDir})
+
+	if err := p.Run(context.Background(), clientSet); err == nil || !strings.Contains(err.Error(), "deployer") {
+		t.Fatalf("expected the absent service account rejected, got: %v", err)
+	}
+	if jobs, _ := clientSet.BatchV1().Jobs(p.Namespace).List(context.Background(), metaV1.ListOptions{}); len(jobs.Items) != 0 {
+		t.Errorf("expected no job created, got: %d", len(jobs.Items))
+	}
+}
+
+// generatingClientSet returns a clientset completing the jobs, the names of the jobs are generated with the suffix x7k2p
+func generatingClientSet() *fake.Clientset {
+	clientSet := completingClientSet(v1.JobStatus{Succeeded: 1})
+	// the fake API server doesn't generate the names
+	clientSet.PrependReactor("create", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8sTesting.CreateAction).GetObject().(*v1.Job)
+		if job.GetName() == "" {
+			job.SetName(job.GetGenerateName() + "x7k2p")
+		}
+		return false, nil, nil
+	})
+	return clientSet
+}
+
+func TestGeneratedJobNameIsUsedOnceCreated(t *testing.T) {
+	clientSet := generatingClientSet()
+	p := newTestPlugin(Options{GenerateName: true, SkipLogs: true, WorkspaceType: WorkspaceTypeEmptyDir})
+	p.LabelSelector = map[string]string{Label: p.JobName}
+
+	if err := p.Run(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	generated := "repo-1-1600000000-x7k2p"
+	if p.JobName != generated {
+		t.Errorf("expected the generated job name: %s, got: %s", generated, p.JobName)
+	}
+	deleted := false
+	for _, action := range clientSet.Actions() {
+		if deleteAction, ok := action.(k8sTesting.DeleteAction); ok && action.GetResource().Resource == "jobs" {
+			deleted = deleteAction.GetName() == generated
+		}
+	}
+	if !deleted {
+		t.Errorf("expected the job deleted by its generated name, got the actions: %v", clientSet.Actions())
+	}
+}
+
+func TestGeneratedJobNameIsReadWhileTheBuildRuns(t *testing.T) {
+	p := newTestPlugin(Options{GenerateName: true, SkipLogs: true, WorkspaceType: WorkspaceTypeEmptyDir,
+		HeartbeatInterval: time.Millisecond})
+	p.LabelSelector = map[string]string{Label: p.JobName}
+
+	// the name is read concurrently (eg. by the fields of the JSON logs), the race detector catches unguarded access
+	done := make(chan struct{})
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.CurrentJobName()
+			}
+		}
+	}()
+
+	err := p.Run(context.Background(), generatingClientSet())
+	close(done)
+	<-reading
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name := p.CurrentJobName(); name != "repo-1-1600000000-x7k2p" {
+		t.Errorf("expected the generated job name, got: %s", name)
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		value, expected string
+	}{
+		{value: "hello-world", expected: "hello-world"},
+		{value: "feature/login page", expected: "feature-login-page"},
+		{value: "/refs/heads/main/", expected: "refs-heads-main"},
+		{value: "v1.2.3_rc", expected: "v1.2.3_rc"},
+		{value: "ünicode", expected: "nicode"},
+		{value: "", expected: ""},
+		{value: strings.Repeat("a", 62) + "/b", expected: strings.Repeat("a", 62)},
+	}
+
+	for _, test := range tests {
+		actual := labelValue(test.value)
+		if actual != test.expected {
+			t.Errorf("expected the label value of [ %s ]: [ %s ], got: [ %s ]", test.value, test.expected, actual)
+		}
+		if errs := validation.IsValidLabelValue(actual); len(errs) != 0 {
+			t.Errorf("invalid label value [ %s ]: %v", actual, errs)
+		}
+	}
+}
+
+func TestAssembleJobLabelsTheBuildMetadata(t *testing.T) {
+	job := assembledJob(t, Options{
+		LabelSelector: map[string]string{Label: "repo-1-1600000000"},
+		Env: map[string]string{
+			"DRONE_REPO_NAME":    "hello-world",
+			"DRONE_REPO_OWNER":   "octocat",
+			"DRONE_BUILD_NUMBER": "42",
+			"DRONE_BRANCH":       "feature/login",
+			"DRONE_BUILD_EVENT":  "push",
+			"DRONE_COMMIT_SHA":   "7fd1a60b01f91b314f59955a4e4d4e80d8edf11d",
+		},
+	})
+
+	expected := map[string]string{
+		Label:             "repo-1-1600000000",
+		"drone.io/repo":   "hello-world",
+		"drone.io/owner":  "octocat",
+		"drone.io/build":  "42",
+		"drone.io/branch": "feature-login",
+		"drone.io/event":  "push",
+		"drone.io/commit": "7fd1a60b01f91b314f59955a4e4d4e80d8edf11d",
+	}
+	if !reflect.DeepEqual(job.Labels, expected) {
+		t.Errorf("expected the job labels: %v, got: %v", expected, job.Labels)
+	}
+	if !reflect.DeepEqual(job.Spec.Template.Labels, expected) {
+		t.Errorf("expected the pod labels: %v, got: %v", expected, job.Spec.Template.Labels)
+	}
+
+	// the labels of the missing env vars are left out
+	job = assembledJob(t, Options{LabelSelector: map[string]string{Label: "repo-1-1600000000"}})
+	if len(job.Labels) != 1 {
+		t.Errorf("expected the selector label only, got: %v", job.Labels)
+	}
+}
+
+func TestAssembleJobPrivileged(t *testing.T) {
+	for _, privileged := range []bool{true, false} {
+		securityContext := assembledJob(t, Options{Privileged: privileged}).Spec.Template.Spec.Containers[0].SecurityContext
+		if securityContext == nil || securityContext.Privileged == nil || *securityContext.Privileged != privileged {
+			t.Errorf("expected privileged: %t, got the security context: %+v", privileged, securityContext)
+		}
+	}
+}
+
+func TestAssembleJobCapabilities(t *testing.T) {
+	tests := []struct {
+		name      string
+		add, drop []coreV1.Capability
+	}{
+		{name: "add only", add: []coreV1.Capability{"NET_ADMIN"}},
+		{name: "drop only", drop: []coreV1.Capability{"ALL"}},
+		{name: "combined", add: []coreV1.Capability{"NET_BIND_SERVICE"}, drop: []coreV1.Capability{"ALL"}},
+	}
+
+	for _, test := range tests {
+		securityContext := assembledJob(t, Options{CapAdd: test.add, CapDrop: test.drop}).Spec.Template.Spec.Containers[0].SecurityContext
+		expected := &coreV1.Capabilities{Add: test.add, Drop: test.drop}
+		if !reflect.DeepEqual(securityContext.Capabilities, expected) {
+			t.Errorf("%s: expected the capabilities: %+v, got: %+v", test.name, expected, securityContext.Capabilities)
+		}
+	}
+
+	if securityContext := assembledJob(t, Options{}).Spec.Template.Spec.Containers[0].SecurityContext; securityContext.Capabilities != nil {
+		t.Errorf("expected no capabilities, got: %+v", securityContext.Capabilities)
+	}
+}
+
+func TestAssembleJobSetsTheTerminationMessagePolicy(t *testing.T) {
+	for _, policy := range []coreV1.TerminationMessagePolicy{coreV1.TerminationMessageFallbackToLogsOnError, coreV1.TerminationMessageReadFile} {
+		container := assembledJob(t, Options{TerminationMessagePolicy: policy}).Spec.Template.Spec.Containers[0]
+		if container.TerminationMessagePolicy != policy {
+			t.Errorf("expected the termination message policy: %s, got: %s", policy, container.TerminationMessagePolicy)
+		}
+	}
+
+	p := newTestPlugin(Options{TerminationMessagePolicy: "Logs"})
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "unsupported termination message policy") {
+		t.Errorf("expected the unsupported policy rejected, got: %v", err)
+	}
+}
+
+func TestAssembleJobMountsTheWorkspaceReadOnly(t *testing.T) {
+	for _, readOnly := range []bool{true, false} {
+		job := assembledJob(t, Options{WorkspaceReadOnly: readOnly})
+		mount := job.Spec.Template.Spec.Containers[0].VolumeMounts[0]
+		if mount.Name != "build" || mount.ReadOnly != readOnly {
+			t.Errorf("expected the workspace mounted read-only: %t, got: %+v", readOnly, mount)
+		}
+	}
+}
+
+// terminatingPVC returns the clientset holding the terminating PVC of a previous build and the watcher of the PVC
+func terminatingPVC(p *Plugin) (*fake.Clientset, *coreV1.PersistentVolumeClaim, *watch.FakeWatcher) {
+	clientSet, claim, watcher := pendingPVCWatch(p)
+	deleted := metaV1.Now()
+	claim.DeletionTimestamp = &deleted
+	claim.Finalizers = []string{"kubernetes.io/pvc-protection"}
+	clientSet.Tracker().Update(coreV1.SchemeGroupVersion.WithResource("persistentvolumeclaims"), claim, p.Namespace)
+	return clientSet, claim, watcher
+}
+
+func TestCreateOrGetPVCWaitsForTheTerminatingPVC(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace", WaitPVCDelete: true})
+	clientSet, claim, watcher := terminatingPVC(p)
+
+	go func() {
+		// received once the plugin waits for the PVC
+		watcher.Modify(claim)
+		// the pod of the previous build is gone, the PVC disappears
+		clientSet.Tracker().Delete(coreV1.SchemeGroupVersion.WithResource("persistentvolumeclaims"), p.Namespace, claim.GetName())
+		watcher.Delete(claim)
+	}()
+
+	created, err := p.CreateOrGetPVC(context.Background(), clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created.DeletionTimestamp != nil {
+		t.Errorf("expected a fresh PVC, got the terminating one")
+	}
+}
+
+func TestCreateOrGetPVCRejectsTheTerminatingPVC(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	clientSet, _, _ := terminatingPVC(p)
+
+	if _, err := p.CreateOrGetPVC(context.Background(), clientSet); err == nil || !strings.Contains(err.Error(), "being deleted") {
+		t.Errorf("expected the terminating PVC rejected without waiting, got: %v", err)
+	}
+}
+
+func TestWatchJobStartsFromTheListedResourceVersion(t *testing.T) {
+	p := newTestPlugin(Options{LabelSelector: map[string]string{Label: "repo-1-1600000000"}})
+	clientSet := fake.NewSimpleClientset()
+	clientSet.PrependReactor("list", "jobs", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, &v1.JobList{ListMeta: metaV1.ListMeta{ResourceVersion: "4242"}}, nil
+	})
+
+	watcher, resourceVersion, err := p.WatchJob(context.Background(), clientSet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer watcher.Stop()
+
+	if resourceVersion != "4242" {
+		t.Errorf("expected the listed resource version 4242 returned, got: %s", resourceVersion)
+	}
+	watched := false
+	for _, action := range clientSet.Actions() {
+		if watchAction, ok := action.(k8sTesting.WatchAction); ok {
+			watched = true
+			if actual := watchAction.GetWatchRestrictions().ResourceVersion; actual != "4242" {
+				t.Errorf("expected the watch started from the resource version 4242, got: %s", actual)
+			}
+		}
+	}
+	if !watched {
+		t.Errorf("the job is not watched")
+	}
+}
+
+func TestAssembleJobSpreadsThePodsAcrossZones(t *testing.T) {
+	zoneSpread := []coreV1.TopologySpreadConstraint{{
+		MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: coreV1.ScheduleAnyway,
+	}}
+	p := newTestPlugin(Options{TopologySpread: zoneSpread})
+	if err := p.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if actual := assembledJob(t, Options{TopologySpread: zoneSpread}).Spec.Template.Spec.TopologySpreadConstraints; !reflect.DeepEqual(actual, zoneSpread) {
+		t.Errorf("expected the constraints: %v, got: %v", zoneSpread, actual)
+	}
+
+	p = newTestPlugin(Options{TopologySpread: []coreV1.TopologySpreadConstraint{{MaxSkew: 0, TopologyKey: "topology.kubernetes.io/zone"}}})
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "invalid topology spread constraint") {
+		t.Errorf("expected the invalid constraint rejected, got: %v", err)
+	}
+}
+
+// existingJob returns the clientset holding the job of the same name left behind by a previous (partially failed) run
+func existingJob(p *Plugin) (*fake.Clientset, *v1.Job) {
+	existing := testJob(p, v1.JobStatus{Active: 1})
+	existing.Spec.Template.Spec.Containers = []coreV1.Container{{Name: "build", Image: "alpine:3.19"}}
+	return fake.NewSimpleClientset(existing), existing
+}
+
+// jobImage returns the image of the job of the plugin
+func jobImage(t *testing.T, p *Plugin, clientSet kubernetes.Interface) string {
+	job, err := clientSet.BatchV1().Jobs(p.Namespace).Get(context.Background(), p.JobName, metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get the job: %s", err)
+	}
+	return job.Spec.Template.Spec.Containers[0].Image
+}
+
+func TestCreateJobFailsOnAnExistingJob(t *testing.T) {
+	for _, onExists := range []string{"", JobExistsFail} {
+		p := newTestPlugin(Options{OnExists: onExists, WorkspaceType: WorkspaceTypeEmptyDir})
+		clientSet, _ := existingJob(p)
+
+		if err := p.CreateJob(context.Background(), clientSet); !apiErrors.IsAlreadyExists(err) {
+			t.Errorf("on exists [ %s ]: expected the already exists error, got: %v", onExists, err)
+		}
+		if image := jobImage(t, p, clientSet); image != "alpine:3.19" {
+			t.Errorf("on exists [ %s ]: expected the existing job left alone, got the image: %s", onExists, image)
+		}
+	}
+}
+
+func TestCreateJobAdoptsAnExistingJob(t *testing.T) {
+	p := newTestPlugin(Options{OnExists: JobExistsAdopt, WorkspaceType: WorkspaceTypeEmptyDir})
+	clientSet, _ := existingJob(p)
+
+	if err := p.CreateJob(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !p.attached {
+		t.Errorf("expected the plugin attached to the existing job")
+	}
+	if image := jobImage(t, p, clientSet); image != "alpine:3.19" {
+		t.Errorf("expected the existing job kept, got the image: %s", image)
+	}
+}
+
+func TestAttachJobCopiesTheSelector(t *testing.T) {
+	given := map[string]string{Label: "repo-1-1600000000", "team": "platform"}
+	p := newTestPlugin(Options{LabelSelector: given})
+	job := testJob(p, v1.JobStatus{Active: 1})
+	job.Labels = map[string]string{Label: "repo-1-1500000000"}
+	p.attachJob(job)
+
+	if given[Label] != "repo-1-1600000000" {
+		t.Errorf("the selector of the options is modified: %v", given)
+	}
+	if p.LabelSelector[Label] != "repo-1-1500000000" || p.LabelSelector["team"] != "platform" {
+		t.Errorf("expected the selector of the attached job, got: %v", p.LabelSelector)
+	}
+
+	// the selector of an adopted job is its own
+	p = newTestPlugin(Options{JobName: "deploy-42", AdoptExisting: true})
+	job = testJob(p, v1.JobStatus{Active: 1})
+	job.Spec.Selector = &metaV1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "1234"}}
+	p.attachJob(job)
+	p.LabelSelector["controller-uid"] = "5678"
+
+	if uid := job.Spec.Selector.MatchLabels["controller-uid"]; uid != "1234" {
+		t.Errorf("the selector of the adopted job is shared: %s", uid)
+	}
+}
+
+func TestCreateJobReplacesAnExistingJob(t *testing.T) {
+	p := newTestPlugin(Options{OnExists: JobExistsReplace, WorkspaceType: WorkspaceTypeEmptyDir})
+	clientSet, existing := existingJob(p)
+	// the job is gone by the time it's watched
+	deleted := watch.NewFakeWithChanSize(1, false)
+	deleted.Delete(existing)
+	clientSet.PrependWatchReactor("jobs", k8sTesting.DefaultWatchReactor(deleted, nil))
+
+	if err := p.CreateJob(context.Background(), clientSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.attached {
+		t.Errorf("expected a new job created instead of attaching to the existing one")
+	}
+	if image := jobImage(t, p, clientSet); image != p.Image {
+		t.Errorf("expected the job replaced by the one running %s, got the image: %s", p.Image, image)
+	}
+}
+
+func TestRunAdoptsTheGivenJob(t *testing.T) {
+	p := newTestPlugin(Options{JobName: "deploy-42", AdoptExisting: true, WorkspaceType: WorkspaceTypeEmptyDir,
+		LogFile: filepath.Join(t.TempDir(), "build.log")})
+	existing := testJob(p, v1.JobStatus{Active: 1})
+	// created elsewhere, without the labels of the build
+	existing.Labels = nil
+	existing.Spec.Selector = &metaV1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "4242"}}
+
+	running := &coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{Name: "deploy-42-abcde", Namespace: p.Namespace,
+			Labels: existing.Spec.Selector.MatchLabels},
+		Spec:   coreV1.PodSpec{Containers: []coreV1.Container{{Name: "build"}}},
+		Status: coreV1.PodStatus{Phase: coreV1.PodRunning},
+	}
+	// the pod is done by the time its logs are streamed
+	completed := running.DeepCopy()
+	completed.Status.Phase = coreV1.PodSucceeded
+	clientSet := fake.NewSimpleClientset(existing, completed)
+
+	// the API server sends the existing objects to the watches (the fake one only sends the changes)
+	var watcherLock sync.Mutex
+	var jobWatcher *watch.FakeWatcher
+	clientSet.PrependWatchReactor("jobs", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		watcherLock.Lock()
+		defer watcherLock.Unlock()
+		jobWatcher = watch.NewFakeWithChanSize(1, false)
+		jobWatcher.Add(existing)
+		return true, jobWatcher, nil
+	})
+	clientSet.PrependWatchReactor("pods", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFakeWithChanSize(1, false)
+		watcher.Add(running)
+		return true, watcher, nil
+	})
+
+	// the job completes once the logs of its running pod are streamed (or the wait is over)
+	streamed := make(chan bool, 1)
+	go func() {
+		found := false
+		for deadline := time.Now().Add(5 * time.Second); !found && time.Now().Before(deadline); {
+			content, _ := os.ReadFile(p.LogFile)
+			found = strings.Contains(string(content), "[deploy-42-abcde] [build] fake logs")
+			time.Sleep(10 * time.Millisecond)
+		}
+		streamed <- found
+
+		watcherLock.Lock()
+		defer watcherLock.Unlock()
+		jobWatcher.Modify(testJob(p, v1.JobStatus{Succeeded: 1}))
+	}()
+
+	result := make(chan error)
+	go func() {
+		result <- p.Run(context.Background(), clientSet)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the adopted job is not watched till it completes")
+	}
+	if !<-streamed {
+		t.Errorf("the logs of the running pod are not streamed while the job runs")
+	}
+
+	jobWatches := 0
+	for _, action := range clientSet.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "delete" {
+			t.Errorf("unexpected %s of the %s", action.GetVerb(), action.GetResource().Resource)
+		}
+		if watchAction, ok := action.(k8sTesting.WatchAction); ok && action.GetResource().Resource == "jobs" {
+			jobWatches++
+			if selector := watchAction.GetWatchRestrictions().Fields.String(); selector != "metadata.name=deploy-42" {
+				t.Errorf("expected the job watched by its name, got the selector: [ %s ]", selector)
+			}
+		}
+	}
+	if jobWatches == 0 {
+		t.Errorf("the adopted job is not watched")
+	}
+}
+
+func TestAssembleJobDecouplesTheContainerNameFromTheJobName(t *testing.T) {
+	job := assembledJob(t, Options{JobName: "octocat-hello-world-1600000000", ContainerName: "build",
+		WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "hello-world-1-workspace"})
+
+	if job.Name != "octocat-hello-world-1600000000" || job.Spec.Template.Name != job.Name {
+		t.Errorf("expected the job and the pod named after the job, got: %s, %s", job.Name, job.Spec.Template.Name)
+	}
+	podSpec := job.Spec.Template.Spec
+	if podSpec.Containers[0].Name != "build" {
+		t.Errorf("expected the container named build, got: %s", podSpec.Containers[0].Name)
+	}
+	if podSpec.Containers[0].VolumeMounts[0].Name != "build" || podSpec.Volumes[0].Name != "build" {
+		t.Errorf("expected the workspace volume named build, got: %s, %s", podSpec.Containers[0].VolumeMounts[0].Name,
+			podSpec.Volumes[0].Name)
+	}
+}
+
+func TestAssembleJobProjectsTheServiceAccountToken(t *testing.T) {
+	opts := Options{TokenAudience: "sts.amazonaws.com", TokenExpiration: time.Hour, TokenPath: "/var/run/secrets/tokens"}
+	if err := newTestPlugin(opts).Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	podSpec := assembledJob(t, opts).Spec.Template.Spec
+
+	var projected *coreV1.ProjectedVolumeSource
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == tokenVolumeName {
+			projected = volume.Projected
+		}
+	}
+	if projected == nil || len(projected.Sources) != 1 || projected.Sources[0].ServiceAccountToken == nil {
+		t.Fatalf("expected the projected service account token volume, got: %+v", podSpec.Volumes)
+	}
+	expiration := int64(3600)
+	expected := coreV1.ServiceAccountTokenProjection{Audience: "sts.amazonaws.com", ExpirationSeconds: &expiration, Path: "token"}
+	if token := projected.Sources[0].ServiceAccountToken; !reflect.DeepEqual(*token, expected) {
+		t.Errorf("expected the token projection: %+v, got: %+v", expected, *token)
+	}
+
+	expectedMount := coreV1.VolumeMount{Name: tokenVolumeName, MountPath: "/var/run/secrets/tokens", ReadOnly: true}
+	mounted := false
+	for _, mount := range podSpec.Containers[0].VolumeMounts {
+		mounted = mounted || reflect.DeepEqual(mount, expectedMount)
+	}
+	if !mounted {
+		t.Errorf("expected the token mounted read-only, got the mounts: %+v", podSpec.Containers[0].VolumeMounts)
+	}
+
+	// no token projected without an audience
+	for _, volume := range assembledJob(t, Options{}).Spec.Template.Spec.Volumes {
+		if volume.Name == tokenVolumeName {
+			t.Errorf("unexpected token volume without an audience")
+		}
+	}
+}
+
+func TestAssembleJobMergesTheFileEnvs(t *testing.T) {
+	fileEnvs := []coreV1.EnvVar{{Name: "VERSION", Value: "1.2.3"}}
+	env := assembledJob(t, Options{Env: map[string]string{"DRONE_BRANCH": "main"}, FileEnvs: fileEnvs}).Spec.Template.Spec.Containers[0].Env
+
+	names := envNames(env)
+	if !reflect.DeepEqual(names, []string{"DRONE_BRANCH", "VERSION"}) {
+		t.Errorf("expected the forwarded and the file env vars, got: %v", names)
+	}
+	if env[len(env)-1].Value != "1.2.3" {
+		t.Errorf("expected the value of the file env var, got: %s", env[len(env)-1].Value)
+	}
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import "strings"
+
+// the value the secrets are masked with in the logs
+const redactedValue = "******"
+
+// DefaultRedactKeys the glob patterns of the env vars whose values are masked in the logs
+var DefaultRedactKeys = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*", "*KEY*"}
+
+// redacted masks the value if the key looks like the one of a secret (matches any of the patterns)
+func redacted(key, value string, patterns []string) string {
+	if matchesAny(strings.ToUpper(key), patterns) {
+		return redactedValue
+	}
+	return value
+}
+
+// RedactedEnv masks the secret values of the key=value pairs of the environment
+func RedactedEnv(env []string, patterns []string) []string {
+	redactedEnv := make([]string, 0, len(env))
+	for _, envVar := range env {
+		keyVal := strings.SplitN(envVar, "=", 2)
+		if len(keyVal) == 2 {
+			envVar = keyVal[0] + "=" + redacted(keyVal[0], keyVal[1], patterns)
+		}
+		redactedEnv = append(redactedEnv, envVar)
+	}
+	return redactedEnv
+}
+
+// RedactedEnvMap masks the secret values of the env map
+func RedactedEnvMap(env map[string]string, patterns []string) map[string]string {
+	redactedEnv := make(map[string]string, len(env))
+	for key, value := range env {
+		redactedEnv[key] = redacted(key, value, patterns)
+	}
+	return redactedEnv
+}
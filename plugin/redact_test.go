@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRedactedEnv(t *testing.T) {
+	env := []string{"GITHUB_TOKEN=ghp_123", "DB_PASSWORD=hunter2", "aws_secret_access_key=abc", "HOME=/root", "EMPTY", "DSN=a=b"}
+
+	expected := []string{"GITHUB_TOKEN=******", "DB_PASSWORD=******", "aws_secret_access_key=******", "HOME=/root", "EMPTY", "DSN=a=b"}
+	if redactedEnv := RedactedEnv(env, DefaultRedactKeys); !reflect.DeepEqual(redactedEnv, expected) {
+		t.Errorf("expected %v, got: %v", expected, redactedEnv)
+	}
+}
+
+func TestRedactedEnvMapWithExtraPatterns(t *testing.T) {
+	env := map[string]string{"PLUGIN_API_KEY": "123", "PLUGIN_DSN": "postgres://user:pass@db", "PLUGIN_TARGET": "linux"}
+	patterns := append(append([]string{}, DefaultRedactKeys...), "*_DSN")
+
+	expected := map[string]string{"PLUGIN_API_KEY": redactedValue, "PLUGIN_DSN": redactedValue, "PLUGIN_TARGET": "linux"}
+	if redactedEnv := RedactedEnvMap(env, patterns); !reflect.DeepEqual(redactedEnv, expected) {
+		t.Errorf("expected %v, got: %v", expected, redactedEnv)
+	}
+	if env["PLUGIN_API_KEY"] != "123" {
+		t.Errorf("the original env is modified")
+	}
+}
+
+func TestOriginalEnvVarsAreLoggedRedacted(t *testing.T) {
+	logs := test.NewGlobal()
+	level := logrus.GetLevel()
+	defer func() {
+		logrus.SetLevel(level)
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	}()
+	logrus.SetLevel(logrus.DebugLevel)
+
+	p := newTestPlugin(Options{Env: map[string]string{"PLUGIN_TOKEN": "ghp_123", "DRONE_BRANCH": "main"},
+		RedactKeys: DefaultRedactKeys})
+	envVars := p.originalEnvVars()
+
+	masked := false
+	for _, entry := range logs.AllEntries() {
+		if strings.Contains(entry.Message, "ghp_123") {
+			t.Errorf("the token is logged: %s", entry.Message)
+		}
+		masked = masked || strings.Contains(entry.Message, redactedValue)
+	}
+	if !masked {
+		t.Errorf("the masked env is not logged")
+	}
+	if len(envVars) != 2 || envVars[1].Value != "ghp_123" {
+		t.Errorf("the env passed to the job is redacted: %v", envVars)
+	}
+}
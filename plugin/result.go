@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// result represents the outcome of the build as written to the result file
+type result struct {
+	JobName         string  `json:"jobName"`
+	Namespace       string  `json:"namespace"`
+	Phase           string  `json:"phase"`
+	ExitCode        *int32  `json:"exitCode"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// writeResult writes the outcome of the build to the result file (if set) as JSON
+// The exit code is the one of the job container as last seen terminated, null if it didn't terminate
+func (p *Plugin) writeResult(err error) {
+	if p.ResultFile == "" {
+		return
+	}
+
+	buildResult := result{
+		JobName:   p.CurrentJobName(),
+		Namespace: p.Namespace,
+		Phase:     outcomeSuccess,
+	}
+	if err != nil {
+		buildResult.Phase = outcomeFailure
+	}
+
+	p.progress.lock.Lock()
+	buildResult.ExitCode = p.progress.exitCode
+	if !p.progress.jobCreated.IsZero() {
+		completed := p.progress.jobCompleted
+		if completed.IsZero() {
+			// the job didn't complete (eg. the plugin timed out)
+			completed = time.Now()
+		}
+		buildResult.DurationSeconds = completed.Sub(p.progress.jobCreated).Seconds()
+	}
+	p.progress.lock.Unlock()
+
+	content, err := json.Marshal(buildResult)
+	if err != nil {
+		logrus.Errorf("could not marshal the result. error: %s", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(p.ResultFile, content, 0644); err != nil {
+		logrus.Errorf("could not write the result file: [ %s ], error: %s", p.ResultFile, err)
+		return
+	}
+	logrus.Debugf("result written to: [ %s ]", p.ResultFile)
+}
+
+// recordExitCode records the exit code of the job container (the first container of the pod) if it terminated
+func (p *Plugin) recordExitCode(pod *coreV1.Pod) {
+	if len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != pod.Spec.Containers[0].Name || status.State.Terminated == nil {
+			continue
+		}
+
+		exitCode := status.State.Terminated.ExitCode
+		p.progress.lock.Lock()
+		p.progress.exitCode = &exitCode
+		p.progress.lock.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// writtenResult writes the result of the build whose job container exited with the exit code after a minute and a half,
+// the written JSON is returned as a map
+func writtenResult(t *testing.T, exitCode int32, buildErr error) map[string]interface{} {
+	p := newTestPlugin(Options{ResultFile: filepath.Join(t.TempDir(), "result.json")})
+	created := time.Now().Add(-time.Minute)
+	p.recordJobCreated(created)
+	p.progress.jobCompleted = created.Add(90 * time.Second)
+
+	pod := testPod(p, "pod-1")
+	pod.Spec.Containers = []coreV1.Container{{Name: "build"}}
+	pod.Status.ContainerStatuses = []coreV1.ContainerStatus{{
+		Name:  "build",
+		State: coreV1.ContainerState{Terminated: &coreV1.ContainerStateTerminated{ExitCode: exitCode}},
+	}}
+	p.recordExitCode(pod)
+	p.writeResult(buildErr)
+
+	content, err := os.ReadFile(p.ResultFile)
+	if err != nil {
+		t.Fatalf("could not read the result file: %s", err)
+	}
+	written := make(map[string]interface{})
+	if err := json.Unmarshal(content, &written); err != nil {
+		t.Fatalf("invalid result: %s, error: %s", content, err)
+	}
+	return written
+}
+
+func TestResultOfSucceededJob(t *testing.T) {
+	expected := map[string]interface{}{
+		"jobName":         "repo-1-1600000000",
+		"namespace":       "default",
+		"phase":           outcomeSuccess,
+		"exitCode":        float64(0),
+		"durationSeconds": float64(90),
+	}
+	if written := writtenResult(t, 0, nil); !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected the result: %v, got: %v", expected, written)
+	}
+}
+
+func TestResultOfFailedJob(t *testing.T) {
+	expected := map[string]interface{}{
+		"jobName":         "repo-1-1600000000",
+		"namespace":       "default",
+		"phase":           outcomeFailure,
+		"exitCode":        float64(2),
+		"durationSeconds": float64(90),
+	}
+	if written := writtenResult(t, 2, errors.New("job failed")); !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected the result: %v, got: %v", expected, written)
+	}
+}
@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// the volume snapshot resource provided by the CSI external snapshotter
+	volumeSnapshotResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshots",
+	}
+)
+
+// SnapshotWorkspace takes a volume snapshot of the workspace PVC so that the state of a failed build can be inspected
+// It's a no-op if preserving the workspace is not enabled or the cluster doesn't support volume snapshots
+func (p *Plugin) SnapshotWorkspace(ctx context.Context, clientSet kubernetes.Interface) {
+	if !p.PreserveWorkspace {
+		return
+	}
+
+	if p.DynamicClient == nil {
+		logrus.Warnf("no dynamic client is set up, the workspace is not preserved")
+		return
+	}
+
+	if p.WorkspaceType == WorkspaceTypeEmptyDir {
+		logrus.Warnf("the workspace is an emptyDir, it can't be preserved")
+		return
+	}
+
+	groupVersion := volumeSnapshotResource.GroupVersion().String()
+	if _, err := clientSet.Discovery().ServerResourcesForGroupVersion(groupVersion); err != nil {
+		logrus.Warnf("volume snapshots [ %s ] are not supported, the workspace is not preserved. error: %s", groupVersion, err)
+		return
+	}
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetAPIVersion(groupVersion)
+	snapshot.SetKind("VolumeSnapshot")
+	snapshot.SetName(p.workspaceSnapshotName())
+	snapshot.SetNamespace(p.Namespace)
+	snapshot.SetLabels(p.LabelSelector)
+
+	source := map[string]interface{}{
+		"persistentVolumeClaimName": p.WorkspacePVC,
+	}
+	if err := unstructured.SetNestedMap(snapshot.Object, source, "spec", "source"); err != nil {
+		logrus.Errorf("could not set up the workspace snapshot. error: %s", err)
+		return
+	}
+
+	if p.VolumeSnapshotClass != "" {
+		if err := unstructured.SetNestedField(snapshot.Object, p.VolumeSnapshotClass, "spec", "volumeSnapshotClassName"); err != nil {
+			logrus.Errorf("could not set up the workspace snapshot. error: %s", err)
+			return
+		}
+	}
+
+	created, err := p.DynamicClient.Resource(volumeSnapshotResource).Namespace(p.Namespace).Create(ctx, snapshot, metaV1.CreateOptions{})
+	if err != nil {
+		logrus.Errorf("could not snapshot the workspace PVC: [ %s ], error: %s", p.WorkspacePVC, err)
+		return
+	}
+
+	logrus.Infof("workspace preserved in volume snapshot: [ %s ]", created.GetName())
+}
+
+// workspaceSnapshotName assembles the name of the workspace snapshot of the build (eg. repository-123-workspace-<job>)
+func (p *Plugin) workspaceSnapshotName() string {
+	return strings.ToLower(strings.Join([]string{p.WorkspacePVC, p.CurrentJobName()}, "-"))
+}
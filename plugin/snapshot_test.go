@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// snapshotPlugin sets up a plugin preserving its workspace through a fake dynamic client
+func snapshotPlugin(options Options) (*Plugin, *dynamicFake.FakeDynamicClient) {
+	dynamicClient := dynamicFake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{volumeSnapshotResource: "VolumeSnapshotList"})
+	options.PreserveWorkspace = true
+	options.DynamicClient = dynamicClient
+	return newTestPlugin(options), dynamicClient
+}
+
+// snapshotCapableClientSet returns a clientset of a cluster serving the volume snapshots
+func snapshotCapableClientSet() *fake.Clientset {
+	clientSet := fake.NewSimpleClientset()
+	clientSet.Resources = []*metaV1.APIResourceList{{
+		GroupVersion: volumeSnapshotResource.GroupVersion().String(),
+		APIResources: []metaV1.APIResource{{Name: volumeSnapshotResource.Resource, Kind: "VolumeSnapshot", Namespaced: true}},
+	}}
+	return clientSet
+}
+
+func TestSnapshotWorkspaceCreatesTheSnapshot(t *testing.T) {
+	p, dynamicClient := snapshotPlugin(Options{
+		WorkspaceType:       WorkspaceTypePVC,
+		WorkspacePVC:        "repo-1-workspace",
+		VolumeSnapshotClass: "csi-snapshots",
+	})
+	p.SnapshotWorkspace(context.Background(), snapshotCapableClientSet())
+
+	snapshot, err := dynamicClient.Resource(volumeSnapshotResource).Namespace(p.Namespace).
+		Get(context.Background(), "repo-1-workspace-repo-1-1600000000", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the workspace snapshot created, error: %s", err)
+	}
+	spec := snapshot.Object["spec"].(map[string]interface{})
+	if claim := spec["source"].(map[string]interface{})["persistentVolumeClaimName"]; claim != "repo-1-workspace" {
+		t.Errorf("expected the snapshot of the workspace PVC, got: %v", claim)
+	}
+	if class := spec["volumeSnapshotClassName"]; class != "csi-snapshots" {
+		t.Errorf("expected the snapshot class: csi-snapshots, got: %v", class)
+	}
+}
+
+func TestSnapshotWorkspaceSkipsUnsupportedGroup(t *testing.T) {
+	p, dynamicClient := snapshotPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	p.SnapshotWorkspace(context.Background(), fake.NewSimpleClientset())
+
+	if actions := dynamicClient.Actions(); len(actions) != 0 {
+		t.Errorf("expected no snapshot without the snapshot API, got: %v", actions)
+	}
+}
+
+func TestSnapshotWorkspaceSkipsEmptyDir(t *testing.T) {
+	p, dynamicClient := snapshotPlugin(Options{WorkspaceType: WorkspaceTypeEmptyDir})
+	p.SnapshotWorkspace(context.Background(), snapshotCapableClientSet())
+
+	if actions := dynamicClient.Actions(); len(actions) != 0 {
+		t.Errorf("expected no snapshot of an emptyDir workspace, got: %v", actions)
+	}
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// summary tracks the resources of the build and whether they got deleted, it's logged once the build is done
+type summary struct {
+	// the names of the job pods in the order they were seen
+	pods []string
+	// the deleted resources by kind and name (eg. job/repo-1)
+	deleted map[string]bool
+	lock    sync.Mutex
+}
+
+// recordPod records a pod of the job (once)
+func (p *Plugin) recordPod(name string) {
+	p.summary.lock.Lock()
+	defer p.summary.lock.Unlock()
+	for _, pod := range p.summary.pods {
+		if pod == name {
+			return
+		}
+	}
+	p.summary.pods = append(p.summary.pods, name)
+}
+
+// recordDeleted records that the resource got deleted (or it was gone already)
+func (p *Plugin) recordDeleted(resource, name string) {
+	p.summary.lock.Lock()
+	defer p.summary.lock.Unlock()
+	if p.summary.deleted == nil {
+		p.summary.deleted = make(map[string]bool)
+	}
+	p.summary.deleted[resource+"/"+name] = true
+}
+
+// logSummary lists the resources of the build and their fate: deleted or kept
+// Nothing is logged if the build didn't get to create (or attach to) a job
+func (p *Plugin) logSummary() {
+	p.progress.lock.Lock()
+	jobCreated := !p.progress.jobCreated.IsZero()
+	p.progress.lock.Unlock()
+	if !jobCreated {
+		return
+	}
+
+	p.summary.lock.Lock()
+	defer p.summary.lock.Unlock()
+
+	logrus.Infof("resources of the build in namespace: [ %s ]", p.Namespace)
+	jobName := p.CurrentJobName()
+	logrus.Infof("  job: [ %s ], %s", jobName, fate(p.summary.deleted["job/"+jobName]))
+	if p.WorkspaceType == WorkspaceTypePVC {
+		logrus.Infof("  pvc: [ %s ], %s", p.WorkspacePVC, fate(p.summary.deleted["pvc/"+p.WorkspacePVC]))
+	}
+	for _, pod := range p.summary.pods {
+		logrus.Infof("  pod: [ %s ], %s", pod, fate(p.summary.deleted["pod/"+pod]))
+	}
+}
+
+// fate describes whether a resource got deleted
+func fate(deleted bool) string {
+	if deleted {
+		return "deleted"
+	}
+	return "kept"
+}
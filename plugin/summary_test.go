@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/batch/v1"
+)
+
+// loggedMessages returns the messages of the log entries
+func loggedMessages(logs *test.Hook) []string {
+	messages := make([]string, 0)
+	for _, entry := range logs.AllEntries() {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func TestSummaryListsTheResourcesOfTheBuild(t *testing.T) {
+	p := newTestPlugin(Options{WorkspaceType: WorkspaceTypePVC, WorkspacePVC: "repo-1-workspace"})
+	p.recordJobCreated(time.Now())
+	for _, pod := range []string{"repo-1-1600000000-abcde", "repo-1-1600000000-fghij", "repo-1-1600000000-abcde"} {
+		p.recordPod(pod)
+	}
+	p.recordDeleted("job", p.JobName)
+	p.recordDeleted("pod", "repo-1-1600000000-abcde")
+
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	p.logSummary()
+
+	expected := []string{
+		"resources of the build in namespace: [ default ]",
+		"  job: [ repo-1-1600000000 ], deleted",
+		"  pvc: [ repo-1-workspace ], kept",
+		"  pod: [ repo-1-1600000000-abcde ], deleted",
+		"  pod: [ repo-1-1600000000-fghij ], kept",
+	}
+	if messages := loggedMessages(logs); !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected the summary: %q, got: %q", expected, messages)
+	}
+}
+
+func TestRunLogsTheDeletedJobInTheSummary(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	p := newTestPlugin(Options{SkipLogs: true, WorkspaceType: WorkspaceTypeEmptyDir})
+	if err := p.Run(context.Background(), completingClientSet(v1.JobStatus{Succeeded: 1})); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	messages := loggedMessages(logs)
+	if len(messages) < 2 || messages[len(messages)-1] != "  job: [ repo-1-1600000000 ], deleted" {
+		t.Errorf("expected the summary of the deleted job last, got: %q", messages)
+	}
+}
+
+func TestNoSummaryWithoutJob(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	newTestPlugin(Options{}).logSummary()
+	if messages := loggedMessages(logs); len(messages) != 0 {
+		t.Errorf("expected no summary before the job is created, got: %q", messages)
+	}
+}